@@ -0,0 +1,78 @@
+// virgo-net changes host network for virgo, so virgo itself runs
+// unprivileged. It's installed setuid root:
+//
+//	sudo chown root virgo-net && sudo chmod u+s virgo-net
+//
+// and accepts only operations of network.ParseRequest, e.g.:
+//
+//	virgo-net tap-create tap1
+//	virgo-net addr tap1 10.1.2.1
+//	virgo-net nat-add tap1 10.1.2.0/24
+//
+// Addresses are limited to pool of network.HelperPoolFile, which is set at
+// install time, e.g.:
+//
+//	echo 10.1.0.0/16 | sudo tee /etc/virgo-net.conf
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/deferpanic/virgo/pkg/network"
+)
+
+// commands are looked up in system directories only
+const securePath = "/usr/sbin:/usr/bin:/sbin:/bin"
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("virgo-net: ")
+
+	uid := os.Getuid()
+
+	if os.Geteuid() != 0 {
+		log.Fatalf("root privileges are needed, make it setuid root: sudo chown root %s && sudo chmod u+s %s", os.Args[0], os.Args[0])
+	}
+
+	pool, err := network.LoadHelperPool(network.HelperPoolFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	req, err := network.ParseRequest(os.Args[1:], uid, pool)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := req.Authorize(runtime.GOOS); err != nil {
+		log.Fatal(err)
+	}
+
+	cmds, err := req.Commands(runtime.GOOS)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// nothing of caller's environment is passed to commands, real uid is
+	// changed as well, so tools don't drop privileges of setuid
+	os.Clearenv()
+	os.Setenv("PATH", securePath)
+
+	if err := syscall.Setuid(0); err != nil {
+		log.Fatalf("error switching to root - %s", err)
+	}
+
+	for _, c := range cmds {
+		cmd := exec.Command(c.Args[0], c.Args[1:]...)
+		cmd.Stdin = strings.NewReader(c.Stdin)
+
+		if out, err := cmd.CombinedOutput(); err != nil && !c.Optional {
+			log.Fatalf("error running '%s' - %s\n%s", strings.Join(c.Args, " "), err, out)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/deferpanic/virgo/pkg/bundle"
+	"github.com/deferpanic/virgo/pkg/project"
+	"github.com/deferpanic/virgo/pkg/registry"
+)
+
+var (
+	saveCommand = app.Command("save", "Save project to bundle, which can be loaded without network access")
+	saveOutput  = saveCommand.Flag("output", "Output file, - for stdout.").Short('o').Default("-").String()
+	saveName    = saveCommand.Arg("name", "Project name.").Required().String()
+
+	loadCommand = app.Command("load", "Load project from bundle")
+	loadFile    = loadCommand.Arg("file", "Bundle file, - for stdin.").Default("-").String()
+)
+
+func save(r *registry.Registry) error {
+	pr := r.Project(*saveName)
+	if pr.Name() == "" {
+		return fmt.Errorf("Project '%s' not found", *saveName)
+	}
+
+	if _, err := os.Stat(pr.ManifestFile()); err != nil {
+		return fmt.Errorf("Project '%s' isn't pulled", pr.Name())
+	}
+
+	if *dry {
+		fmt.Printf("save %s to %s\n", pr.Name(), *saveOutput)
+		return nil
+	}
+
+	if *saveOutput == "-" {
+		return bundle.Save(pr, os.Stdout)
+	}
+
+	// partial bundle is never left under requested name
+	tmp := *saveOutput + ".tmp"
+
+	w, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file '%s' - %s", *saveOutput, err)
+	}
+
+	if err := bundle.Save(pr, w); err != nil {
+		w.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, *saveOutput)
+}
+
+// load refuses to replace project which is running, its instances use
+// volumes being replaced
+func load(r *registry.Registry, projects project.Projects) error {
+	var rd io.Reader = os.Stdin
+
+	if *loadFile != "-" {
+		f, err := os.Open(*loadFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		rd = f
+	}
+
+	if *dry {
+		fmt.Printf("load %s\n", *loadFile)
+		return nil
+	}
+
+	running := func(name string) bool {
+		rt := projects.GetProjectByName(name)
+		return rt != nil && len(rt.Process) > 0
+	}
+
+	pr, err := bundle.Load(r, rd, running)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s loaded\n", pr.Name())
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/deferpanic/virgo/pkg/config"
+	"github.com/deferpanic/virgo/pkg/logsink"
+	"github.com/deferpanic/virgo/pkg/network"
+	"github.com/deferpanic/virgo/pkg/registry"
+)
+
+var (
+	root = app.Flag("root", "Registry root, overrides config and "+config.HomeEnv).String()
+
+	configCommand = app.Command("config", "Manage settings of config.yaml")
+
+	configGetCommand = configCommand.Command("get", "Display setting")
+	configGetProject = configGetCommand.Flag("project", "Setting of project, global one is used if it's unset").String()
+	configGetKey     = configGetCommand.Arg("key", "Setting, e.g. qemu.binary.").Required().String()
+
+	configSetCommand = configCommand.Command("set", "Change setting, empty value unsets it")
+	configSetProject = configSetCommand.Flag("project", "Override setting for project").String()
+	configSetKey     = configSetCommand.Arg("key", "Setting, e.g. qemu.binary.").Required().String()
+	configSetValue   = configSetCommand.Arg("value", "Value, comma separated for lists.").Required().String()
+
+	configListCommand = configCommand.Command("list", "Display all settings")
+	configListProject = configListCommand.Flag("project", "Settings of project merged with global ones").String()
+
+	// global config, it's loaded before registry
+	cfg = &config.Config{}
+
+	// registry root helpers are started with
+	registryRoot string
+)
+
+func configFile() string {
+	return filepath.Join(config.Home(), config.File)
+}
+
+// loadConfig reads global config and returns registry root
+func loadConfig() (string, error) {
+	var err error
+
+	if cfg, err = config.Load(configFile()); err != nil {
+		return "", err
+	}
+
+	registry.SetSerialLog(cfg.Log.Serial)
+	network.SetHelper(cfg.Network.Helper)
+
+	result := *root
+
+	if result == "" {
+		result = cfg.Root
+	}
+
+	if result == "" {
+		result = config.Home()
+	}
+
+	return result, nil
+}
+
+// migrateLogSinks moves sinks of file used by older versions to config
+func migrateLogSinks(r *registry.Registry) error {
+	var err error
+
+	if _, err := os.Stat(r.LogSinkFile()); err != nil || len(cfg.Log.Sinks) > 0 {
+		return nil
+	}
+
+	if cfg.Log.Sinks, err = logsink.ReadConfig(r.LogSinkFile()); err != nil {
+		return err
+	}
+
+	if err := cfg.Save(configFile()); err != nil {
+		return err
+	}
+
+	return os.Remove(r.LogSinkFile())
+}
+
+// projectConfig returns settings of project merged with global ones and
+// project config itself
+func projectConfig(pr registry.Project) (config.Config, *config.Config, error) {
+	c, err := config.Load(pr.ConfigFile())
+	if err != nil {
+		return config.Config{}, nil, err
+	}
+
+	return cfg.Merge(c), c, nil
+}
+
+func configCmd(command string, r *registry.Registry) error {
+	var project string
+
+	switch command {
+	case "config get":
+		project = *configGetProject
+	case "config set":
+		project = *configSetProject
+	case "config list":
+		project = *configListProject
+	}
+
+	c, file := cfg, configFile()
+
+	if project != "" {
+		pr := r.Project(project)
+		if pr.Name() == "" {
+			return fmt.Errorf("Project '%s' not found", project)
+		}
+
+		merged, own, err := projectConfig(pr)
+		if err != nil {
+			return err
+		}
+
+		// set changes project config only, get and list show values
+		// which are used by project
+		if command == "config set" {
+			c, file = own, pr.ConfigFile()
+		} else {
+			c = &merged
+		}
+	}
+
+	switch command {
+	case "config get":
+		v, err := c.Get(*configGetKey)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(v)
+
+	case "config set":
+		if err := c.Set(*configSetKey, *configSetValue, project != ""); err != nil {
+			return err
+		}
+
+		if *dry {
+			return nil
+		}
+
+		return c.Save(file)
+
+	case "config list":
+		w := tabwriter.NewWriter(os.Stdout, 4, 8, 2, ' ', 0)
+
+		for _, key := range config.Keys(project == "") {
+			v, _ := c.Get(key)
+			fmt.Fprintf(w, "%s\t%s\n", key, v)
+		}
+
+		w.Flush()
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/cache"
+	"github.com/deferpanic/virgo/pkg/project"
+	"github.com/deferpanic/virgo/pkg/registry"
+	"github.com/deferpanic/virgo/pkg/stats"
+)
+
+var (
+	dfCommand = app.Command("df", "Display disk usage of projects")
+
+	pruneCommand = app.Command("prune", "Remove files not used by running instances")
+	pruneDays    = pruneCommand.Flag("days", "Remove projects which haven't been run for given number of days").Int()
+	pruneDryRun  = pruneCommand.Flag("dry-run", "List files to remove only").Bool()
+)
+
+func df(r *registry.Registry) error {
+	w := tabwriter.NewWriter(os.Stdout, 4, 8, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Project\tKernel\tVolumes\tLogs\tSnapshots\tOther\tTotal\tLast run\n")
+	fmt.Fprintf(w, "-------\t------\t-------\t----\t---------\t-----\t-----\t--------\n")
+
+	var total registry.Usage
+
+	for _, pr := range r.ProjectList() {
+		u, err := pr.Usage()
+		if err != nil {
+			return err
+		}
+
+		total.Kernel += u.Kernel
+		total.Volumes += u.Volumes
+		total.Logs += u.Logs
+		total.Snapshots += u.Snapshots
+		total.Other += u.Other
+
+		lastRun := "never"
+		if t := pr.LastRun(); !t.IsZero() {
+			lastRun = t.Format("2006-01-02 15:04")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", pr.Name(), human(u.Kernel), human(u.Volumes), human(u.Logs), human(u.Snapshots), human(u.Other), human(u.Total()), lastRun)
+	}
+
+	fmt.Fprintf(w, "Total\t%s\t%s\t%s\t%s\t%s\t%s\t\n", human(total.Kernel), human(total.Volumes), human(total.Logs), human(total.Snapshots), human(total.Other), human(total.Total()))
+
+	w.Flush()
+
+	named, err := registry.DiskUsage(r.VolumesDir())
+	if err != nil {
+		return err
+	}
+
+	cached, err := registry.DiskUsage(r.CacheDir())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nNamed volumes: %s\n", human(named))
+	fmt.Printf("Download cache: %s, shared with projects\n", human(cached))
+
+	return nil
+}
+
+// prune collects files before orphaned runtime entries are removed, so
+// ephemeral instances are still known
+func prune(r *registry.Registry, projects *project.Projects) error {
+	dryRun := *pruneDryRun || *dry
+
+	if *pruneDays < 0 {
+		return fmt.Errorf("days can't be negative")
+	}
+
+	garbage, err := projects.Garbage(r, time.Duration(*pruneDays)*24*time.Hour, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, name := range projects.Orphans() {
+		fmt.Printf("runtime entry of %s\n", name)
+	}
+
+	if !dryRun {
+		if err := projects.RemoveOrphans(r); err != nil {
+			return err
+		}
+	}
+
+	c, err := cache.Open(r.CacheDir())
+	if err != nil {
+		return err
+	}
+
+	// cached files of removed projects are collected by next prune
+	unused, err := c.Unused()
+	if err != nil {
+		return err
+	}
+
+	garbage = append(garbage, unused...)
+
+	var freed int64
+
+	for _, path := range garbage {
+		size, err := registry.DiskUsage(path)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\t%s\n", path, human(size))
+
+		if dryRun {
+			freed += size
+			continue
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("error removing %s - %s", path, err)
+		}
+
+		freed += size
+	}
+
+	if dryRun {
+		fmt.Printf("%s would be freed\n", human(freed))
+	} else {
+		fmt.Printf("%s freed\n", human(freed))
+	}
+
+	return nil
+}
+
+func human(n int64) string {
+	return stats.HumanBytes(uint64(n))
+}
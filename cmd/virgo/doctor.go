@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+
+	"github.com/deferpanic/virgo/pkg/depcheck"
+	"github.com/deferpanic/virgo/pkg/network"
+	"github.com/deferpanic/virgo/pkg/project"
+	"github.com/deferpanic/virgo/pkg/registry"
+)
+
+var (
+	doctorCommand = app.Command("doctor", "Check host is able to run instances and explain how to fix it")
+	doctorJson    = doctorCommand.Flag("json", "output as json").Bool()
+)
+
+// doctor prints results of host checks, it fails if any of required ones
+// failed
+func doctor(r *registry.Registry, projects project.Projects) error {
+	checks := depcheck.New(newRunner()).Doctor(r.CapabilitiesFile())
+
+	if cfg.NetworkMode() == network.ModeTap {
+		checks = append(checks, networkCheck(projects))
+	}
+
+	failed := 0
+
+	for _, c := range checks {
+		if !c.Ok && !c.Optional {
+			failed++
+		}
+	}
+
+	if *doctorJson {
+		if err := json.NewEncoder(os.Stdout).Encode(checks); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 4, 8, 2, ' ', 0)
+
+		for _, c := range checks {
+			status := "ok"
+			switch {
+			case !c.Ok && c.Optional:
+				status = "warn"
+			case !c.Ok:
+				status = "FAIL"
+			}
+
+			fmt.Fprintf(w, "[%s]\t%s\t%s\n", status, c.Name, c.Message)
+
+			if c.Hint != "" && !c.Ok {
+				fmt.Fprintf(w, "\t\tfix: %s\n", c.Hint)
+			}
+		}
+
+		w.Flush()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+
+	return nil
+}
+
+// networkCheck checks the next instance gets subnet of pool, which isn't
+// used by host
+func networkCheck(projects project.Projects) depcheck.Check {
+	start, pool, err := cfg.Pool()
+	if err != nil {
+		return depcheck.Check{Name: "network", Message: err.Error()}
+	}
+
+	ip, _ := projects.NextNetwork(start, pool)
+	if ip == "" {
+		return depcheck.Check{
+			Name:    "network",
+			Message: fmt.Sprintf("network pool %s is exhausted", pool),
+			Hint:    "kill unused instances or virgo config set network.pool with larger network",
+		}
+	}
+
+	// helper refuses addresses outside of pool it was installed with
+	helperPool, err := network.LoadHelperPool(network.HelperPoolFile)
+	if err != nil {
+		return depcheck.Check{Name: "network", Message: err.Error()}
+	}
+
+	if !helperPool.Contains(net.ParseIP(ip)) {
+		return depcheck.Check{
+			Name:    "network",
+			Message: fmt.Sprintf("next subnet of %s is outside of %s, which %s accepts", ip, helperPool, network.Helper()),
+			Hint:    fmt.Sprintf("virgo config set network.pool with network of %s or change %s", helperPool, network.HelperPoolFile),
+		}
+	}
+
+	return depcheck.CheckSubnet(ip)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/project"
+	"github.com/deferpanic/virgo/pkg/registry"
+)
+
+var (
+	imagesCommand = app.Command("images", "List pulled projects and their tags")
+	imagesName    = imagesCommand.Arg("name", "Project name.").String()
+
+	tagCommand = app.Command("tag", "Create tag which refers to project, e.g. virgo tag hello hello:stable")
+	tagSource  = tagCommand.Arg("source", "Source project, name[:tag].").Required().String()
+	tagTarget  = tagCommand.Arg("target", "Target project, name[:tag].").Required().String()
+)
+
+// images lists projects which have manifest, newest tags go first
+func images(r *registry.Registry) error {
+	list := []registry.Project{}
+
+	for _, pr := range r.ProjectList() {
+		if *imagesName != "" && pr.Repository() != *imagesName {
+			continue
+		}
+
+		if _, err := os.Stat(pr.ManifestFile()); err == nil {
+			list = append(list, pr)
+		}
+	}
+
+	if len(list) == 0 {
+		fmt.Fprintf(os.Stdout, "No images found\n")
+		return nil
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Repository() != list[j].Repository() {
+			return list[i].Repository() < list[j].Repository()
+		}
+
+		return pulled(list[i]).After(pulled(list[j]))
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 4, 8, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Project\tTag\tPulled\tSize\tHash\n")
+	fmt.Fprintf(w, "-------\t---\t------\t----\t----\n")
+
+	for _, pr := range list {
+		u, err := pr.Usage()
+		if err != nil {
+			return err
+		}
+
+		hash, err := pr.Hash()
+		if err != nil {
+			hash = "-"
+		} else {
+			hash = hash[:12]
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", pr.Repository(), pr.Tag(), pulled(pr).Format("2006-01-02 15:04"), human(u.Kernel+u.Volumes), hash)
+	}
+
+	w.Flush()
+
+	return nil
+}
+
+// tag refuses to replace project which is running, its instances use
+// volumes being replaced
+func tag(r *registry.Registry, projects project.Projects) error {
+	if name, _ := registry.SplitTag(*tagTarget); name == "" {
+		*tagTarget = r.Project(*tagSource).Repository() + *tagTarget
+	}
+
+	if rt := projects.GetProjectByName(r.Project(*tagTarget).Name()); rt != nil && len(rt.Process) > 0 {
+		return fmt.Errorf("Project '%s' is running, kill it first", *tagTarget)
+	}
+
+	if *dry {
+		fmt.Printf("tag %s %s\n", *tagSource, *tagTarget)
+		return nil
+	}
+
+	_, err := r.Tag(*tagSource, *tagTarget)
+
+	return err
+}
+
+// pulled returns time project was pulled or tagged
+func pulled(pr registry.Project) time.Time {
+	if info, err := os.Stat(pr.ManifestFile()); err == nil {
+		return info.ModTime()
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/health"
+	"github.com/deferpanic/virgo/pkg/hypervisor"
+	"github.com/deferpanic/virgo/pkg/logsink"
+	"github.com/deferpanic/virgo/pkg/network"
+	"github.com/deferpanic/virgo/pkg/project"
+	"github.com/deferpanic/virgo/pkg/proxy"
+	"github.com/deferpanic/virgo/pkg/registry"
+	"github.com/deferpanic/virgo/pkg/runner"
+	"github.com/deferpanic/virgo/pkg/volume"
+)
+
+// instanceOptions are settings of instance given by run flags or compose
+// file, zero values keep manifest settings
+type instanceOptions struct {
+	headless       bool
+	memory         int
+	cpus           int
+	cpuQuota       int
+	env            []string
+	healthcheck    string
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+	healthRetries  int
+	healthStart    time.Duration
+	logSinks       []string
+	balancers      []string
+	volumes        []string
+	ephemeral      bool
+	mounts         []string
+	stack          string
+	service        string
+	hypervisor     string
+	arch           string
+	accel          string
+}
+
+func newRunner() runner.Runner {
+	if *dry {
+		return runner.NewDryRunner(os.Stdout)
+	}
+
+	return runner.NewExecRunner(os.Stdout, os.Stderr, false)
+}
+
+// startInstance runs new instance of project and saves it in runtime
+// together with its background helpers
+func startInstance(r *registry.Registry, projects *project.Projects, pr registry.Project, opts instanceOptions) (*project.Project, error) {
+	// port can't be shared with balancer started by previous run, there's
+	// no need for it anyway as that one picks up new instances
+	for _, mapping := range opts.balancers {
+		host, _, err := proxy.ParseMapping(mapping)
+		if err != nil {
+			return nil, err
+		}
+
+		if !*dry {
+			l, err := net.Listen("tcp", ":"+strconv.Itoa(host))
+			if err != nil {
+				return nil, fmt.Errorf("unable to balance port %d - %s", host, err)
+			}
+
+			l.Close()
+		}
+	}
+
+	settings, _, err := projectConfig(pr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, gw := network.UserIp, network.UserGw
+
+	if settings.NetworkMode() == network.ModeTap {
+		start, pool, err := settings.Pool()
+		if err != nil {
+			return nil, err
+		}
+
+		if ip, gw = projects.NextNetwork(start, pool); ip == "" || gw == "" {
+			return nil, fmt.Errorf("Ip range is exceeded, unable to proceed")
+		}
+	}
+
+	num := projects.NextNum()
+
+	n, err := network.New(pr, num, ip, gw)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := project.New(pr, n, newRunner(), num)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := configure(r, projects, p, opts); err != nil {
+		return nil, err
+	}
+
+	sinks, err := logSinks(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.Run(opts.headless); err != nil {
+		return nil, err
+	}
+
+	if err := projects.Add(p, r); err != nil {
+		p.Stop()
+
+		if rerr := p.Limits.Release(newRunner(), p.InstanceName()); rerr != nil {
+			log.Println(rerr)
+		}
+
+		return nil, err
+	}
+
+	// instance which can't be completed isn't left running
+	abort := func(err error) (*project.Project, error) {
+		if rt := projects.GetProjectByName(p.Name()); rt != nil {
+			for i := range rt.Instance {
+				if rt.Instance[i].Num != p.Num() || i >= len(rt.Process) {
+					continue
+				}
+
+				stopInstance(r, rt, i)
+
+				if rerr := projects.Remove(rt, i, r); rerr != nil {
+					log.Println(rerr)
+				}
+
+				break
+			}
+		}
+
+		return nil, err
+	}
+
+	if err := startHelpers(p, sinks); err != nil {
+		return abort(err)
+	}
+
+	for _, mapping := range opts.balancers {
+		if err := startHelper(p, "proxy", "--project", p.Name(), mapping); err != nil {
+			return abort(err)
+		}
+	}
+
+	return p, nil
+}
+
+// optionsOf returns options instance was started with, so it can be
+// restarted or cloned by scale
+func optionsOf(instance project.Instance) instanceOptions {
+	opts := instanceOptions{
+		headless:   true,
+		memory:     instance.Limits.Memory,
+		cpus:       instance.Limits.Cpus,
+		cpuQuota:   instance.Limits.CpuQuota,
+		env:        instance.Env,
+		logSinks:   instance.LogSinks,
+		stack:      instance.Stack,
+		service:    instance.Service,
+		volumes:    instance.Volumes,
+		mounts:     instance.Mounts,
+		ephemeral:  instance.Ephemeral,
+		hypervisor: instance.Hypervisor,
+		arch:       instance.Arch,
+		accel:      instance.Accel,
+	}
+
+	if c := instance.Healthcheck; c != nil {
+		opts.healthcheck = c.String()
+		opts.healthInterval = c.Interval.Duration
+		opts.healthTimeout = c.Timeout.Duration
+		opts.healthRetries = c.Retries
+		opts.healthStart = c.StartPeriod.Duration
+	}
+
+	return opts
+}
+
+// configure applies config and options to project before it's run.
+// Memory of project config goes over manifest one, global config is used
+// only if manifest doesn't have it.
+func configure(r *registry.Registry, projects *project.Projects, p *project.Project, opts instanceOptions) error {
+	settings, own, err := projectConfig(p.Project)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case opts.memory != 0:
+		p.Limits.Memory = opts.memory
+	case own.Memory != 0, p.Limits.Memory == 0:
+		p.Limits.Memory = settings.Memory
+	}
+
+	p.Limits.Cpus = settings.Cpus
+	if opts.cpus != 0 {
+		p.Limits.Cpus = opts.cpus
+	}
+
+	p.Binary = settings.Qemu.Binary
+	p.Accel = settings.Qemu.Accel
+	if opts.accel != "" {
+		p.Accel = opts.accel
+	}
+	p.Vga = settings.Vga()
+	p.Firmware = settings.Qemu.Firmware
+	p.NetworkMode = settings.NetworkMode()
+
+	if p.Hypervisor, err = hypervisor.Get(opts.hypervisor); err != nil {
+		return err
+	}
+
+	// flag goes over arch of manifest
+	if opts.arch != "" {
+		p.Arch = opts.arch
+	}
+
+	if _, err := hypervisor.GetArch(p.Arch); err != nil {
+		return err
+	}
+
+	p.Limits.CpuQuota = opts.cpuQuota
+	p.Env = opts.env
+	p.LogSinks = opts.logSinks
+	p.Stack = opts.stack
+	p.Service = opts.service
+	p.Ephemeral = opts.ephemeral
+
+	store := volume.NewStore(r.VolumesDir(), newRunner())
+
+	for _, spec := range opts.volumes {
+		v, err := store.Attach(spec)
+		if err != nil {
+			return err
+		}
+
+		if user := projects.VolumeUser(v.Name); user != "" {
+			return fmt.Errorf("volume '%s' is in use by %s", v.Name, user)
+		}
+
+		p.Volumes = append(p.Volumes, v)
+	}
+
+	for _, spec := range opts.mounts {
+		m, err := project.ParseMount(spec)
+		if err != nil {
+			return err
+		}
+
+		p.Mounts = append(p.Mounts, m)
+	}
+
+	if opts.healthcheck != "" {
+		if p.Healthcheck, err = health.Parse(opts.healthcheck); err != nil {
+			return err
+		}
+	}
+
+	if p.Healthcheck != nil {
+		if opts.healthInterval != 0 {
+			p.Healthcheck.Interval.Duration = opts.healthInterval
+		}
+
+		if opts.healthTimeout != 0 {
+			p.Healthcheck.Timeout.Duration = opts.healthTimeout
+		}
+
+		if opts.healthRetries != 0 {
+			p.Healthcheck.Retries = opts.healthRetries
+		}
+
+		if opts.healthStart != 0 {
+			p.Healthcheck.StartPeriod.Duration = opts.healthStart
+		}
+
+		p.Healthcheck.SetDefaults()
+	}
+
+	return nil
+}
+
+// logSinks returns log sinks of instance, they default to ones of config.
+// Every sink is opened once, so misconfigured one fails before instance is
+// started.
+func logSinks(p *project.Project) ([]string, error) {
+	sinks := p.LogSinks
+	if len(sinks) == 0 {
+		settings, _, err := projectConfig(p.Project)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = settings.Log.Sinks
+	}
+
+	for _, uri := range sinks {
+		s, err := logsink.New(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		s.Close()
+	}
+
+	return sinks, nil
+}
+
+// startHelpers starts log shipper and health monitor of running instance
+func startHelpers(p *project.Project, sinks []string) error {
+	if len(sinks) > 0 {
+		if err := shipLogs(p, sinks); err != nil {
+			return err
+		}
+	}
+
+	if p.Healthcheck != nil {
+		// state left by previous instance with the same number
+		os.Remove(p.HealthFile(p.Num()))
+
+		if err := startHelper(p, "health-check", p.Name(), strconv.Itoa(p.Num())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stopInstance stops i-th instance of project, runtime is left untouched
+func stopInstance(r *registry.Registry, rt *project.Runtime, i int) {
+	rt.Stop(i)
+
+	if i >= len(rt.Instance) {
+		return
+	}
+
+	instance := rt.Instance[i]
+
+	if err := instance.Limits.Release(newRunner(), rt.InstanceName(i)); err != nil {
+		log.Println(err)
+	}
+
+	if instance.Ephemeral && !*dry {
+		if err := os.RemoveAll(r.Project(rt.ProjectName).OverlaysDir(instance.Num)); err != nil {
+			log.Printf("error removing overlays of %s - %s", rt.InstanceName(i), err)
+		}
+	}
+}
+
+// waitHealthy blocks until instance becomes healthy
+func waitHealthy(p *project.Project) error {
+	if p.Healthcheck == nil {
+		return fmt.Errorf("No health check configured for %s, unable to wait for instance to become healthy", p.InstanceName())
+	}
+
+	if *dry {
+		return nil
+	}
+
+	alive := func() bool {
+		return runner.IsPidAlive(p.Pid())
+	}
+
+	if _, err := health.Wait(p.HealthFile(p.Num()), 0, alive); err != nil {
+		return fmt.Errorf("%s - %s", p.InstanceName(), err)
+	}
+
+	fmt.Printf("%s is healthy\n", p.InstanceName())
+
+	return nil
+}
+
+// shipLogs starts detached log shipper, which follows serial log of
+// instance and exits together with it.
+func shipLogs(p *project.Project, sinks []string) error {
+	args := []string{"log-ship", p.Name(), strconv.Itoa(p.Num()), strconv.Itoa(p.Pid())}
+	args = append(args, sinks...)
+
+	return startHelper(p, args...)
+}
+
+// startHelper runs virgo itself with given arguments as detached process,
+// it's used for background tasks which live together with instance.
+func startHelper(p *project.Project, args ...string) error {
+	var helper runner.Runner
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error locating virgo executable - %s", err)
+	}
+
+	if *dry {
+		helper = runner.NewDryRunner(os.Stdout)
+	} else {
+		wr, err := os.OpenFile(p.HelperLogFile(p.Num()), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening file '%s' - %s", p.HelperLogFile(p.Num()), err)
+		}
+		defer wr.Close()
+
+		helper = runner.NewExecRunner(wr, wr, true)
+	}
+
+	// helper uses the same registry, whichever way it was chosen
+	if err := helper.Exec(self, append([]string{"--root", registryRoot}, args...)...); err != nil {
+		return fmt.Errorf("error starting %s - %s", args[0], err)
+	}
+
+	return nil
+}
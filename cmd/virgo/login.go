@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/deferpanic/virgo/pkg/credentials"
+	"github.com/deferpanic/virgo/pkg/project"
+	"github.com/deferpanic/virgo/pkg/registry"
+	"github.com/deferpanic/virgo/pkg/tools"
+)
+
+var (
+	profile = app.Flag("profile", "Credentials profile used by remote commands").Envar("VIRGO_PROFILE").String()
+
+	loginCommand = app.Command("login", "Save api token of profile, it's prompted for if stdin is terminal")
+	loginMirror  = loginCommand.Flag("mirror", "Api url of mirror, e.g. https://mirror.local/v1, it serves manifests, kernels and volumes, search isn't mirrored").String()
+
+	logoutCommand = app.Command("logout", "Remove credentials of profile")
+
+	profilesCommand = app.Command("profiles", "List credentials profiles")
+)
+
+// remote commands are the only ones which need credentials
+var remoteCommands = map[string]bool{
+	"pull":   true,
+	"search": true,
+}
+
+// commands which go only through dpcli, so they can't use mirror
+var defaultAPICommands = map[string]bool{
+	"search": true,
+}
+
+// setCredentials makes token and mirror of profile used by api calls
+func setCredentials(r *registry.Registry, command string) error {
+	store, err := credentials.Load(r.CredentialsFile())
+	if err != nil {
+		return err
+	}
+
+	p, err := store.Resolve(*profile)
+	if err != nil {
+		return fmt.Errorf("%s\nlogin via 'virgo login' or set %s, if you have no account signup via\nvirgo signup my@email.com username", err, credentials.TokenEnv)
+	}
+
+	tools.SetToken(p.Token)
+
+	if p.Mirror != "" {
+		if defaultAPICommands[command] {
+			return fmt.Errorf("%s isn't supported by mirror %s, use profile without mirror via --profile", command, p.Mirror)
+		}
+
+		project.APIBase = p.Mirror
+	}
+
+	return nil
+}
+
+func login(r *registry.Registry) error {
+	store, err := credentials.Load(r.CredentialsFile())
+	if err != nil {
+		return err
+	}
+
+	token, err := tools.ReadPassword("Token: ")
+	if err != nil {
+		return err
+	}
+
+	if token == "" {
+		return fmt.Errorf("empty token, unable to proceed")
+	}
+
+	name := *profile
+	if name == "" {
+		name = credentials.DefaultProfile
+	}
+
+	store.Set(name, credentials.Profile{Token: token, Mirror: *loginMirror})
+
+	if err := store.Save(); err != nil {
+		return fmt.Errorf("error saving credentials - %s", err)
+	}
+
+	fmt.Printf("Logged in with profile '%s'\n", name)
+
+	return nil
+}
+
+func logout(r *registry.Registry) error {
+	store, err := credentials.Load(r.CredentialsFile())
+	if err != nil {
+		return err
+	}
+
+	name := *profile
+	if name == "" {
+		name = store.Current
+	}
+
+	if name == "" {
+		name = credentials.DefaultProfile
+	}
+
+	if err := store.Remove(name); err != nil {
+		return err
+	}
+
+	return store.Save()
+}
+
+func profiles(r *registry.Registry) error {
+	store, err := credentials.Load(r.CredentialsFile())
+	if err != nil {
+		return err
+	}
+
+	if len(store.Profiles) == 0 {
+		fmt.Fprintf(os.Stdout, "No profiles found\n")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 4, 8, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Profile\tMirror\tCurrent\n")
+	fmt.Fprintf(w, "-------\t------\t-------\n")
+
+	current := store.Current
+	if current == "" {
+		current = credentials.DefaultProfile
+	}
+
+	for _, name := range store.Names() {
+		mirror := store.Profiles[name].Mirror
+		if mirror == "" {
+			mirror = project.APIBase
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%v\n", name, mirror, name == current)
+	}
+
+	w.Flush()
+
+	return nil
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"runtime"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/deferpanic/dpcli/api"
+	"github.com/deferpanic/virgo/pkg/config"
 	"github.com/deferpanic/virgo/pkg/depcheck"
-	"github.com/deferpanic/virgo/pkg/network"
+	"github.com/deferpanic/virgo/pkg/health"
+	"github.com/deferpanic/virgo/pkg/hypervisor"
+	"github.com/deferpanic/virgo/pkg/logsink"
+	"github.com/deferpanic/virgo/pkg/metrics"
 	"github.com/deferpanic/virgo/pkg/project"
 	"github.com/deferpanic/virgo/pkg/registry"
 	"github.com/deferpanic/virgo/pkg/runner"
+	"github.com/deferpanic/virgo/pkg/stats"
 	"github.com/deferpanic/virgo/pkg/tools"
 
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -25,12 +33,26 @@ var (
 	app = kingpin.New("virgo", "Run Unikernels Locally")
 	dry = app.Flag("dry", "dry run, print commands only").Short('n').Bool()
 
-	pullCommand     = app.Command("pull", "Pull a project")
-	pullProjectName = pullCommand.Arg("name", "Project name.").Required().String()
-
-	runCmd         = app.Command("run", "Run a project")
-	runHeadless    = runCmd.Flag("headless", "Run project headless").Bool()
-	runProjectName = runCmd.Arg("name", "Project name.").Required().String()
+	runCmd            = app.Command("run", "Run a project")
+	runHeadless       = runCmd.Flag("headless", "Run project headless").Bool()
+	runMemory         = runCmd.Flag("memory", "Guest memory in MB, overrides manifest").Int()
+	runCpus           = runCmd.Flag("cpus", "Number of virtual cpus").Int()
+	runCpuQuota       = runCmd.Flag("cpu-quota", "Host cpu quota in percents of one cpu").Int()
+	runHealthCheck    = runCmd.Flag("health-check", "Health check: tcp:port, http:port/path[=status] or log:regex").String()
+	runHealthInterval = runCmd.Flag("health-interval", "Time between health checks").Duration()
+	runHealthTimeout  = runCmd.Flag("health-timeout", "Health check timeout").Duration()
+	runHealthRetries  = runCmd.Flag("health-retries", "Consecutive failures needed to report unhealthy").Int()
+	runHealthStart    = runCmd.Flag("health-start-period", "Time after start when failed health checks aren't counted").Duration()
+	runWaitHealthy    = runCmd.Flag("wait-healthy", "Wait until instance becomes healthy").Bool()
+	runLoadBalancers  = runCmd.Flag("lb", "Balance host port between healthy instances of project, host:guest e.g. 8080:3000").Strings()
+	runVolumes        = runCmd.Flag("volume", "Attach named volume, name:/path e.g. data:/data").Short('v').Strings()
+	runEphemeral      = runCmd.Flag("ephemeral", "Discard changes of project volumes on kill").Bool()
+	runMounts         = runCmd.Flag("mount", "Mount host directory read-only, host:guest[:ro] e.g. ./conf:/etc/app").Strings()
+	runHypervisor     = runCmd.Flag("hypervisor", "Hypervisor: "+strings.Join(hypervisor.Names(), ", ")).Default(hypervisor.Qemu).Enum(hypervisor.Names()...)
+	runAccel          = runCmd.Flag("accel", "Accelerator, auto falls back to tcg if kvm isn't usable: auto, kvm, tcg").Enum(config.AccelAuto, config.AccelKvm, config.AccelTcg)
+	runArch           = runCmd.Flag("arch", "Guest architecture, overrides manifest: "+strings.Join(hypervisor.ArchNames(), ", ")).String()
+	runLogSinks       = runCmd.Flag("log-sink", "Ship serial log to sink: syslog+udp://host:514, syslog+tcp://host:514, syslog+unix:///dev/log, jsonl:///path/file or http(s)://host/path").Strings()
+	runProjectName    = runCmd.Arg("name", "Project name, name:tag runs given tag.").Required().String()
 
 	killCommand     = app.Command("kill", "Kill a running project")
 	killProjectName = killCommand.Arg("name", "Project name.").Required().String()
@@ -41,6 +63,16 @@ var (
 	logCommand     = app.Command("log", "Fetch log of project")
 	logProjectName = logCommand.Arg("name", "Project name.").Required().String()
 
+	logShipCommand     = app.Command("log-ship", "Ship serial log of instance to sinks").Hidden()
+	logShipProjectName = logShipCommand.Arg("name", "Project name.").Required().String()
+	logShipInstance    = logShipCommand.Arg("instance", "Instance number.").Required().Int()
+	logShipPid         = logShipCommand.Arg("pid", "Instance pid.").Required().Int()
+	logShipSinks       = logShipCommand.Arg("sink", "Sink uri.").Required().Strings()
+
+	healthCheckCommand     = app.Command("health-check", "Monitor health of instance").Hidden()
+	healthCheckProjectName = healthCheckCommand.Arg("name", "Project name.").Required().String()
+	healthCheckInstance    = healthCheckCommand.Arg("instance", "Instance number.").Required().Int()
+
 	searchCommand      = app.Command("search", "Search for a project")
 	searchCommandName  = searchCommand.Arg("description", "Description").Required().String()
 	searchCommandStars = searchCommand.Arg("stars", "Star Count").Int()
@@ -48,9 +80,16 @@ var (
 	signupCommand  = app.Command("signup", "Signup")
 	signupEmail    = signupCommand.Arg("email", "Email.").Required().String()
 	signupUsername = signupCommand.Arg("username", "Username.").Required().String()
-	signupPassword = signupCommand.Arg("password", "Password.").Required().String()
 
 	psCommand = app.Command("ps", "List running projects")
+	psStack   = psCommand.Flag("stack", "List instances started by up").Bool()
+
+	statsCommand  = app.Command("stats", "Display resource usage of running projects")
+	statsNoStream = statsCommand.Flag("no-stream", "Print first result and exit").Bool()
+	statsJson     = statsCommand.Flag("json", "output as json").Bool()
+
+	metricsCommand = app.Command("metrics", "Export prometheus metrics of running projects")
+	metricsListen  = metricsCommand.Flag("listen", "Address to listen on").Default(":9323").String()
 
 	listCommand = app.Command("list", "List all projects")
 	listJson    = listCommand.Flag("json", "output as json").Bool()
@@ -58,8 +97,7 @@ var (
 
 func main() {
 	var (
-		stdout, stderr *os.File = os.Stdout, os.Stderr
-		process        runner.Runner
+		process runner.Runner
 	)
 
 	log.SetFlags(log.Lshortfile)
@@ -68,66 +106,54 @@ func main() {
 		fmt.Println(tools.Logo)
 	}
 
-	if len(os.Args) > 1 && os.Args[1] == "signup" {
-		api.Cli = api.NewCliImplementation("")
-	} else {
-		if err := tools.SetToken(); err != nil {
-			log.Fatalf("%s\nif you have and account add your token to '~/.dprc' otherwise signup via\nvirgo signup my@email.com username password", err)
-		}
-	}
+	api.Cli = api.NewCliImplementation("")
 
 	command := kingpin.MustParse(app.Parse(os.Args[1:]))
 
-	if *dry {
-		process = runner.NewDryRunner(stdout)
-	} else {
-		process = runner.NewExecRunner(stdout, stderr, false)
-	}
-
-	dep := depcheck.New(process)
-
-	if command == "run" && runtime.GOOS == "darwin" {
-		var err error
-		log.Println("setting sysctl")
+	process = newRunner()
 
-		if _, err := process.Shell("sysctl -w net.inet.ip.forwarding=1"); err != nil {
-			log.Fatalf("Error enabling ip forwarding - %s", err)
+	// host network is changed by privileged helper when instances start,
+	// so only os version is checked here
+	if (command == "run" || command == "up" || command == "scale" || command == "restart") && runtime.GOOS == "darwin" {
+		if _, err := depcheck.New(process).OsCheck(); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		if _, err = process.Shell("sysctl -w net.link.ether.inet.proxyall=1"); err != nil {
-			log.Fatalf("error enabling proxyall - %s", err)
-		}
+	var err error
 
-		// enable this for lower osx versions
-		version, err := dep.OsCheck()
-		if err != nil {
-			log.Fatal(err)
-		}
-		if dep.IsNeedFw(version) {
-			if _, err = process.Shell("sysctl -w net.inet.ip.fw.enable=1"); err != nil {
-				log.Fatalf("error enabling ip firewall - %s", err)
-			}
-		}
+	if registryRoot, err = loadConfig(); err != nil {
+		log.Fatal(err)
 	}
 
-	r, err := registry.New()
+	r, err := registry.New(registryRoot)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if err := migrateLogSinks(r); err != nil {
+		log.Fatal(err)
+	}
+
 	projects, err := project.LoadProjects(r)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	killProject := func() {
-		rt := projects.GetProjectByName(*killProjectName)
+	if remoteCommands[command] {
+		if err := setCredentials(r, command); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	killProject := func(name string) {
+		rt := projects.GetProjectByName(r.Project(name).Name())
 		if rt == nil {
-			log.Fatalf("Project '%s' isn't running\n", *killProjectName)
+			log.Fatalf("Project '%s' isn't running\n", name)
 		}
 
-		for _, instance := range rt.Process {
-			instance.Stop()
+		for i := range rt.Process {
+			stopInstance(r, rt, i)
 		}
 
 		if err := projects.Delete(rt, r); err != nil {
@@ -137,12 +163,7 @@ func main() {
 
 	switch command {
 	case "pull":
-		pr, err := r.AddProject(*pullProjectName)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if err := project.Pull(pr); err != nil {
+		if err := pull(r, projects); err != nil {
 			log.Fatal(err)
 		}
 
@@ -152,32 +173,52 @@ func main() {
 			log.Fatalf("Project '%s' not found\n", *runProjectName)
 		}
 
-		ip, gw := projects.GetNextNetowrk()
-		if ip == "" || gw == "" {
-			log.Fatal("Ip range is exceeded, unable to proceed")
+		opts := instanceOptions{
+			headless:       *runHeadless,
+			memory:         *runMemory,
+			cpus:           *runCpus,
+			cpuQuota:       *runCpuQuota,
+			healthcheck:    *runHealthCheck,
+			healthInterval: *runHealthInterval,
+			healthTimeout:  *runHealthTimeout,
+			healthRetries:  *runHealthRetries,
+			healthStart:    *runHealthStart,
+			logSinks:       *runLogSinks,
+			balancers:      *runLoadBalancers,
+			volumes:        *runVolumes,
+			ephemeral:      *runEphemeral,
+			mounts:         *runMounts,
+			hypervisor:     *runHypervisor,
+			arch:           *runArch,
+			accel:          *runAccel,
 		}
 
-		network, err := network.New(pr, ip, gw)
+		p, err := startInstance(r, &projects, pr, opts)
 		if err != nil {
 			log.Fatal(err)
 		}
-		fmt.Println("NextNum:", projects.NextNum())
-		p, err := project.New(pr, network, process, projects.NextNum())
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if err = p.Run(*runHeadless); err != nil {
-			log.Fatal(err)
-		}
 
-		if err := projects.Add(p, r); err != nil {
-			log.Fatal(err)
+		if *runWaitHealthy {
+			if err := waitHealthy(p); err != nil {
+				log.Fatal(err)
+			}
 		}
 
 		fmt.Println()
 
 	case "ps":
+		if *psStack {
+			result := projects.StackString()
+			if result == "" {
+				fmt.Fprintf(os.Stdout, "No stacks running\n")
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 4, 8, 2, '\t', 0)
+			fmt.Fprintf(w, "%s", result)
+			w.Flush()
+			break
+		}
+
 		result := projects.String()
 		if result == "" {
 			fmt.Fprintf(os.Stdout, "No projects running\n")
@@ -188,10 +229,82 @@ func main() {
 		w.Flush()
 
 	case "kill":
-		killProject()
+		killProject(*killProjectName)
+
+	case "scale":
+		if err := scale(r, &projects); err != nil {
+			log.Fatal(err)
+		}
+
+	case "restart":
+		if err := restart(r, &projects); err != nil {
+			log.Fatal(err)
+		}
+
+	case "up":
+		if err := up(r, &projects); err != nil {
+			log.Fatal(err)
+		}
+
+	case "down":
+		if err := down(r, &projects); err != nil {
+			log.Fatal(err)
+		}
+
+	case "proxy":
+		if err := runProxy(r); err != nil {
+			log.Fatal(err)
+		}
+
+	case "volume create", "volume ls", "volume rm", "volume inspect", "volume export", "volume import":
+		if err := volumeCmd(command, r, projects); err != nil {
+			log.Fatal(err)
+		}
+
+	case "save":
+		if err := save(r); err != nil {
+			log.Fatal(err)
+		}
+
+	case "load":
+		if err := load(r, projects); err != nil {
+			log.Fatal(err)
+		}
+
+	case "config get", "config set", "config list":
+		if err := configCmd(command, r); err != nil {
+			log.Fatal(err)
+		}
+
+	case "images":
+		if err := images(r); err != nil {
+			log.Fatal(err)
+		}
+
+	case "tag":
+		if err := tag(r, projects); err != nil {
+			log.Fatal(err)
+		}
+
+	case "doctor":
+		if err := doctor(r, projects); err != nil {
+			log.Fatal(err)
+		}
+
+	case "df":
+		if err := df(r); err != nil {
+			log.Fatal(err)
+		}
+
+	case "prune":
+		if err := prune(r, &projects); err != nil {
+			log.Fatal(err)
+		}
 
 	case "rm":
-		killProject()
+		if rt := projects.GetProjectByName(r.Project(*rmProjectName).Name()); rt != nil {
+			killProject(*rmProjectName)
+		}
 
 		if err := r.PurgeProject(*rmProjectName); err != nil {
 			log.Fatal(err)
@@ -207,6 +320,63 @@ func main() {
 			log.Fatal(err)
 		}
 
+	case "log-ship":
+		pr := r.Project(*logShipProjectName)
+		if pr.Name() == "" {
+			log.Fatalf("Project '%s' not found\n", *logShipProjectName)
+		}
+
+		sinks := logsink.Multi{}
+
+		for _, uri := range *logShipSinks {
+			s, err := logsink.New(uri)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			sinks = append(sinks, s)
+		}
+		defer sinks.Close()
+
+		host, _ := os.Hostname()
+
+		entry := logsink.Entry{
+			Host:     host,
+			Project:  pr.Name(),
+			Instance: *logShipInstance,
+		}
+
+		alive := func() bool {
+			return runner.IsPidAlive(*logShipPid)
+		}
+
+		if err := logsink.Follow(pr.SerialLogFile(*logShipInstance), sinks, entry, alive); err != nil {
+			log.Fatal(err)
+		}
+
+	case "health-check":
+		pr := r.Project(*healthCheckProjectName)
+
+		rt := projects.GetProjectByName(pr.Name())
+		if pr.Name() == "" || rt == nil {
+			log.Fatalf("Project '%s' isn't running\n", *healthCheckProjectName)
+		}
+
+		i := rt.Index(*healthCheckInstance)
+		if i == -1 || rt.Instance[i].Healthcheck == nil {
+			log.Fatalf("No health check found for instance %d of '%s'\n", *healthCheckInstance, *healthCheckProjectName)
+		}
+
+		pid := rt.Process[i].Pid
+
+		alive := func() bool {
+			return runner.IsPidAlive(pid)
+		}
+
+		if err := health.Monitor(rt.Instance[i].Healthcheck, rt.Network[i].Ip, pr.SerialLogFile(*healthCheckInstance), pr.HealthFile(*healthCheckInstance), alive); err != nil {
+			log.Fatal(err)
+		}
+
 	case "search":
 		search := &api.Search{}
 		if *searchCommandStars != 0 {
@@ -216,8 +386,90 @@ func main() {
 		}
 
 	case "signup":
+		// password is always prompted for, so it isn't kept in shell history
+		password, err := tools.ReadPassword("Password: ")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if repeat, err := tools.ReadPassword("Repeat password: "); err != nil {
+			log.Fatal(err)
+		} else if repeat != password {
+			log.Fatal("passwords don't match")
+		}
+
 		users := &api.Users{}
-		users.Create(*signupEmail, *signupUsername, *signupPassword)
+		users.Create(*signupEmail, *signupUsername, password)
+
+	case "login":
+		if err := login(r); err != nil {
+			log.Fatal(err)
+		}
+
+	case "logout":
+		if err := logout(r); err != nil {
+			log.Fatal(err)
+		}
+
+	case "profiles":
+		if err := profiles(r); err != nil {
+			log.Fatal(err)
+		}
+
+	case "stats":
+		collector := stats.NewCollector()
+		targets := statsTargets(projects)
+
+		// first sample is needed as a base for cpu usage
+		collector.Collect(targets)
+
+		for {
+			time.Sleep(time.Second)
+
+			// instances could be started or stopped while streaming
+			if current, err := project.LoadProjects(r); err == nil {
+				targets = statsTargets(current)
+			} else {
+				log.Printf("error reloading projects - %s", err)
+			}
+
+			samples := collector.Collect(targets)
+
+			if *statsJson {
+				if err := json.NewEncoder(os.Stdout).Encode(samples); err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				if !*statsNoStream {
+					// clear screen and move cursor home
+					fmt.Print("\033[2J\033[H")
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 4, 8, 2, ' ', 0)
+				stats.WriteTable(w, samples)
+				w.Flush()
+			}
+
+			if *statsNoStream {
+				break
+			}
+		}
+
+	case "metrics":
+		src := func() ([]stats.Target, error) {
+			projects, err := project.LoadProjects(r)
+			if err != nil {
+				return nil, err
+			}
+
+			return statsTargets(projects), nil
+		}
+
+		log.Printf("serving metrics on %s/metrics", *metricsListen)
+
+		if err := metrics.ListenAndServe(*metricsListen, src); err != nil {
+			log.Fatal(err)
+		}
 
 	case "list":
 		var running bool
@@ -248,3 +500,26 @@ func main() {
 	}
 
 }
+
+func statsTargets(projects project.Projects) []stats.Target {
+	result := []stats.Target{}
+
+	for _, rt := range projects {
+		for i, proc := range rt.Process {
+			t := stats.Target{
+				Project: rt.ProjectName,
+				Pid:     proc.Pid,
+			}
+
+			if i < len(rt.Instance) {
+				t.Instance = rt.Instance[i].Num
+				t.Iface = rt.Instance[i].Iface()
+				t.Restarts = rt.Instance[i].Restarts
+			}
+
+			result = append(result, t)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/deferpanic/virgo/pkg/cache"
+	"github.com/deferpanic/virgo/pkg/download"
+	"github.com/deferpanic/virgo/pkg/project"
+	"github.com/deferpanic/virgo/pkg/registry"
+)
+
+var (
+	pullCommand     = app.Command("pull", "Pull a project")
+	pullQuiet       = pullCommand.Flag("quiet", "Don't report progress").Short('q').Bool()
+	pullJson        = pullCommand.Flag("json", "Report progress as json events").Bool()
+	pullParallel    = pullCommand.Flag("parallel", "Number of files downloaded at once").Default("4").Int()
+	pullRetries     = pullCommand.Flag("retries", "Number of retries of failed download").Default("5").Int()
+	pullCheck       = pullCommand.Flag("check", "Report if newer manifest exists without downloading").Bool()
+	pullNoCache     = pullCommand.Flag("no-cache", "Download every file, even if it's cached").Bool()
+	pullProjectName = pullCommand.Arg("name", "Project name, name:tag stores it under given tag.").Required().String()
+)
+
+func pull(r *registry.Registry, projects project.Projects) error {
+	if *pullCheck {
+		return checkProject(r)
+	}
+
+	// pull drops overlays, instances can't lose disks under them
+	if name := r.Project(*pullProjectName).Name(); name != "" {
+		if rt := projects.GetProjectByName(name); rt != nil && len(rt.Process) > 0 {
+			return fmt.Errorf("Project '%s' is running, kill it first", name)
+		}
+	}
+
+	pr, err := r.AddProject(*pullProjectName)
+	if err != nil {
+		return err
+	}
+
+	m := download.New()
+	m.Parallel = *pullParallel
+	m.Retries = *pullRetries
+
+	switch {
+	case *pullJson:
+		m.Progress = download.JSON(os.Stdout)
+	case !*pullQuiet:
+		m.Progress = download.Bar(os.Stderr)
+	}
+
+	var c *cache.Cache
+
+	if !*pullNoCache {
+		if c, err = cache.Open(r.CacheDir()); err != nil {
+			return err
+		}
+	}
+
+	return project.Pull(pr, m, c)
+}
+
+func checkProject(r *registry.Registry) error {
+	pr := r.Project(*pullProjectName)
+	if pr.Name() == "" {
+		fmt.Printf("%s isn't pulled\n", *pullProjectName)
+		return nil
+	}
+
+	outdated, err := project.Check(pr)
+	if err != nil {
+		return err
+	}
+
+	if outdated {
+		fmt.Printf("%s has newer manifest, pull it to update\n", pr.Name())
+	} else {
+		fmt.Printf("%s is up to date\n", pr.Name())
+	}
+
+	return nil
+}
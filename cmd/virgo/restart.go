@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/network"
+	"github.com/deferpanic/virgo/pkg/project"
+	"github.com/deferpanic/virgo/pkg/registry"
+	"github.com/deferpanic/virgo/pkg/runner"
+)
+
+var (
+	restartCommand  = app.Command("restart", "Restart instances of a project")
+	restartInstance = restartCommand.Flag("instance", "Instance number, all instances by default").Int()
+	restartRebuild  = restartCommand.Flag("rebuild-mounts", "Rebuild images of mounted host directories").Bool()
+	restartName     = restartCommand.Arg("name", "Project name.").Required().String()
+)
+
+// time given to stopped instance to release its tap interface
+const restartTimeout = 10 * time.Second
+
+// restart stops instances and runs them again with the same number,
+// address and settings
+func restart(r *registry.Registry, projects *project.Projects) error {
+	pr := r.Project(*restartName)
+
+	rt := projects.GetProjectByName(pr.Name())
+	if pr.Name() == "" || rt == nil {
+		return fmt.Errorf("Project '%s' isn't running", *restartName)
+	}
+
+	found := false
+
+	for i := range rt.Process {
+		if i >= len(rt.Instance) {
+			return fmt.Errorf("runtime of '%s' is saved by older version, kill it and run again", *restartName)
+		}
+
+		instance := rt.Instance[i]
+
+		if *restartInstance != 0 && instance.Num != *restartInstance {
+			continue
+		}
+
+		found = true
+
+		if *dry {
+			fmt.Printf("restart %s\n", rt.InstanceName(i))
+			continue
+		}
+
+		pid := rt.Process[i].Pid
+
+		stopInstance(r, rt, i)
+
+		for start := time.Now(); runner.IsPidAlive(pid); time.Sleep(100 * time.Millisecond) {
+			if time.Since(start) > restartTimeout {
+				return fmt.Errorf("%s is still running after %s", rt.InstanceName(i), restartTimeout)
+			}
+		}
+
+		n, err := network.New(pr, instance.Num, rt.Network[i].Ip, rt.Network[i].Gw)
+		if err != nil {
+			return err
+		}
+
+		n.Mac = rt.Network[i].Mac
+
+		p, err := project.New(pr, n, newRunner(), instance.Num)
+		if err != nil {
+			return err
+		}
+
+		if err := configure(r, projects, p, optionsOf(instance)); err != nil {
+			return err
+		}
+
+		p.ReuseMounts = !*restartRebuild
+
+		sinks, err := logSinks(p)
+		if err != nil {
+			return err
+		}
+
+		if err := p.Run(true); err != nil {
+			return err
+		}
+
+		if err := projects.Replace(rt, i, p, r); err != nil {
+			return err
+		}
+
+		if err := startHelpers(p, sinks); err != nil {
+			return err
+		}
+
+		fmt.Printf("%s restarted\n", p.InstanceName())
+	}
+
+	if !found {
+		return fmt.Errorf("instance %d of '%s' isn't running", *restartInstance, *restartName)
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/deferpanic/virgo/pkg/project"
+	"github.com/deferpanic/virgo/pkg/registry"
+)
+
+var (
+	scaleCommand = app.Command("scale", "Scale projects to given number of instances")
+	scaleTargets = scaleCommand.Arg("project=N", "Project name and number of instances.").Required().Strings()
+)
+
+// scale starts or stops instances until their number matches the target.
+// New instances inherit settings of the newest running one, the newest
+// instances are stopped first.
+func scale(r *registry.Registry, projects *project.Projects) error {
+	for _, target := range *scaleTargets {
+		name, n, err := parseScale(target)
+		if err != nil {
+			return err
+		}
+
+		pr := r.Project(name)
+		if pr.Name() == "" {
+			return fmt.Errorf("Project '%s' not found", name)
+		}
+
+		current := 0
+
+		rt := projects.GetProjectByName(pr.Name())
+		if rt != nil {
+			current = len(rt.Process)
+		}
+
+		switch {
+		case n > current:
+			opts := instanceOptions{headless: true}
+
+			if rt != nil && len(rt.Instance) > 0 {
+				opts = optionsOf(rt.Instance[len(rt.Instance)-1])
+			}
+
+			// named volume is attached to single instance only
+			if len(opts.volumes) > 0 {
+				return fmt.Errorf("Project '%s' uses volumes %s, they can't be shared between instances", name, strings.Join(opts.volumes, ", "))
+			}
+
+			for i := current; i < n; i++ {
+				if _, err := startInstance(r, projects, pr, opts); err != nil {
+					return err
+				}
+			}
+
+		case n < current:
+			for i := current - 1; i >= n; i-- {
+				if *dry {
+					fmt.Printf("stop %s\n", rt.InstanceName(i))
+					continue
+				}
+
+				stopInstance(r, rt, i)
+
+				if err := projects.Remove(rt, i, r); err != nil {
+					return err
+				}
+			}
+		}
+
+		fmt.Printf("%s scaled from %d to %d instance(s)\n", name, current, n)
+	}
+
+	return nil
+}
+
+func parseScale(target string) (string, int, error) {
+	i := strings.LastIndex(target, "=")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("wrong format '%s', should be project=N", target)
+	}
+
+	n, err := strconv.Atoi(target[i+1:])
+	if err != nil || n < 0 {
+		return "", 0, fmt.Errorf("wrong number of instances in '%s'", target)
+	}
+
+	return target[:i], n, nil
+}
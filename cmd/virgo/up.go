@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/compose"
+	"github.com/deferpanic/virgo/pkg/project"
+	"github.com/deferpanic/virgo/pkg/proxy"
+	"github.com/deferpanic/virgo/pkg/registry"
+)
+
+var (
+	upCommand = app.Command("up", "Start services of compose file")
+	upFile    = upCommand.Flag("file", "Compose file.").Short('f').Default(compose.DefaultFile).String()
+
+	downCommand = app.Command("down", "Stop services of compose file")
+	downFile    = downCommand.Flag("file", "Compose file.").Short('f').Default(compose.DefaultFile).String()
+
+	proxyCommand = app.Command("proxy", "Balance host port between project instances").Hidden()
+	proxyProject = proxyCommand.Flag("project", "Project name.").Required().String()
+	proxyStack   = proxyCommand.Flag("stack", "Stack name.").String()
+	proxyService = proxyCommand.Flag("service", "Service name.").String()
+	proxyMapping = proxyCommand.Arg("ports", "Port mapping host:guest.").Required().String()
+)
+
+// proxyRefresh is how often proxy reloads runtime
+const proxyRefresh = time.Second
+
+// up starts services of stack in dependency order. Every service gets
+// addresses of services sharing its networks and started before it as
+// <SERVICE>_HOST and <SERVICE>_HOSTS env variables. If any service fails
+// to start, instances already started are stopped.
+func up(r *registry.Registry, projects *project.Projects) error {
+	stack, err := compose.Load(*upFile)
+	if err != nil {
+		return err
+	}
+
+	for _, rt := range *projects {
+		for _, instance := range rt.Instance {
+			if instance.Stack == stack.Name {
+				return fmt.Errorf("stack '%s' is already up, use 'virgo down' first", stack.Name)
+			}
+		}
+	}
+
+	order, err := stack.Order()
+	if err != nil {
+		return err
+	}
+
+	if err := upServices(r, projects, stack, order); err != nil {
+		if _, derr := stopStack(r, projects, stack.Name); derr != nil {
+			return fmt.Errorf("%s\nerror stopping started services - %s", err, derr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// upServices starts services in given order
+func upServices(r *registry.Registry, projects *project.Projects, stack *compose.Stack, order []string) error {
+	addrs := make(map[string][]string)
+
+	for _, name := range order {
+		svc := stack.Services[name]
+
+		pr := r.Project(svc.Project)
+		if pr.Name() == "" {
+			return fmt.Errorf("project '%s' of service '%s' not found, pull it first", svc.Project, name)
+		}
+
+		env := append([]string{}, svc.Env...)
+		for _, peer := range stack.Peers(name) {
+			env = append(env, compose.DiscoveryEnv(peer, addrs[peer])...)
+		}
+
+		opts := instanceOptions{
+			headless:    true,
+			memory:      svc.Memory,
+			cpus:        svc.Cpus,
+			env:         env,
+			healthcheck: svc.Healthcheck,
+			hypervisor:  svc.Hypervisor,
+			arch:        svc.Arch,
+			volumes:     svc.Volumes,
+			stack:       stack.Name,
+			service:     name,
+		}
+
+		started := []*project.Project{}
+
+		for i := 0; i < svc.Instances; i++ {
+			p, err := startInstance(r, projects, pr, opts)
+			if err != nil {
+				return fmt.Errorf("error starting service '%s' - %s", name, err)
+			}
+
+			started = append(started, p)
+			addrs[name] = append(addrs[name], p.Network.Ip)
+		}
+
+		if len(started) == 0 {
+			continue
+		}
+
+		// dependent services are started only when this one is ready
+		if svc.Healthcheck != "" {
+			for _, p := range started {
+				if err := waitHealthy(p); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, port := range svc.Ports {
+			args := []string{"proxy", "--project", pr.Name(), "--stack", stack.Name, "--service", name, port}
+
+			if err := startHelper(started[0], args...); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("Service %s started, %d instance(s)\n", name, len(started))
+	}
+
+	return nil
+}
+
+// down stops all instances of stack and removes them from runtime,
+// port balancers exit on their own when instances are gone
+func down(r *registry.Registry, projects *project.Projects) error {
+	stack, err := compose.Load(*downFile)
+	if err != nil {
+		return err
+	}
+
+	found, err := stopStack(r, projects, stack.Name)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return fmt.Errorf("stack '%s' isn't running", stack.Name)
+	}
+
+	return nil
+}
+
+// stopStack stops instances of stack and removes them from runtime, found
+// is false if stack has no instances
+func stopStack(r *registry.Registry, projects *project.Projects, name string) (bool, error) {
+	found := false
+
+	for _, rt := range append(project.Projects{}, *projects...) {
+		for i := len(rt.Instance) - 1; i >= 0; i-- {
+			if rt.Instance[i].Stack != name || i >= len(rt.Process) {
+				continue
+			}
+
+			found = true
+
+			stopInstance(r, rt, i)
+
+			if err := projects.Remove(rt, i, r); err != nil {
+				return found, err
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// runProxy balances host port between running instances of project or
+// stack service. Runtime is reloaded periodically, so instances added by
+// scale are picked up and only healthy ones receive connections. Proxy
+// exits when there are no instances left.
+func runProxy(r *registry.Registry) error {
+	host, guest, err := proxy.ParseMapping(*proxyMapping)
+	if err != nil {
+		return err
+	}
+
+	load := func() project.Projects {
+		projects, err := project.LoadProjects(r)
+		if err != nil {
+			log.Println(err)
+		}
+
+		return projects
+	}
+
+	if !load().HasInstances(*proxyProject, *proxyStack, *proxyService) {
+		return fmt.Errorf("Project '%s' isn't running", *proxyProject)
+	}
+
+	backends := proxy.Cached(func() []string {
+		return load().Backends(*proxyProject, *proxyStack, *proxyService, guest)
+	}, proxyRefresh)
+
+	p, err := proxy.Listen(":"+strconv.Itoa(host), backends)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			time.Sleep(proxyRefresh)
+
+			if !load().HasInstances(*proxyProject, *proxyStack, *proxyService) {
+				p.Close()
+				return
+			}
+		}
+	}()
+
+	log.Printf("balancing %s between instances of %s, port %d", p.Addr(), *proxyProject, guest)
+
+	p.Serve()
+
+	log.Printf("no instances of %s left, exiting", *proxyProject)
+
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/deferpanic/virgo/pkg/project"
+	"github.com/deferpanic/virgo/pkg/registry"
+	"github.com/deferpanic/virgo/pkg/stats"
+	"github.com/deferpanic/virgo/pkg/volume"
+)
+
+var (
+	volumeCommand = app.Command("volume", "Manage named and project volumes")
+
+	volumeCreateCommand = volumeCommand.Command("create", "Create a volume")
+	volumeCreateSize    = volumeCreateCommand.Flag("size", "Volume size, e.g. 512M or 1G").Default("1G").String()
+	volumeCreateFormat  = volumeCreateCommand.Flag("format", "Image format: raw or qcow2").Default(volume.FormatRaw).Enum(volume.FormatRaw, volume.FormatQcow2)
+	volumeCreateFs      = volumeCreateCommand.Flag("fs", "Format volume with filesystem: ffs, ext2 or fat").Enum(volume.FsFfs, volume.FsExt2, volume.FsFat)
+	volumeCreateName    = volumeCreateCommand.Arg("name", "Volume name.").Required().String()
+
+	volumeLsCommand = volumeCommand.Command("ls", "List volumes, or volumes of project manifest")
+	volumeLsProject = volumeLsCommand.Arg("project", "Project name.").String()
+
+	volumeRmCommand = volumeCommand.Command("rm", "Remove volumes")
+	volumeRmNames   = volumeRmCommand.Arg("name", "Volume name.").Required().Strings()
+
+	volumeInspectCommand = volumeCommand.Command("inspect", "Display volume details")
+	volumeInspectName    = volumeInspectCommand.Arg("name", "Volume name.").Required().String()
+
+	volumeExportCommand  = volumeCommand.Command("export", "Export files of project volume to tar archive")
+	volumeExportInstance = volumeExportCommand.Flag("instance", "Export overlay of instance with changes made by it").Int()
+	volumeExportRaw      = volumeExportCommand.Flag("raw", "Export disk image instead of files").Bool()
+	volumeExportProject  = volumeExportCommand.Arg("project", "Project name.").Required().String()
+	volumeExportMount    = volumeExportCommand.Arg("mount", "Mountpoint of volume, e.g. /etc").Required().String()
+	volumeExportFile     = volumeExportCommand.Arg("file", "Output tar file, - for stdout.").Required().String()
+
+	volumeImportCommand = volumeCommand.Command("import", "Replace project volume with files of tar archive")
+	volumeImportProject = volumeImportCommand.Arg("project", "Project name.").Required().String()
+	volumeImportMount   = volumeImportCommand.Arg("mount", "Mountpoint of volume, e.g. /etc").Required().String()
+	volumeImportFile    = volumeImportCommand.Arg("file", "Input tar file, - for stdin.").Required().String()
+)
+
+// volumeInfo is volume together with instance using it
+type volumeInfo struct {
+	*volume.Volume
+	UsedBy string `json:"used_by,omitempty"`
+}
+
+func volumeCmd(command string, r *registry.Registry, projects project.Projects) error {
+	store := volume.NewStore(r.VolumesDir(), newRunner())
+
+	switch command {
+	case "volume create":
+		size, err := volume.ParseSize(*volumeCreateSize)
+		if err != nil {
+			return err
+		}
+
+		v, err := store.Create(*volumeCreateName, size, *volumeCreateFormat, *volumeCreateFs)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(v.Name)
+
+	case "volume ls":
+		if *volumeLsProject != "" {
+			return projectVolumes(r, *volumeLsProject)
+		}
+
+		list, err := store.List()
+		if err != nil {
+			return err
+		}
+
+		if len(list) == 0 {
+			fmt.Fprintf(os.Stdout, "No volumes found\n")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 8, 2, '\t', 0)
+
+		fmt.Fprintf(w, "Name\tFormat\tFs\tSize\tUsed by\n")
+		fmt.Fprintf(w, "----\t------\t--\t----\t-------\n")
+
+		for _, v := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", v.Name, v.Format, v.Fs, stats.HumanBytes(uint64(v.Size)), projects.VolumeUser(v.Name))
+		}
+
+		w.Flush()
+
+	case "volume rm":
+		for _, name := range *volumeRmNames {
+			if user := projects.VolumeUser(name); user != "" {
+				return fmt.Errorf("volume '%s' is in use by %s, kill it first", name, user)
+			}
+
+			if err := store.Remove(name); err != nil {
+				return err
+			}
+		}
+
+	case "volume inspect":
+		v, err := store.Get(*volumeInspectName)
+		if err != nil {
+			return err
+		}
+
+		b, err := json.MarshalIndent(volumeInfo{v, projects.VolumeUser(v.Name)}, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(b))
+
+	case "volume export":
+		return exportVolume(r, projects)
+
+	case "volume import":
+		return importVolume(r, projects)
+	}
+
+	return nil
+}
+
+// projectVolumes lists manifest volumes of project with their files
+func projectVolumes(r *registry.Registry, name string) error {
+	pr := r.Project(name)
+	if pr.Name() == "" {
+		return fmt.Errorf("Project '%s' not found", name)
+	}
+
+	volumes, err := project.ManifestVolumes(pr)
+	if err != nil {
+		return err
+	}
+
+	if len(volumes) == 0 {
+		fmt.Fprintf(os.Stdout, "No volumes found\n")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 4, 8, 2, '\t', 0)
+
+	fmt.Fprintf(w, "Id\tFile\tMount\tPath\tSize\tFormat\tFs\n")
+	fmt.Fprintf(w, "--\t----\t-----\t----\t----\t------\t--\n")
+
+	for _, v := range volumes {
+		size, format, fs := "-", "-", ""
+
+		if info, err := os.Stat(v.Path); err == nil {
+			size = stats.HumanBytes(uint64(info.Size()))
+
+			if format, fs, err = volume.Detect(v.Path); err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", v.Id, v.File, v.Mount, v.Path, size, format, fs)
+	}
+
+	w.Flush()
+
+	return nil
+}
+
+// exportVolume writes files of pristine volume or of instance overlay to
+// tar archive, only ISO9660 volumes can be exported as files
+func exportVolume(r *registry.Registry, projects project.Projects) error {
+	pr := r.Project(*volumeExportProject)
+	if pr.Name() == "" {
+		return fmt.Errorf("Project '%s' not found", *volumeExportProject)
+	}
+
+	v, err := project.ManifestVolumeByMount(pr, *volumeExportMount)
+	if err != nil {
+		return err
+	}
+
+	image := v.Path
+
+	if *volumeExportInstance != 0 {
+		overlay, format := instanceOverlay(pr, projects, *volumeExportInstance, v.Id)
+		if overlay == "" {
+			return fmt.Errorf("instance %d of '%s' has no overlay of volume at '%s'", *volumeExportInstance, pr.Name(), v.Mount)
+		}
+
+		image = overlay
+
+		// raw overlays are copies of volume and are read as they are
+		if format == volume.FormatQcow2 {
+			tmp, err := ioutil.TempFile("", "virgo-export")
+			if err != nil {
+				return err
+			}
+			tmp.Close()
+			defer os.Remove(tmp.Name())
+
+			if out, err := newRunner().Shell("qemu-img convert -f qcow2 -O raw " + overlay + " " + tmp.Name()); err != nil {
+				return fmt.Errorf("error converting overlay - %s\n%s", err, out)
+			}
+
+			image = tmp.Name()
+		}
+	}
+
+	if *dry {
+		return nil
+	}
+
+	_, fs, err := volume.Detect(image)
+	if err != nil {
+		return err
+	}
+
+	if fs != volume.FsIso9660 && !*volumeExportRaw {
+		return fmt.Errorf("volume at '%s' isn't ISO9660 image, use --raw to export disk image", v.Mount)
+	}
+
+	w := os.Stdout
+
+	if *volumeExportFile != "-" {
+		if w, err = os.OpenFile(*volumeExportFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644); err != nil {
+			return fmt.Errorf("error opening file '%s' - %s", *volumeExportFile, err)
+		}
+		defer w.Close()
+	}
+
+	if *volumeExportRaw {
+		return volume.ExportRaw(image, filepath.Base(v.Path)+".img", w)
+	}
+
+	return volume.ExportTar(image, w)
+}
+
+// instanceOverlay returns overlay of volume made for instance and its
+// format. Format is the one of hypervisor recorded in runtime, overlays of
+// instances which aren't there are looked up on disk.
+func instanceOverlay(pr registry.Project, projects project.Projects, num, id int) (string, string) {
+	overlays := map[string]string{
+		volume.FormatQcow2: pr.OverlayFile(num, id),
+		volume.FormatRaw:   pr.RawOverlayFile(num, id),
+	}
+
+	if rt := projects.GetProjectByName(pr.Name()); rt != nil {
+		if format := rt.DiskFormat(num); format != "" {
+			if _, err := os.Stat(overlays[format]); err != nil {
+				return "", ""
+			}
+
+			return overlays[format], format
+		}
+	}
+
+	for _, format := range []string{volume.FormatQcow2, volume.FormatRaw} {
+		if _, err := os.Stat(overlays[format]); err == nil {
+			return overlays[format], format
+		}
+	}
+
+	return "", ""
+}
+
+// importVolume replaces pristine volume with ISO9660 image built from tar
+// archive, overlays backed by old volume are dropped
+func importVolume(r *registry.Registry, projects project.Projects) error {
+	pr := r.Project(*volumeImportProject)
+	if pr.Name() == "" {
+		return fmt.Errorf("Project '%s' not found", *volumeImportProject)
+	}
+
+	if rt := projects.GetProjectByName(pr.Name()); rt != nil && len(rt.Process) > 0 {
+		return fmt.Errorf("Project '%s' is running, kill it first", pr.Name())
+	}
+
+	v, err := project.ManifestVolumeByMount(pr, *volumeImportMount)
+	if err != nil {
+		return err
+	}
+
+	if *dry {
+		fmt.Printf("import %s to %s\n", *volumeImportFile, v.Path)
+		return nil
+	}
+
+	rd := os.Stdin
+
+	if *volumeImportFile != "-" {
+		if rd, err = os.Open(*volumeImportFile); err != nil {
+			return err
+		}
+		defer rd.Close()
+	}
+
+	if err := volume.ImportTar(rd, v.Path); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(pr.OverlaysRoot())
+}
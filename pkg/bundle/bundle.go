@@ -0,0 +1,306 @@
+// Package bundle packs pulled project to a single gzipped tar archive, so
+// it can be moved to host without access to api
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+
+	"github.com/deferpanic/virgo/pkg/registry"
+)
+
+const (
+	Version = 1
+
+	indexFile    = "index.json"
+	kernelFile   = "kernel"
+	manifestFile = "manifest"
+	volumesDir   = "volumes"
+)
+
+var volumeRe = regexp.MustCompile(`^vol[0-9]+$`)
+
+// Index is the first entry of bundle, it describes the rest of them
+type Index struct {
+	Version int    `json:"version"`
+	Project string `json:"project"`
+	Files   []File `json:"files"`
+}
+
+// File is bundle entry, path is relative to project layout, e.g.
+// kernel, manifest or volumes/vol7887
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// Save writes manifest, kernel and volumes of project to w
+func Save(pr registry.Project, w io.Writer) error {
+	files := map[string]string{
+		kernelFile:   pr.KernelFile(),
+		manifestFile: pr.ManifestFile(),
+	}
+
+	volumes, err := ioutil.ReadDir(pr.VolumesDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, info := range volumes {
+		if volumeRe.MatchString(info.Name()) {
+			files[path.Join(volumesDir, info.Name())] = filepath.Join(pr.VolumesDir(), info.Name())
+		}
+	}
+
+	index := Index{Version: Version, Project: pr.Name()}
+
+	for _, name := range []string{manifestFile, kernelFile} {
+		f, err := hashFile(name, files[name])
+		if err != nil {
+			return err
+		}
+
+		index.Files = append(index.Files, f)
+	}
+
+	for _, info := range volumes {
+		name := path.Join(volumesDir, info.Name())
+		if _, ok := files[name]; !ok {
+			continue
+		}
+
+		f, err := hashFile(name, files[name])
+		if err != nil {
+			return err
+		}
+
+		index.Files = append(index.Files, f)
+	}
+
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	if err := tw.WriteHeader(&tar.Header{Name: indexFile, Mode: 0644, Size: int64(len(b))}); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+
+	for _, f := range index.Files {
+		if err := writeFile(tw, f, files[f.Path]); err != nil {
+			return fmt.Errorf("error saving %s - %s", f.Path, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+// Load adds project found in bundle to registry, its files are replaced
+// only when every one of them matches index. Projects for which inUse
+// returns true aren't replaced, nil inUse allows any.
+func Load(r *registry.Registry, rd io.Reader, inUse func(name string) bool) (registry.Project, error) {
+	gr, err := gzip.NewReader(rd)
+	if err != nil {
+		return registry.Project{}, fmt.Errorf("error reading bundle - %s", err)
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != indexFile {
+		return registry.Project{}, fmt.Errorf("bundle has no index")
+	}
+
+	var index Index
+
+	if err := json.NewDecoder(tr).Decode(&index); err != nil {
+		return registry.Project{}, fmt.Errorf("error reading bundle index - %s", err)
+	}
+
+	if index.Version != Version {
+		return registry.Project{}, fmt.Errorf("unsupported bundle version %d", index.Version)
+	}
+
+	// project name of bundle is untrusted, it becomes path in registry
+	if name, _ := registry.SplitTag(index.Project); registry.ValidName(name) != nil {
+		return registry.Project{}, fmt.Errorf("bundle has wrong project name '%s'", index.Project)
+	}
+
+	pr, err := r.AddProject(index.Project)
+	if err != nil {
+		return registry.Project{}, err
+	}
+
+	if inUse != nil && inUse(pr.Name()) {
+		return registry.Project{}, fmt.Errorf("Project '%s' is running, kill it first", pr.Name())
+	}
+
+	tmp, err := ioutil.TempDir(pr.Root(), ".load")
+	if err != nil {
+		return registry.Project{}, err
+	}
+	defer os.RemoveAll(tmp)
+
+	expected := make(map[string]File)
+
+	for _, f := range index.Files {
+		if _, err := destination(pr, f.Path); err != nil {
+			return registry.Project{}, err
+		}
+
+		expected[f.Path] = f
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return registry.Project{}, fmt.Errorf("error reading bundle - %s", err)
+		}
+
+		f, ok := expected[hdr.Name]
+		if !ok {
+			return registry.Project{}, fmt.Errorf("file '%s' isn't listed in bundle index", hdr.Name)
+		}
+
+		if err := readFile(tr, f, filepath.Join(tmp, filepath.FromSlash(f.Path))); err != nil {
+			return registry.Project{}, err
+		}
+
+		delete(expected, hdr.Name)
+	}
+
+	for name := range expected {
+		return registry.Project{}, fmt.Errorf("file '%s' is missing in bundle", name)
+	}
+
+	// overlays can't outlive volumes they're backed by
+	for _, dir := range []string{pr.VolumesDir(), pr.OverlaysRoot()} {
+		if err := os.RemoveAll(dir); err != nil {
+			return registry.Project{}, err
+		}
+	}
+
+	for _, dir := range pr.Structure() {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return registry.Project{}, err
+		}
+	}
+
+	for _, f := range index.Files {
+		dst, _ := destination(pr, f.Path)
+
+		// files could be hard linked to other tags
+		os.Remove(dst)
+
+		if err := os.Rename(filepath.Join(tmp, filepath.FromSlash(f.Path)), dst); err != nil {
+			return registry.Project{}, err
+		}
+	}
+
+	return pr, nil
+}
+
+// destination returns registry file of bundle entry
+func destination(pr registry.Project, name string) (string, error) {
+	switch name {
+	case kernelFile:
+		return pr.KernelFile(), nil
+	case manifestFile:
+		return pr.ManifestFile(), nil
+	}
+
+	if dir, file := path.Split(name); dir == volumesDir+"/" && volumeRe.MatchString(file) {
+		return filepath.Join(pr.VolumesDir(), file), nil
+	}
+
+	return "", fmt.Errorf("wrong file '%s' in bundle index", name)
+}
+
+func hashFile(name, file string) (File, error) {
+	rd, err := os.Open(file)
+	if err != nil {
+		return File{}, err
+	}
+	defer rd.Close()
+
+	h := sha256.New()
+
+	size, err := io.Copy(h, rd)
+	if err != nil {
+		return File{}, fmt.Errorf("error reading %s - %s", file, err)
+	}
+
+	return File{Path: name, Size: size, Sha256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func writeFile(tw *tar.Writer, f File, file string) error {
+	rd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	if err := tw.WriteHeader(&tar.Header{Name: f.Path, Mode: 0644, Size: f.Size}); err != nil {
+		return err
+	}
+
+	// file changed after it was hashed
+	if n, err := io.CopyN(tw, rd, f.Size); err != nil {
+		return fmt.Errorf("expected %d bytes, obtained %d", f.Size, n)
+	}
+
+	return nil
+}
+
+// readFile extracts entry to file and checks it against index
+func readFile(r io.Reader, f File, file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	wr, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer wr.Close()
+
+	h := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(wr, h), r)
+	if err != nil {
+		return fmt.Errorf("error extracting %s - %s", f.Path, err)
+	}
+
+	if size != f.Size || hex.EncodeToString(h.Sum(nil)) != f.Sha256 {
+		return fmt.Errorf("checksum mismatch of %s, bundle is corrupted", f.Path)
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/deferpanic/virgo/pkg/registry"
+)
+
+func newRegistry(t *testing.T) (*registry.Registry, string) {
+	dir, err := ioutil.TempDir("", "virgo-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := registry.New(filepath.Join(dir, "virgo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r, dir
+}
+
+func TestSaveLoad(t *testing.T) {
+	src, dir := newRegistry(t)
+	defer os.RemoveAll(dir)
+
+	pr, err := src.AddProject("project/user:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		pr.KernelFile():    "kernel",
+		pr.ManifestFile():  "{}",
+		pr.VolumeFile(12):  "volume 12",
+		pr.VolumeFile(100): "volume 100",
+	}
+
+	for file, content := range files {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := &bytes.Buffer{}
+
+	if err := Save(pr, b); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, dir := newRegistry(t)
+	defer os.RemoveAll(dir)
+
+	loaded, err := Load(dst, bytes.NewReader(b.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Name() != "project/user:v1" || !loaded.IsCommunity() {
+		t.Fatalf("Expected community project project/user:v1, obtained %s\n", loaded.Name())
+	}
+
+	for file, content := range files {
+		file = strings.Replace(file, src.Root(), dst.Root(), 1)
+
+		if b, err := ioutil.ReadFile(file); err != nil || string(b) != content {
+			t.Fatalf("Expected '%s' in %s, obtained '%s', %v\n", content, file, b, err)
+		}
+	}
+
+	if list, _ := ioutil.ReadDir(loaded.Root()); len(list) != 4 {
+		t.Fatalf("Expected no temporary files left in %s, obtained %d entries\n", loaded.Root(), len(list))
+	}
+}
+
+func TestLoadCorrupted(t *testing.T) {
+	cases := []struct {
+		index Index
+		files map[string]string
+		err   string
+	}{
+		{
+			Index{Version: Version, Project: "hello", Files: []File{{Path: "kernel", Size: 6, Sha256: "00"}}},
+			map[string]string{"kernel": "kernel"},
+			"checksum mismatch",
+		},
+		{
+			Index{Version: Version, Project: "hello", Files: []File{{Path: "../kernel"}}},
+			map[string]string{},
+			"wrong file",
+		},
+		{
+			Index{Version: Version, Project: "hello"},
+			map[string]string{"volumes/vol1": ""},
+			"isn't listed",
+		},
+		{
+			Index{Version: Version, Project: "hello", Files: []File{{Path: "manifest"}}},
+			map[string]string{},
+			"missing",
+		},
+		{
+			Index{Version: 100, Project: "hello"},
+			map[string]string{},
+			"unsupported",
+		},
+	}
+
+	r, dir := newRegistry(t)
+	defer os.RemoveAll(dir)
+
+	for _, c := range cases {
+		b := &bytes.Buffer{}
+		gw := gzip.NewWriter(b)
+		tw := tar.NewWriter(gw)
+
+		index, _ := json.Marshal(c.index)
+		tw.WriteHeader(&tar.Header{Name: indexFile, Mode: 0644, Size: int64(len(index))})
+		tw.Write(index)
+
+		for name, content := range c.files {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+			tw.Write([]byte(content))
+		}
+
+		tw.Close()
+		gw.Close()
+
+		if _, err := Load(r, b, nil); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("Expected '%s' error, obtained %v\n", c.err, err)
+		}
+	}
+
+	if _, err := os.Stat(r.Project("hello").KernelFile()); !os.IsNotExist(err) {
+		t.Fatalf("Expected kernel of corrupted bundle not to be loaded, obtained %v\n", err)
+	}
+}
+
+func TestLoadHostileProject(t *testing.T) {
+	r, dir := newRegistry(t)
+	defer os.RemoveAll(dir)
+
+	// named volumes of registry mustn't be removed by bundle
+	if err := os.MkdirAll(filepath.Join(r.VolumesDir(), "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"..", "../x", "x/..", "/x", "x//y", "./x", "x/.:v1"} {
+		b := &bytes.Buffer{}
+		gw := gzip.NewWriter(b)
+		tw := tar.NewWriter(gw)
+
+		index, _ := json.Marshal(Index{Version: Version, Project: name})
+
+		if err := tw.WriteHeader(&tar.Header{Name: indexFile, Mode: 0644, Size: int64(len(index))}); err != nil {
+			t.Fatal(err)
+		}
+
+		tw.Write(index)
+		tw.Close()
+		gw.Close()
+
+		if _, err := Load(r, b, nil); err == nil || !strings.Contains(err.Error(), "wrong project name") {
+			t.Fatalf("Expected '%s' to be refused, obtained %v\n", name, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(r.VolumesDir(), "data")); err != nil {
+		t.Fatalf("Expected named volumes to be kept, obtained %s\n", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "x")); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing to be written outside of registry\n")
+	}
+}
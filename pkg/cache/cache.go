@@ -0,0 +1,194 @@
+// Package cache keeps downloaded files by their content hash, so files
+// which haven't changed upstream aren't downloaded again and identical
+// files of different projects share disk space via hard links
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	indexFile = "index.json"
+	blobsDir  = "blobs"
+)
+
+// Entry is cached file, key of entry is url it was downloaded from
+type Entry struct {
+	ETag   string `json:"etag,omitempty"`
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+type Cache struct {
+	dir   string
+	index map[string]Entry
+}
+
+// Open loads cache index from dir, missing index is an empty one
+func Open(dir string) (*Cache, error) {
+	c := &Cache{dir: dir, index: make(map[string]Entry)}
+
+	if err := os.MkdirAll(filepath.Join(dir, blobsDir), 0755); err != nil {
+		return nil, fmt.Errorf("error creating cache - %s", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &c.index); err != nil {
+		return nil, fmt.Errorf("error reading cache index - %s", err)
+	}
+
+	return c, nil
+}
+
+// Save writes cache index
+func (c *Cache) Save() error {
+	b, err := json.MarshalIndent(c.index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(c.dir, indexFile+".tmp")
+
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(c.dir, indexFile))
+}
+
+// Lookup returns entry of key, entries which files are gone aren't found
+func (c *Cache) Lookup(key string) (Entry, bool) {
+	e, ok := c.index[key]
+	if !ok {
+		return Entry{}, false
+	}
+
+	info, err := os.Stat(c.blob(e.Sha256))
+	if err != nil || info.Size() != e.Size {
+		return Entry{}, false
+	}
+
+	return e, true
+}
+
+// Add moves file to cache and replaces it with hard link of cached one,
+// file with the same content which is cached already is reused
+func (c *Cache) Add(key, etag, file string) (Entry, error) {
+	e, err := hashFile(file)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	e.ETag = etag
+
+	blob := c.blob(e.Sha256)
+
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.Link(file, blob); err != nil {
+			// cache is on other filesystem, copy is kept
+			if err := copyFile(file, blob); err != nil {
+				return Entry{}, err
+			}
+		}
+	} else if err := c.Link(e, file); err != nil {
+		return Entry{}, err
+	}
+
+	c.index[key] = e
+
+	return e, nil
+}
+
+// Link makes file a hard link of cached entry, it's copied if cache is on
+// other filesystem
+func (c *Cache) Link(e Entry, file string) error {
+	blob := c.blob(e.Sha256)
+
+	// file is replaced only when link is made
+	tmp := file + ".link"
+
+	os.Remove(tmp)
+
+	if err := os.Link(blob, tmp); err != nil {
+		if err := copyFile(blob, tmp); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// Unused returns cached files which aren't linked to any project
+func (c *Cache) Unused() ([]string, error) {
+	result := []string{}
+
+	list, err := ioutil.ReadDir(filepath.Join(c.dir, blobsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range list {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink == 1 {
+			result = append(result, filepath.Join(c.dir, blobsDir, info.Name()))
+		}
+	}
+
+	return result, nil
+}
+
+func (c *Cache) blob(sum string) string {
+	return filepath.Join(c.dir, blobsDir, sum)
+}
+
+func hashFile(file string) (Entry, error) {
+	rd, err := os.Open(file)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer rd.Close()
+
+	h := sha256.New()
+
+	size, err := io.Copy(h, rd)
+	if err != nil {
+		return Entry{}, fmt.Errorf("error reading %s - %s", file, err)
+	}
+
+	return Entry{Sha256: hex.EncodeToString(h.Sum(nil)), Size: size}, nil
+}
+
+func copyFile(from, to string) error {
+	rd, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	wr, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(wr, rd); err != nil {
+		wr.Close()
+		return err
+	}
+
+	return wr.Close()
+}
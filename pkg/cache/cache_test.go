@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := Open(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{filepath.Join(dir, "vol1"), filepath.Join(dir, "vol2")}
+
+	for _, file := range files {
+		if err := ioutil.WriteFile(file, []byte("volume"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e1, err := c.Add("http://host/vol1", `"v1"`, files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e2, err := c.Add("http://host/vol2", "", files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e1.Sha256 != e2.Sha256 || e1.Size != 6 {
+		t.Fatalf("Expected the same entries, obtained %v and %v\n", e1, e2)
+	}
+
+	// identical files share single cached copy
+	info1, _ := os.Stat(files[0])
+	info2, _ := os.Stat(files[1])
+
+	if !os.SameFile(info1, info2) {
+		t.Fatal("Expected identical files to be hard linked")
+	}
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = Open(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := c.Lookup("http://host/vol1")
+	if !ok || e.ETag != `"v1"` {
+		t.Fatalf("Expected entry with etag, obtained %v, %v\n", e, ok)
+	}
+
+	if _, ok := c.Lookup("http://host/vol3"); ok {
+		t.Fatal("Expected no entry of unknown url")
+	}
+
+	linked := filepath.Join(dir, "vol3")
+
+	if err := c.Link(e, linked); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ioutil.ReadFile(linked); err != nil || string(b) != "volume" {
+		t.Fatalf("Expected linked file, obtained '%s', %v\n", b, err)
+	}
+
+	if unused, err := c.Unused(); err != nil || len(unused) != 0 {
+		t.Fatalf("Expected no unused files, obtained %v, %v\n", unused, err)
+	}
+
+	for _, file := range append(files, linked) {
+		os.Remove(file)
+	}
+
+	if unused, err := c.Unused(); err != nil || len(unused) != 1 {
+		t.Fatalf("Expected unused file, obtained %v, %v\n", unused, err)
+	}
+}
@@ -0,0 +1,333 @@
+package compose
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/deferpanic/virgo/pkg/health"
+	"github.com/deferpanic/virgo/pkg/hypervisor"
+	"github.com/deferpanic/virgo/pkg/proxy"
+	"github.com/deferpanic/virgo/pkg/volume"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DefaultFile    = "virgo.yml"
+	DefaultNetwork = "default"
+)
+
+type Service struct {
+	Project     string   `yaml:"project"`
+	Instances   int      `yaml:"instances"`
+	Memory      int      `yaml:"memory"`
+	Cpus        int      `yaml:"cpus"`
+	Env         []string `yaml:"env"`
+	Ports       []string `yaml:"ports"`
+	Volumes     []string `yaml:"volumes"`
+	DependsOn   []string `yaml:"depends_on"`
+	Networks    []string `yaml:"networks"`
+	Healthcheck string   `yaml:"healthcheck"`
+	Hypervisor  string   `yaml:"hypervisor"`
+	Arch        string   `yaml:"arch"`
+}
+
+// Stack is a set of services described by compose file, e.g.:
+//
+//	name: shop
+//	services:
+//	  app:
+//	    project: shop-app
+//	    memory: 128
+//	    env: [MODE=prod]
+//	    ports: ["8080:3000"]
+//	    volumes: ["uploads:/data"]
+//	    depends_on: [cache]
+//	    networks: [front, back]
+//	  cache:
+//	    project: redis
+//	    hypervisor: solo5-hvt
+//	    healthcheck: tcp:6379
+//	    networks: [back]
+//
+// Networks limit service discovery only: service gets addresses of
+// services sharing its networks, but instances aren't isolated from each
+// other, all of them are attached to the same host network.
+type Stack struct {
+	Name     string              `yaml:"name"`
+	Services map[string]*Service `yaml:"services"`
+	Networks []string            `yaml:"networks"`
+}
+
+// Load reads compose file, stack name defaults to name of directory
+// containing the file
+func Load(file string) (*Stack, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s - %s", file, err)
+	}
+
+	s := &Stack{}
+
+	if err := yaml.UnmarshalStrict(b, s); err != nil {
+		return nil, fmt.Errorf("error parsing %s - %s", file, err)
+	}
+
+	if s.Name == "" {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+
+		s.Name = filepath.Base(filepath.Dir(abs))
+	}
+
+	s.setDefaults()
+
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("error in %s - %s", file, err)
+	}
+
+	return s, nil
+}
+
+func (s *Stack) setDefaults() {
+	for name, svc := range s.Services {
+		if svc == nil {
+			svc = &Service{}
+			s.Services[name] = svc
+		}
+
+		if svc.Project == "" {
+			svc.Project = name
+		}
+
+		if svc.Instances == 0 {
+			svc.Instances = 1
+		}
+
+		if len(svc.Networks) == 0 {
+			svc.Networks = []string{DefaultNetwork}
+		}
+	}
+}
+
+func (s *Stack) Validate() error {
+	if len(s.Services) == 0 {
+		return fmt.Errorf("no services found")
+	}
+
+	networks := map[string]bool{DefaultNetwork: true}
+	for _, n := range s.Networks {
+		networks[n] = true
+	}
+
+	for name, svc := range s.Services {
+		if svc.Instances < 0 || svc.Memory < 0 || svc.Cpus < 0 {
+			return fmt.Errorf("service '%s' - instances, memory and cpus can't be negative", name)
+		}
+
+		if _, err := hypervisor.Get(svc.Hypervisor); err != nil {
+			return fmt.Errorf("service '%s' - %s", name, err)
+		}
+
+		if svc.Arch != "" {
+			if _, err := hypervisor.GetArch(svc.Arch); err != nil {
+				return fmt.Errorf("service '%s' - %s", name, err)
+			}
+		}
+
+		for _, dep := range svc.DependsOn {
+			if _, ok := s.Services[dep]; !ok {
+				return fmt.Errorf("service '%s' depends on unknown service '%s'", name, dep)
+			}
+		}
+
+		// networks have to be declared unless stack uses default one only
+		for _, n := range svc.Networks {
+			if !networks[n] {
+				return fmt.Errorf("service '%s' uses undeclared network '%s'", name, n)
+			}
+		}
+
+		for _, env := range svc.Env {
+			if !strings.Contains(env, "=") || strings.ContainsAny(env, " \"") {
+				return fmt.Errorf("service '%s' - wrong env '%s', should be KEY=value without spaces and quotes", name, env)
+			}
+		}
+
+		for _, port := range svc.Ports {
+			if _, _, err := proxy.ParseMapping(port); err != nil {
+				return fmt.Errorf("service '%s' - %s", name, err)
+			}
+		}
+
+		for _, v := range svc.Volumes {
+			if _, err := volume.ParseMount(v); err != nil {
+				return fmt.Errorf("service '%s' - %s", name, err)
+			}
+		}
+
+		// named volume can be attached to single instance only
+		if len(svc.Volumes) > 0 && svc.Instances > 1 {
+			return fmt.Errorf("service '%s' - volumes can't be shared between %d instances", name, svc.Instances)
+		}
+
+		if svc.Healthcheck != "" {
+			if _, err := health.Parse(svc.Healthcheck); err != nil {
+				return fmt.Errorf("service '%s' - %s", name, err)
+			}
+		}
+	}
+
+	order, err := s.Order()
+	if err != nil {
+		return err
+	}
+
+	// discovery env of services started before is given to peers
+	started := make(map[string]bool)
+
+	for _, name := range order {
+		svc := s.Services[name]
+
+		if !hypervisor.HasEnv(svc.Hypervisor) {
+			if len(svc.Env) > 0 {
+				return fmt.Errorf("service '%s' - %s unikernels have no env", name, svc.Hypervisor)
+			}
+
+			for _, peer := range s.Peers(name) {
+				if started[peer] {
+					return fmt.Errorf("service '%s' - %s unikernels have no env for discovery of '%s', use separate networks", name, svc.Hypervisor, peer)
+				}
+			}
+		}
+
+		started[name] = true
+	}
+
+	return nil
+}
+
+// Order returns service names sorted so every service goes after its
+// dependencies, services without dependencies between them are sorted
+// by name
+func (s *Stack) Order() ([]string, error) {
+	const (
+		visiting = iota + 1
+		visited
+	)
+
+	result := []string{}
+	state := make(map[string]int)
+
+	var visit func(name string, path []string) error
+
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("circular dependency: %s", strings.Join(append(path, name), " -> "))
+		}
+
+		state[name] = visiting
+
+		deps := append([]string{}, s.Services[name].DependsOn...)
+		sort.Strings(deps)
+
+		for _, dep := range deps {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+
+		state[name] = visited
+		result = append(result, name)
+
+		return nil
+	}
+
+	for _, name := range s.Names() {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Names returns sorted service names
+func (s *Stack) Names() []string {
+	result := make([]string, 0, len(s.Services))
+
+	for name := range s.Services {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// Peers returns services sharing at least one network with given service
+func (s *Stack) Peers(name string) []string {
+	result := []string{}
+
+	for _, other := range s.Names() {
+		if other == name {
+			continue
+		}
+
+		if shareNetwork(s.Services[name].Networks, s.Services[other].Networks) {
+			result = append(result, other)
+		}
+	}
+
+	return result
+}
+
+// DiscoveryEnv returns env variables with addresses of peer service, e.g.
+// for service "db-proxy" with two instances:
+//
+//	DB_PROXY_HOST=10.1.3.4
+//	DB_PROXY_HOSTS=10.1.3.4,10.1.4.4
+func DiscoveryEnv(service string, ips []string) []string {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	key := EnvName(service)
+
+	return []string{
+		key + "_HOST=" + ips[0],
+		key + "_HOSTS=" + strings.Join(ips, ","),
+	}
+}
+
+// EnvName converts service name to env variable prefix
+func EnvName(service string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+
+		return '_'
+	}, service)
+}
+
+func shareNetwork(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,119 @@
+package compose
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func loadSample(t *testing.T, data string) (*Stack, error) {
+	dir, err := ioutil.TempDir("", "compose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, DefaultFile)
+
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Load(file)
+	if err == nil && s.Name != filepath.Base(dir) && !strings.Contains(data, "name:") {
+		t.Errorf("Expected stack name '%s', obtained '%s'\n", filepath.Base(dir), s.Name)
+	}
+
+	return s, err
+}
+
+func TestLoad(t *testing.T) {
+	s, err := loadSample(t, `
+networks: [front, back]
+services:
+  app:
+    project: shop-app
+    instances: 2
+    memory: 128
+    env: [MODE=prod]
+    ports: ["8080:3000"]
+    depends_on: [cache, db-proxy]
+    networks: [front, back]
+  db-proxy:
+    depends_on: [cache]
+    networks: [back]
+  cache:
+    project: redis
+    hypervisor: solo5-hvt
+    healthcheck: tcp:6379
+    networks: [back]
+  web:
+    networks: [front]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if app := s.Services["app"]; app.Project != "shop-app" || app.Instances != 2 || app.Memory != 128 {
+		t.Errorf("Unexpected app service: %#v\n", app)
+	}
+
+	if proxy := s.Services["db-proxy"]; proxy.Project != "db-proxy" || proxy.Instances != 1 {
+		t.Errorf("Unexpected defaults for db-proxy service: %#v\n", proxy)
+	}
+
+	order, err := s.Order()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"cache", "db-proxy", "app", "web"}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("Expected order %v, obtained %v\n", expected, order)
+	}
+
+	if peers := s.Peers("cache"); !reflect.DeepEqual(peers, []string{"app", "db-proxy"}) {
+		t.Errorf("Unexpected peers of cache: %v\n", peers)
+	}
+
+	if peers := s.Peers("web"); !reflect.DeepEqual(peers, []string{"app"}) {
+		t.Errorf("Unexpected peers of web: %v\n", peers)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tt := map[string]string{
+		"empty":         `name: empty`,
+		"unknown key":   "services:\n  app:\n    image: x\n",
+		"unknown dep":   "services:\n  app:\n    depends_on: [db]\n",
+		"circular dep":  "services:\n  a:\n    depends_on: [b]\n  b:\n    depends_on: [a]\n",
+		"network":       "services:\n  app:\n    networks: [back]\n",
+		"env":           "services:\n  app:\n    env: [MODE]\n",
+		"port":          "services:\n  app:\n    ports: [\"80:abc\"]\n",
+		"healthcheck":   "services:\n  app:\n    healthcheck: udp:53\n",
+		"volume":        "services:\n  app:\n    volumes: [data]\n",
+		"shared volume": "services:\n  app:\n    instances: 2\n    volumes: [\"data:/data\"]\n",
+		"solo5 env":     "services:\n  app:\n    hypervisor: solo5-spt\n    env: [MODE=prod]\n",
+		"solo5 peer":    "services:\n  app:\n    hypervisor: solo5-hvt\n    depends_on: [db]\n  db:\n",
+	}
+
+	for name, data := range tt {
+		if _, err := loadSample(t, data); err == nil {
+			t.Errorf("Expecting error for %s\n", name)
+		}
+	}
+}
+
+func TestDiscoveryEnv(t *testing.T) {
+	expected := []string{"DB_PROXY_HOST=10.1.3.4", "DB_PROXY_HOSTS=10.1.3.4,10.1.4.4"}
+
+	if obtained := DiscoveryEnv("db-proxy", []string{"10.1.3.4", "10.1.4.4"}); !reflect.DeepEqual(obtained, expected) {
+		t.Fatalf("Expected %v, obtained %v\n", expected, obtained)
+	}
+
+	if obtained := DiscoveryEnv("db", nil); len(obtained) != 0 {
+		t.Fatalf("Expected no env, obtained %v\n", obtained)
+	}
+}
@@ -0,0 +1,327 @@
+// Package config reads settings of config.yaml, global one is kept in
+// virgo home and projects can override some of them with config.yaml in
+// project directory
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/deferpanic/virgo/pkg/network"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// HomeEnv overrides virgo home, which is ~/.virgo by default
+	HomeEnv = "VIRGO_HOME"
+	File    = "config.yaml"
+
+	DefaultHome = ".virgo"
+	DefaultPool = "10.1.2.0/16"
+	DefaultVga  = "none"
+
+	AccelAuto = "auto"
+	AccelKvm  = "kvm"
+	AccelHax  = "hax"
+	AccelTcg  = "tcg"
+)
+
+type Config struct {
+	Root    string  `yaml:"root,omitempty"`
+	Network Network `yaml:"network,omitempty"`
+	Memory  int     `yaml:"memory,omitempty"`
+	Cpus    int     `yaml:"cpus,omitempty"`
+	Qemu    Qemu    `yaml:"qemu,omitempty"`
+	Log     Log     `yaml:"log,omitempty"`
+}
+
+// Network pool is split to /24 subnets, one per instance, starting from
+// address of pool, e.g. 10.1.2.0/16 gives 10.1.2.0/24, 10.1.3.0/24 etc.
+// Helper is setuid binary which changes host network, virgo-net of PATH
+// is used if it's empty.
+type Network struct {
+	Pool   string `yaml:"pool,omitempty"`
+	Mode   string `yaml:"mode,omitempty"`
+	Helper string `yaml:"helper,omitempty"`
+}
+
+// Qemu binary and firmware default to ones of guest architecture, riscv64
+// firmware is u-boot which is loaded by opensbi of qemu
+type Qemu struct {
+	Binary   string `yaml:"binary,omitempty"`
+	Accel    string `yaml:"accel,omitempty"`
+	Vga      string `yaml:"vga,omitempty"`
+	Firmware string `yaml:"firmware,omitempty"`
+}
+
+// Log serial is name of guest serial log in project logs directory, it
+// has %d for instance number
+type Log struct {
+	Serial string   `yaml:"serial,omitempty"`
+	Sinks  []string `yaml:"sinks,omitempty"`
+}
+
+// key is setting available to get and set commands, global ones can't
+// be overridden by projects
+type key struct {
+	name   string
+	global bool
+	get    func(c *Config) string
+	set    func(c *Config, v string) error
+}
+
+var keys = []key{
+	{"root", true, func(c *Config) string { return c.Root }, func(c *Config, v string) error {
+		if v != "" && !filepath.IsAbs(v) {
+			return fmt.Errorf("root should be absolute path")
+		}
+		c.Root = v
+		return nil
+	}},
+	{"network.pool", true, func(c *Config) string { return c.Network.Pool }, func(c *Config, v string) error {
+		if v != "" {
+			if _, _, err := ParsePool(v); err != nil {
+				return err
+			}
+		}
+		c.Network.Pool = v
+		return nil
+	}},
+	{"network.mode", false, func(c *Config) string { return c.Network.Mode }, func(c *Config, v string) error {
+		if v != "" && v != network.ModeTap && v != network.ModeUser {
+			return fmt.Errorf("network mode should be %s or %s", network.ModeTap, network.ModeUser)
+		}
+		c.Network.Mode = v
+		return nil
+	}},
+	{"network.helper", true, func(c *Config) string { return c.Network.Helper }, func(c *Config, v string) error {
+		c.Network.Helper = v
+		return nil
+	}},
+	{"memory", false, func(c *Config) string { return itoa(c.Memory) }, func(c *Config, v string) error {
+		return atoi(v, &c.Memory)
+	}},
+	{"cpus", false, func(c *Config) string { return itoa(c.Cpus) }, func(c *Config, v string) error {
+		return atoi(v, &c.Cpus)
+	}},
+	{"qemu.binary", false, func(c *Config) string { return c.Qemu.Binary }, func(c *Config, v string) error {
+		c.Qemu.Binary = v
+		return nil
+	}},
+	{"qemu.accel", false, func(c *Config) string { return c.Qemu.Accel }, func(c *Config, v string) error {
+		switch v {
+		case "", AccelAuto, AccelKvm, AccelHax, AccelTcg:
+		default:
+			return fmt.Errorf("accelerator should be one of %s, %s, %s or %s", AccelAuto, AccelKvm, AccelHax, AccelTcg)
+		}
+		c.Qemu.Accel = v
+		return nil
+	}},
+	{"qemu.vga", false, func(c *Config) string { return c.Qemu.Vga }, func(c *Config, v string) error {
+		c.Qemu.Vga = v
+		return nil
+	}},
+	{"qemu.firmware", false, func(c *Config) string { return c.Qemu.Firmware }, func(c *Config, v string) error {
+		if v != "" && !filepath.IsAbs(v) {
+			return fmt.Errorf("firmware should be absolute path")
+		}
+		c.Qemu.Firmware = v
+		return nil
+	}},
+	{"log.serial", true, func(c *Config) string { return c.Log.Serial }, func(c *Config, v string) error {
+		if v != "" && (strings.Count(v, "%d") != 1 || strings.Count(v, "%") != 1 || strings.Contains(v, "/")) {
+			return fmt.Errorf("serial log name should have single %%d for instance number, e.g. serial-%%d.log")
+		}
+		c.Log.Serial = v
+		return nil
+	}},
+	{"log.sinks", false, func(c *Config) string { return strings.Join(c.Log.Sinks, ",") }, func(c *Config, v string) error {
+		c.Log.Sinks = nil
+		for _, sink := range strings.Split(v, ",") {
+			if sink = strings.TrimSpace(sink); sink != "" {
+				c.Log.Sinks = append(c.Log.Sinks, sink)
+			}
+		}
+		return nil
+	}},
+}
+
+func itoa(n int) string {
+	if n == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(n)
+}
+
+func atoi(v string, n *int) error {
+	if v == "" {
+		*n = 0
+		return nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return fmt.Errorf("wrong number '%s'", v)
+	}
+
+	*n = i
+
+	return nil
+}
+
+// Home returns directory of global config file
+func Home() string {
+	if home := os.Getenv(HomeEnv); home != "" {
+		return home
+	}
+
+	return filepath.Join(os.Getenv("HOME"), DefaultHome)
+}
+
+// Load reads config file, missing file is an empty config
+func Load(file string) (*Config, error) {
+	c := &Config{}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("error reading %s - %s", file, err)
+	}
+
+	// values written by hand are checked the same way as set ones
+	for _, k := range keys {
+		if err := k.set(c, k.get(c)); err != nil {
+			return nil, fmt.Errorf("error reading %s - %s: %s", file, k.name, err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *Config) Save(file string) error {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, b, 0644)
+}
+
+// Keys returns names of settings, project ones only if global is false
+func Keys(global bool) []string {
+	result := []string{}
+
+	for _, k := range keys {
+		if global || !k.global {
+			result = append(result, k.name)
+		}
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+func lookup(name string) (key, error) {
+	for _, k := range keys {
+		if k.name == name {
+			return k, nil
+		}
+	}
+
+	return key{}, fmt.Errorf("unknown setting '%s', available are: %s", name, strings.Join(Keys(true), ", "))
+}
+
+// Get returns setting, unset one is empty
+func (c *Config) Get(name string) (string, error) {
+	k, err := lookup(name)
+	if err != nil {
+		return "", err
+	}
+
+	return k.get(c), nil
+}
+
+// Set changes setting, empty value unsets it. Settings of project config
+// can't be global ones.
+func (c *Config) Set(name, value string, project bool) error {
+	k, err := lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if project && k.global {
+		return fmt.Errorf("'%s' can't be set for project", name)
+	}
+
+	return k.set(c, value)
+}
+
+// Merge returns config with settings of project config over global ones
+func (c Config) Merge(project *Config) Config {
+	for _, k := range keys {
+		if v := k.get(project); v != "" && !k.global {
+			k.set(&c, v)
+		}
+	}
+
+	return c
+}
+
+// Pool returns network pool, default one if unset
+func (c Config) Pool() (net.IP, *net.IPNet, error) {
+	if c.Network.Pool == "" {
+		return ParsePool(DefaultPool)
+	}
+
+	return ParsePool(c.Network.Pool)
+}
+
+// ParsePool parses IPv4 network with prefix up to /24, address is the
+// first subnet to use
+func ParsePool(s string) (net.IP, *net.IPNet, error) {
+	ip, pool, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrong network pool '%s' - %s", s, err)
+	}
+
+	if ones, bits := pool.Mask.Size(); ip.To4() == nil || bits != 32 || ones > 24 {
+		return nil, nil, fmt.Errorf("network pool '%s' should be IPv4 network with prefix up to /24", s)
+	}
+
+	return ip.To4(), pool, nil
+}
+
+func (c Config) Vga() string {
+	if c.Qemu.Vga == "" {
+		return DefaultVga
+	}
+
+	return c.Qemu.Vga
+}
+
+func (c Config) NetworkMode() string {
+	if c.Network.Mode == "" {
+		return network.ModeTap
+	}
+
+	return c.Network.Mode
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, File)
+
+	c, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Vga() != DefaultVga || c.NetworkMode() != "tap" {
+		t.Fatalf("Expected defaults, obtained %s, %s\n", c.Vga(), c.NetworkMode())
+	}
+
+	settings := map[string]string{
+		"root":         "/data/virgo",
+		"network.pool": "172.16.0.0/12",
+		"memory":       "256",
+		"qemu.accel":   "kvm",
+		"log.sinks":    "jsonl:///tmp/a, jsonl:///tmp/b",
+		"log.serial":   "console-%d.txt",
+	}
+
+	for key, value := range settings {
+		if err := c.Set(key, value, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Save(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err = Load(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := c.Get("log.sinks"); v != "jsonl:///tmp/a,jsonl:///tmp/b" || len(c.Log.Sinks) != 2 {
+		t.Fatalf("Expected two sinks, obtained %s\n", v)
+	}
+
+	if v, _ := c.Get("memory"); v != "256" {
+		t.Fatalf("Expected memory 256, obtained %s\n", v)
+	}
+
+	errors := []struct {
+		key, value string
+		project    bool
+	}{
+		{"unknown", "", false},
+		{"root", "relative", false},
+		{"network.pool", "10.0.0.0/25", false},
+		{"network.pool", "fd00::/64", false},
+		{"network.mode", "bridge", false},
+		{"memory", "-1", false},
+		{"qemu.accel", "xen", false},
+		{"log.serial", "serial.log", false},
+		{"root", "/tmp", true},
+	}
+
+	for _, e := range errors {
+		if err := c.Set(e.key, e.value, e.project); err == nil {
+			t.Fatalf("Expected error for %s=%s\n", e.key, e.value)
+		}
+	}
+
+	project := &Config{}
+	project.Set("memory", "512", true)
+	project.Set("qemu.binary", "/opt/qemu", true)
+	project.Root = "/ignored"
+
+	merged := c.Merge(project)
+
+	if merged.Memory != 512 || merged.Qemu.Binary != "/opt/qemu" || merged.Root != "/data/virgo" || merged.Qemu.Accel != "kvm" {
+		t.Fatalf("Unexpected merged config %+v\n", merged)
+	}
+
+	if c.Memory != 256 {
+		t.Fatalf("Expected global config to be left untouched, obtained %d\n", c.Memory)
+	}
+
+	start, pool, err := merged.Pool()
+	if err != nil || start.String() != "172.16.0.0" || pool.String() != "172.16.0.0/12" {
+		t.Fatalf("Unexpected pool %s %s, %v\n", start, pool, err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("qemu:\n  accel: xen\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(file); err == nil {
+		t.Fatal("Expected error for wrong accelerator in file")
+	}
+}
@@ -0,0 +1,171 @@
+// Package credentials keeps api tokens of named profiles, so different
+// accounts and mirrors can be used from one host
+package credentials
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultProfile = "default"
+
+	// TokenEnv overrides token of any profile
+	TokenEnv = "VIRGO_TOKEN"
+
+	legacyFile = ".dprc"
+)
+
+type Profile struct {
+	Token  string `json:"token"`
+	Mirror string `json:"mirror,omitempty"`
+}
+
+// Store is credentials file, it's readable by owner only
+type Store struct {
+	Current  string             `json:"current,omitempty"`
+	Profiles map[string]Profile `json:"profiles"`
+
+	file string
+}
+
+// Load reads credentials file, missing file is an empty store. File which
+// is accessible by others is refused the same way ssh does it.
+func Load(file string) (*Store, error) {
+	s := &Store{Profiles: make(map[string]Profile), file: file}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+
+		return nil, err
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("credentials file '%s' is accessible by others, run chmod 600 %s", file, file)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("error reading credentials - %s", err)
+	}
+
+	if s.Profiles == nil {
+		s.Profiles = make(map[string]Profile)
+	}
+
+	return s, nil
+}
+
+// Save writes credentials with 0600 permissions
+func (s *Store) Save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+		return err
+	}
+
+	tmp := s.file + ".tmp"
+
+	wr, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	// umask doesn't matter, but existing tmp file could have other mode
+	if err := wr.Chmod(0600); err != nil {
+		wr.Close()
+		return err
+	}
+
+	if _, err := wr.Write(b); err != nil {
+		wr.Close()
+		return err
+	}
+
+	if err := wr.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.file)
+}
+
+// Set stores profile and makes it current one
+func (s *Store) Set(name string, p Profile) {
+	s.Profiles[name] = p
+	s.Current = name
+}
+
+// Remove removes profile, current profile falls back to default one
+func (s *Store) Remove(name string) error {
+	if _, ok := s.Profiles[name]; !ok {
+		return fmt.Errorf("profile '%s' not found", name)
+	}
+
+	delete(s.Profiles, name)
+
+	if s.Current == name {
+		s.Current = ""
+	}
+
+	return nil
+}
+
+// Names returns sorted profile names
+func (s *Store) Names() []string {
+	result := []string{}
+
+	for name := range s.Profiles {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// Resolve returns profile with given name or current one if name is
+// empty. Token of VIRGO_TOKEN is used over the stored one and ~/.dprc
+// of older versions is used if there is no default profile.
+func (s *Store) Resolve(name string) (Profile, error) {
+	if name == "" {
+		name = s.Current
+	}
+
+	if name == "" {
+		name = DefaultProfile
+	}
+
+	p, ok := s.Profiles[name]
+
+	if token := strings.TrimSpace(os.Getenv(TokenEnv)); token != "" {
+		p.Token = token
+		return p, nil
+	}
+
+	if !ok && name == DefaultProfile {
+		if b, err := ioutil.ReadFile(filepath.Join(os.Getenv("HOME"), legacyFile)); err == nil {
+			p.Token = strings.TrimSpace(string(b))
+		}
+	}
+
+	if p.Token == "" {
+		return p, fmt.Errorf("no credentials found for profile '%s'", name)
+	}
+
+	return p, nil
+}
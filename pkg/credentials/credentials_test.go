@@ -0,0 +1,79 @@
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-credentials-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	home, env := os.Getenv("HOME"), os.Getenv(TokenEnv)
+	defer os.Setenv("HOME", home)
+	defer os.Setenv(TokenEnv, env)
+
+	os.Setenv("HOME", dir)
+	os.Unsetenv(TokenEnv)
+
+	file := filepath.Join(dir, "credentials")
+
+	s, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Resolve(""); err == nil {
+		t.Fatal("Expected error for missing credentials")
+	}
+
+	// token of older versions
+	if err := ioutil.WriteFile(filepath.Join(dir, legacyFile), []byte("legacy\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := s.Resolve(""); err != nil || p.Token != "legacy" {
+		t.Fatalf("Expected legacy token, obtained %v, %v\n", p, err)
+	}
+
+	s.Set("mirror", Profile{Token: "secret", Mirror: "http://mirror/v1"})
+
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected 0600 permissions, obtained %v, %v\n", info.Mode(), err)
+	}
+
+	if s, err = Load(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := s.Resolve(""); err != nil || p.Token != "secret" || p.Mirror != "http://mirror/v1" {
+		t.Fatalf("Expected current profile, obtained %v, %v\n", p, err)
+	}
+
+	os.Setenv(TokenEnv, "env")
+
+	if p, err := s.Resolve("mirror"); err != nil || p.Token != "env" || p.Mirror != "http://mirror/v1" {
+		t.Fatalf("Expected token of environment, obtained %v, %v\n", p, err)
+	}
+
+	if err := s.Remove("mirror"); err != nil || s.Current != "" {
+		t.Fatalf("Expected current profile to be reset, obtained '%s', %v\n", s.Current, err)
+	}
+
+	if err := os.Chmod(file, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(file); err == nil {
+		t.Fatal("Expected error for file readable by others")
+	}
+}
@@ -34,10 +34,6 @@ func (d DepCehck) RunAll() error {
 		return fmt.Errorf("QEMU not found\nYou can install it\n- via homebrew: brew install qemu\n- via port: port install qemu\n- manually: https://www.qemu.org/download/#source")
 	}
 
-	if !d.HasCpulimit() {
-		return fmt.Errorf("cpulimit not found\nYou can install it\n- via howbrew: brew install cpulimit\n- via port: port install cpulimit\n- manually: https://github.com/opsengine/cpulimit")
-	}
-
 	if !d.HasTunTap() {
 		return fmt.Errorf("tuntap not found\nPlease download and install tuntaposx\nhttp://downloads.sourceforge.net/tuntaposx/tuntap_20150118.tar.gz")
 	}
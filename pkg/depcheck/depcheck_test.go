@@ -1,7 +1,16 @@
 package depcheck
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/runner"
 )
 
 func TestIsValidDarwin(t *testing.T) {
@@ -38,3 +47,301 @@ func TestIsValidDarwin(t *testing.T) {
 		}
 	}
 }
+
+func TestKvm(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("kvm is probed on linux amd64 only")
+	}
+
+	dir, err := ioutil.TempDir("", "virgo-depcheck-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(cpuinfo, device, modules string) {
+		cpuInfoFile, kvmDevice, modulesDir = cpuinfo, device, modules
+	}(cpuInfoFile, kvmDevice, modulesDir)
+
+	cpuInfoFile = filepath.Join(dir, "cpuinfo")
+	kvmDevice = filepath.Join(dir, "kvm")
+	modulesDir = filepath.Join(dir, "module")
+
+	d := New(runner.NewDryRunner(ioutil.Discard))
+
+	cases := []struct {
+		flags  string
+		module bool
+		device bool
+		reason string
+	}{
+		{"fpu sse2 hypervisor", false, false, "nested virtualization"},
+		{"fpu sse2", false, false, "virtualization isn't supported"},
+		{"fpu vmx sse2", false, false, "kvm_intel isn't loaded"},
+		{"fpu svm sse2", true, false, "doesn't exist"},
+		{"fpu svm sse2", true, true, ""},
+		// device is all that matters once it exists
+		{"fpu sse2 hypervisor", false, true, ""},
+	}
+
+	for _, c := range cases {
+		os.RemoveAll(modulesDir)
+		os.Remove(kvmDevice)
+
+		if err := ioutil.WriteFile(cpuInfoFile, []byte("processor\t: 0\nflags\t\t: "+c.flags+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.module {
+			if err := os.MkdirAll(filepath.Join(modulesDir, "kvm_amd"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if c.device {
+			if err := ioutil.WriteFile(kvmDevice, nil, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		kvm := d.Kvm()
+
+		if c.reason == "" && !kvm.Usable {
+			t.Fatalf("Expected kvm to be usable with %s, obtained %s\n", c.flags, kvm.Reason)
+		}
+
+		if c.reason != "" && (kvm.Usable || !strings.Contains(kvm.Reason, c.reason) || kvm.Hint == "") {
+			t.Fatalf("Expected '%s' with hint for %s, obtained %+v\n", c.reason, c.flags, kvm)
+		}
+	}
+
+	// root opens any file
+	if os.Getuid() == 0 {
+		return
+	}
+
+	if err := os.Chmod(kvmDevice, 0064); err != nil {
+		t.Fatal(err)
+	}
+
+	if kvm := d.Kvm(); kvm.Usable || !strings.Contains(kvm.Hint, "usermod") {
+		t.Fatalf("Expected permission error, obtained %+v\n", kvm)
+	}
+}
+
+// fakeRunner answers shell commands with given output, unknown commands
+// fail
+type fakeRunner struct {
+	runner.DryRunner
+	out map[string]string
+}
+
+func (r fakeRunner) Shell(args string) ([]byte, error) {
+	out, ok := r.out[args]
+	if !ok {
+		return nil, fmt.Errorf("exit status 1")
+	}
+
+	return []byte(out), nil
+}
+
+func TestDoctor(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux checks only")
+	}
+
+	dir, err := ioutil.TempDir("", "virgo-depcheck-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(release, tun string) {
+		osReleaseFile, tunDevice = release, tun
+	}(osReleaseFile, tunDevice)
+
+	osReleaseFile = filepath.Join(dir, "os-release")
+	tunDevice = filepath.Join(dir, "tun")
+
+	if err := ioutil.WriteFile(osReleaseFile, []byte("NAME=\"Ubuntu\"\nID=ubuntu\nID_LIKE=debian\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if distro := Distro(); distro != "debian" {
+		t.Fatalf("Expected debian, obtained '%s'\n", distro)
+	}
+
+	qemu := "qemu-system-" + hostArch()
+	qemuPath := filepath.Join(dir, qemu)
+
+	helperPath := filepath.Join(dir, "virgo-net")
+
+	for _, file := range []string{qemuPath, helperPath} {
+		if err := ioutil.WriteFile(file, nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := New(fakeRunner{out: map[string]string{
+		"which " + qemu:             qemuPath,
+		qemuPath + " -version":      "QEMU emulator version 2.5.0 (Debian 1:2.5+dfsg-5ubuntu10)\n",
+		qemuPath + " -machine help": "",
+		qemuPath + " -device help":  "",
+		"which iptables":            "/usr/sbin/iptables",
+		"which ip":                  "/usr/sbin/ip",
+		"which qemu-img":            "/usr/bin/qemu-img",
+		"which bridge":              "/usr/sbin/bridge",
+		"which virgo-net":           helperPath,
+	}})
+
+	checks := make(map[string]Check)
+	for _, c := range d.Doctor("") {
+		checks[c.Name] = c
+	}
+
+	if c := checks["qemu"]; c.Ok || !strings.Contains(c.Message, "2.5.0 is too old") || !strings.HasPrefix(c.Hint, "sudo apt-get install -y qemu-system-") {
+		t.Fatalf("Expected old qemu with apt-get hint, obtained %+v\n", c)
+	}
+
+	if c := checks["tun"]; c.Ok || c.Hint != "sudo modprobe tun" {
+		t.Fatalf("Expected missing tun, obtained %+v\n", c)
+	}
+
+	if c := checks["nat"]; !c.Ok || c.Message != "iptables found" {
+		t.Fatalf("Expected iptables, obtained %+v\n", c)
+	}
+
+	// fake helper isn't setuid root
+	if c := checks["privileges"]; c.Ok != (os.Getuid() == 0) || (!c.Ok && c.Hint != "sudo chown root "+helperPath+" && sudo chmod u+s "+helperPath) {
+		t.Fatalf("Unexpected privileges check %+v\n", c)
+	}
+
+	for _, name := range []string{"qemu-img", "ip", "bridge"} {
+		if !checks[name].Ok {
+			t.Fatalf("Expected %s check to pass, obtained %+v\n", name, checks[name])
+		}
+	}
+
+	nftOnly := New(fakeRunner{out: map[string]string{"which nft": "/usr/sbin/nft"}}).checkNat()
+	if nftOnly.Ok || !strings.Contains(nftOnly.Message, "only nft") || !strings.HasPrefix(nftOnly.Hint, "sudo apt-get install -y iptables") {
+		t.Fatalf("Expected nft only host to be unsupported, obtained %+v\n", nftOnly)
+	}
+
+	// missing tool gets package of distribution
+	if c := New(fakeRunner{}).checkTool("ip", "ip", "creates taps"); c.Ok || c.Hint != "sudo apt-get install -y iproute2" {
+		t.Fatalf("Expected iproute2 hint, obtained %+v\n", c)
+	}
+
+	if err := New(fakeRunner{}).Preflight(qemu, false); err == nil || !strings.Contains(err.Error(), "apt-get") {
+		t.Fatalf("Expected missing qemu error, obtained %v\n", err)
+	}
+
+	if !versionAtLeast("8.2.2", minQemuVersion) || !versionAtLeast("2.6", minQemuVersion) || versionAtLeast("2.5.1", minQemuVersion) {
+		t.Fatalf("Unexpected version comparison\n")
+	}
+}
+
+// fakeQemu prints what qemu 2.8 prints and counts its runs
+const fakeQemu = `#!/bin/sh
+echo "$*" >> "$0.calls"
+case "$*" in
+-version)
+	echo "QEMU emulator version 2.8.1(Debian 1:2.8+dfsg-6+deb9u9)"
+	echo "Copyright (c) 2003-2016 Fabrice Bellard and the QEMU Project developers"
+	;;
+"-machine help")
+	echo "Supported machines are:"
+	echo "pc                   Standard PC (i440FX + PIIX, 1996) (alias of pc-i440fx-2.8)"
+	echo "pc-i440fx-2.8        Standard PC (i440FX + PIIX, 1996) (default)"
+	echo "none                 empty machine"
+	;;
+"-device help")
+	echo "Controller/Bridge/Hub devices:"
+	echo 'name "pci-bridge", bus PCI, desc "Standard PCI Bridge"'
+	echo
+	echo "Network devices:"
+	echo 'name "e1000", bus PCI, alias "e1000-82540em", desc "Intel Gigabit Ethernet"'
+	echo 'name "virtio-net-pci", bus PCI, alias "virtio-net"'
+	;;
+*)
+	exit 1
+esac
+`
+
+func TestProbeQemu(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-depcheck-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binary := filepath.Join(dir, "qemu-system-x86_64")
+	cacheFile := filepath.Join(dir, "capabilities.json")
+
+	if err := ioutil.WriteFile(binary, []byte(fakeQemu), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	d := New(runner.NewExecRunner(os.Stdout, os.Stderr, false))
+
+	q, err := d.ProbeQemu(binary, cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Version != "2.8.1" {
+		t.Fatalf("Expected 2.8.1, obtained '%s'\n", q.Version)
+	}
+
+	if !q.HasMachine("pc") || !q.HasMachine("none") || q.HasMachine("virt") || q.HasMachine("Supported") {
+		t.Fatalf("Unexpected machines %v\n", q.Machines)
+	}
+
+	if !q.HasDevice("virtio-net-pci") || !q.HasDevice("virtio-net") || q.HasDevice("virtio-blk-pci") {
+		t.Fatalf("Unexpected devices %v\n", q.Devices)
+	}
+
+	if !q.HasAccel("kvm") || q.HasAccel("hax") || q.HasAccel("xen") {
+		t.Fatalf("Expected kvm accelerator only\n")
+	}
+
+	if err := q.Supported(); err != nil {
+		t.Fatal(err)
+	}
+
+	// cached result is used until binary is changed
+	if _, err := d.ProbeQemu(binary, cacheFile); err != nil {
+		t.Fatal(err)
+	}
+
+	countCalls := func() int {
+		b, err := ioutil.ReadFile(binary + ".calls")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return strings.Count(string(b), "\n")
+	}
+
+	if calls := countCalls(); calls != 3 {
+		t.Fatalf("Expected 3 runs of qemu, obtained %d\n", calls)
+	}
+
+	later := time.Now().Add(time.Hour)
+
+	if err := os.Chtimes(binary, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.ProbeQemu(binary, cacheFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := countCalls(); calls != 6 {
+		t.Fatalf("Expected binary to be probed again, obtained %d runs\n", calls)
+	}
+
+	if _, err := d.ProbeQemu(filepath.Join(dir, "qemu-system-mips"), cacheFile); err == nil {
+		t.Fatalf("Expected error of missing binary\n")
+	}
+}
@@ -0,0 +1,308 @@
+package depcheck
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/deferpanic/virgo/pkg/network"
+)
+
+// oldest qemu which supports every option instances are started with
+const minQemuVersion = "2.6.0"
+
+// device doctor checks, tests point it to fake one
+var tunDevice = "/dev/net/tun"
+
+// Check is result of single host check of doctor, hint tells how to fix
+// failed one. Instances can run without optional checks passed, but some
+// features are missing.
+type Check struct {
+	Name     string `json:"name"`
+	Ok       bool   `json:"ok"`
+	Optional bool   `json:"optional,omitempty"`
+	Message  string `json:"message"`
+	Hint     string `json:"hint,omitempty"`
+}
+
+// Doctor runs checks of everything instances need on host, capsFile
+// caches probed capabilities of qemu
+func (d DepCehck) Doctor(capsFile string) []Check {
+	switch runtime.GOOS {
+	case "linux":
+		return []Check{
+			d.checkQemu(capsFile),
+			d.checkTool("qemu-img", "qemu-img", "creates overlays of volumes"),
+			d.checkTun(),
+			d.checkKvm(),
+			d.checkTool("ip", "ip", "configures tap interfaces"),
+			d.checkNat(),
+			d.optional(d.checkTool("bridge", "bridge", "bridges tap interfaces")),
+			d.checkPrivileges(),
+		}
+	case "darwin":
+		return d.darwinChecks()
+	}
+
+	return []Check{{Name: "os", Message: runtime.GOOS + " isn't supported, only linux and darwin are"}}
+}
+
+func (d DepCehck) optional(c Check) Check {
+	c.Optional = true
+	return c
+}
+
+func (d DepCehck) has(tool string) bool {
+	_, err := d.r.Shell("which " + tool)
+	return err == nil
+}
+
+func (d DepCehck) checkTool(name, tool, purpose string) Check {
+	if !d.has(tool) {
+		return Check{Name: name, Message: tool + " not found, it " + purpose, Hint: InstallHint(name)}
+	}
+
+	return Check{Name: name, Ok: true, Message: tool + " found"}
+}
+
+// checkQemu checks qemu binary of host architecture, its version and
+// devices instances use, probed capabilities are cached in capsFile
+func (d DepCehck) checkQemu(capsFile string) Check {
+	binary := "qemu-system-" + hostArch()
+
+	if !d.has(binary) {
+		return Check{Name: "qemu", Message: binary + " not found", Hint: InstallHint("qemu")}
+	}
+
+	q, err := d.ProbeQemu(binary, capsFile)
+	if err != nil {
+		return Check{Name: "qemu", Message: err.Error(), Hint: InstallHint("qemu")}
+	}
+
+	if !q.Known() {
+		return Check{Name: "qemu", Ok: true, Message: binary + " found, its version is unknown"}
+	}
+
+	if q.Version != "" && !versionAtLeast(q.Version, minQemuVersion) {
+		return Check{
+			Name:    "qemu",
+			Message: fmt.Sprintf("%s %s is too old, %s or newer is needed", binary, q.Version, minQemuVersion),
+			Hint:    InstallHint("qemu"),
+		}
+	}
+
+	for _, device := range []string{"virtio-net-pci", "virtio-blk-pci"} {
+		if !q.HasDevice(device) {
+			return Check{
+				Name:    "qemu",
+				Message: fmt.Sprintf("%s %s doesn't support %s device", binary, q.Version, device),
+				Hint:    InstallHint("qemu"),
+			}
+		}
+	}
+
+	return Check{Name: "qemu", Ok: true, Message: binary + " " + q.Version}
+}
+
+func (d DepCehck) checkTun() Check {
+	f, err := os.OpenFile(tunDevice, os.O_RDWR, 0)
+	switch {
+	case os.IsNotExist(err):
+		return Check{Name: "tun", Message: tunDevice + " doesn't exist, tap interfaces can't be created", Hint: "sudo modprobe tun"}
+	case os.IsPermission(err):
+		return Check{Name: "tun", Message: "no permission to read and write " + tunDevice, Hint: "sudo chmod 0666 " + tunDevice}
+	case err != nil:
+		return Check{Name: "tun", Message: fmt.Sprintf("error opening %s - %s", tunDevice, err), Hint: "sudo modprobe tun"}
+	}
+
+	f.Close()
+
+	return Check{Name: "tun", Ok: true, Message: tunDevice + " is usable"}
+}
+
+func (d DepCehck) checkKvm() Check {
+	kvm := d.Kvm()
+	if !kvm.Usable {
+		return Check{Name: "kvm", Optional: true, Message: kvm.Reason + ", instances are emulated by slow tcg", Hint: kvm.Hint}
+	}
+
+	return Check{Name: "kvm", Ok: true, Message: kvmDevice + " is usable"}
+}
+
+// checkNat checks iptables, which virgo-net masquerades traffic of
+// instances with. It's required as ifup script of instance fails without
+// it. Hosts with nft only aren't supported, iptables-nft package provides
+// iptables command for them.
+func (d DepCehck) checkNat() Check {
+	switch {
+	case d.has("iptables"):
+		return Check{Name: "nat", Ok: true, Message: "iptables found"}
+	case d.has("nft"):
+		return Check{
+			Name:    "nat",
+			Message: "only nft found, which isn't supported, " + network.DefaultHelper + " masquerades instances with iptables",
+			Hint:    InstallHint("iptables") + " (iptables-nft translates its rules to nft)",
+		}
+	}
+
+	return Check{
+		Name:    "nat",
+		Message: "iptables not found, tap interfaces of instances can't be configured",
+		Hint:    InstallHint("iptables"),
+	}
+}
+
+// checkPrivileges checks privileged helper, which changes host network,
+// is installed setuid root, root can run it without setuid bit
+func (d DepCehck) checkPrivileges() Check {
+	helper := network.Helper()
+
+	out, err := d.r.Shell("which " + helper)
+	if err != nil {
+		return Check{
+			Name:    "privileges",
+			Message: helper + " not found, tap interfaces can't be configured",
+			Hint:    "install " + network.DefaultHelper + " next to virgo and make it setuid root, or use network.mode user",
+		}
+	}
+
+	path := strings.TrimSpace(string(out))
+
+	switch {
+	case path == "":
+		// dry run
+		return Check{Name: "privileges", Ok: true, Message: helper + " found"}
+	case os.Getuid() == 0:
+		return Check{Name: "privileges", Ok: true, Message: "running as root, " + path + " found"}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Check{Name: "privileges", Message: fmt.Sprintf("error accessing %s - %s", path, err)}
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); !ok || st.Uid != 0 || info.Mode()&os.ModeSetuid == 0 {
+		return Check{
+			Name:    "privileges",
+			Message: path + " isn't setuid root, tap interfaces can't be configured",
+			Hint:    fmt.Sprintf("sudo chown root %s && sudo chmod u+s %s", path, path),
+		}
+	}
+
+	return Check{Name: "privileges", Ok: true, Message: path + " is setuid root"}
+}
+
+// CheckSubnet checks /24 subnet of ip, which is given to the next
+// instance, isn't used by host interfaces
+func CheckSubnet(ip string) Check {
+	_, subnet, err := net.ParseCIDR(ip + "/24")
+	if err != nil {
+		return Check{Name: "network", Message: fmt.Sprintf("wrong address %s - %s", ip, err)}
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return Check{Name: "network", Message: fmt.Sprintf("error listing interfaces - %s", err)}
+	}
+
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && (subnet.Contains(n.IP) || n.Contains(subnet.IP)) {
+				return Check{
+					Name:    "network",
+					Message: fmt.Sprintf("next free subnet %s overlaps %s of interface %s", subnet, n, iface.Name),
+					Hint:    "virgo config set network.pool with network which isn't used by host, e.g. 172.30.0.0/16",
+				}
+			}
+		}
+	}
+
+	return Check{Name: "network", Ok: true, Message: fmt.Sprintf("next free subnet is %s", subnet)}
+}
+
+func (d DepCehck) darwinChecks() []Check {
+	result := []Check{}
+
+	if _, err := d.OsCheck(); err != nil {
+		result = append(result, Check{Name: "os", Message: strings.TrimSpace(err.Error())})
+	} else {
+		result = append(result, Check{Name: "os", Ok: true, Message: "supported version of OS X"})
+	}
+
+	result = append(result, d.checkTool("qemu", "qemu-system-"+hostArch(), "runs instances"))
+
+	if d.HasTunTap() {
+		result = append(result, Check{Name: "tuntap", Ok: true, Message: "tuntap found"})
+	} else {
+		result = append(result, Check{Name: "tuntap", Message: "tuntap not found", Hint: "install tuntaposx from http://downloads.sourceforge.net/tuntaposx/tuntap_20150118.tar.gz"})
+	}
+
+	if d.HasHAX() {
+		result = append(result, Check{Name: "hax", Ok: true, Optional: true, Message: "hax found"})
+	} else {
+		result = append(result, Check{Name: "hax", Optional: true, Message: "hax not found, instances are emulated by slow tcg", Hint: "brew install --cask intel-haxm"})
+	}
+
+	return result
+}
+
+// hostArch returns architecture of host as qemu binaries name it, it's
+// the same as hypervisor one, which can't be used here as hypervisor
+// package depends on depcheck
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	}
+
+	return runtime.GOARCH
+}
+
+func versionAtLeast(ver, min string) bool {
+	v, m := getVersionParts(ver), getVersionParts(min)
+	if len(v) != 3 || len(m) != 3 {
+		return false
+	}
+
+	for i := range v {
+		if v[i] != m[i] {
+			return v[i] > m[i]
+		}
+	}
+
+	return true
+}
+
+// Preflight fails early with install hint if host misses what qemu
+// instance needs on linux, tap is false for user network
+func (d DepCehck) Preflight(binary string, tap bool) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+
+	if !d.has(binary) {
+		return fmt.Errorf("%s not found, install it with: %s", binary, InstallHint("qemu"))
+	}
+
+	if !tap {
+		return nil
+	}
+
+	for _, c := range []Check{d.checkTun(), d.checkNat(), d.checkPrivileges()} {
+		if !c.Ok {
+			return fmt.Errorf("%s\nfix: %s\nrun 'virgo doctor' to check the rest or use network.mode user", c.Message, c.Hint)
+		}
+	}
+
+	return nil
+}
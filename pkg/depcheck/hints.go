@@ -0,0 +1,127 @@
+package depcheck
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+var osReleaseFile = "/etc/os-release"
+
+// package managers of distribution families, %s is list of packages
+var installCommands = map[string]string{
+	"debian": "sudo apt-get install -y %s",
+	"fedora": "sudo dnf install -y %s",
+	"arch":   "sudo pacman -S --needed %s",
+	"alpine": "sudo apk add %s",
+	"suse":   "sudo zypper install -y %s",
+}
+
+// packages of tools by distribution family, missing family means the tool
+// has the same package name everywhere
+var packages = map[string]map[string]string{
+	"qemu": {
+		"debian": "qemu-system-x86",
+		"fedora": "qemu-system-x86-core",
+		"arch":   "qemu-base",
+		"alpine": "qemu-system-x86_64",
+		"suse":   "qemu-x86",
+	},
+	"qemu-img": {
+		"debian": "qemu-utils",
+		"arch":   "qemu-base",
+		"suse":   "qemu-tools",
+	},
+	"ip": {
+		"debian": "iproute2",
+		"fedora": "iproute",
+		"arch":   "iproute2",
+		"alpine": "iproute2",
+		"suse":   "iproute2",
+	},
+	"bridge": {
+		"debian": "iproute2",
+		"fedora": "iproute",
+		"arch":   "iproute2",
+		"alpine": "iproute2-bridge",
+		"suse":   "iproute2",
+	},
+}
+
+// default package names of tools
+var defaultPackages = map[string]string{
+	"qemu":     "qemu",
+	"qemu-img": "qemu-img",
+	"ip":       "iproute2",
+	"bridge":   "iproute2",
+	"iptables": "iptables",
+}
+
+// qemu packages of debian based distributions are split by architecture
+var debianQemu = map[string]string{
+	"arm64":   "qemu-system-arm",
+	"riscv64": "qemu-system-misc",
+}
+
+// Distro returns family of linux distribution host runs, e.g. debian for
+// ubuntu, empty string if it's unknown
+func Distro() string {
+	f, err := os.Open(osReleaseFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	ids := []string{}
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), "=", 2)
+		if len(parts) != 2 || (parts[0] != "ID" && parts[0] != "ID_LIKE") {
+			continue
+		}
+
+		ids = append(ids, strings.Fields(strings.Trim(parts[1], `"'`))...)
+	}
+
+	for _, id := range ids {
+		switch id {
+		case "debian", "ubuntu":
+			return "debian"
+		case "fedora", "rhel", "centos":
+			return "fedora"
+		case "arch", "alpine":
+			return id
+		case "suse", "opensuse":
+			return "suse"
+		}
+	}
+
+	return ""
+}
+
+// InstallHint returns command which installs tool on host
+func InstallHint(tool string) string {
+	if runtime.GOOS == "darwin" {
+		return "brew install " + defaultPackages[tool]
+	}
+
+	distro := Distro()
+
+	pkg, ok := packages[tool][distro]
+	if !ok {
+		pkg = defaultPackages[tool]
+	}
+
+	if tool == "qemu" && distro == "debian" && debianQemu[runtime.GOARCH] != "" {
+		pkg = debianQemu[runtime.GOARCH]
+	}
+
+	if cmd, ok := installCommands[distro]; ok {
+		return fmt.Sprintf(cmd, pkg)
+	}
+
+	return fmt.Sprintf("install %s with package manager of your distribution", pkg)
+}
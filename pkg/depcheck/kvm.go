@@ -0,0 +1,141 @@
+package depcheck
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// files kvm is probed with, tests point them to fake ones
+var (
+	cpuInfoFile = "/proc/cpuinfo"
+	kvmDevice   = "/dev/kvm"
+	modulesDir  = "/sys/module"
+)
+
+// Kvm is result of kvm probe, reason and hint explain why it can't be
+// used and how to fix it
+type Kvm struct {
+	Usable bool
+	Reason string
+	Hint   string
+}
+
+// Kvm probes if kvm can be used by current user. Device is tried first,
+// cpu flags and kernel module explain why it's missing.
+func (d DepCehck) Kvm() Kvm {
+	if runtime.GOOS != "linux" {
+		return Kvm{Reason: "kvm is available on linux only"}
+	}
+
+	info, err := os.Stat(kvmDevice)
+	if err == nil {
+		return openKvm(info)
+	}
+
+	if !os.IsNotExist(err) {
+		return Kvm{Reason: fmt.Sprintf("error accessing %s - %s", kvmDevice, err)}
+	}
+
+	module := "kvm"
+
+	// other architectures don't report virtualization in cpu flags
+	if runtime.GOARCH == "amd64" || runtime.GOARCH == "386" {
+		flags, err := cpuFlags()
+		if err != nil {
+			return Kvm{Reason: fmt.Sprintf("error reading %s - %s", cpuInfoFile, err)}
+		}
+
+		switch {
+		case flags["vmx"]:
+			module = "kvm_intel"
+		case flags["svm"]:
+			module = "kvm_amd"
+		case flags["hypervisor"]:
+			return Kvm{
+				Reason: "host is a virtual machine without nested virtualization, cpu has no vmx or svm flag",
+				Hint:   "enable nested virtualization for this machine in the outer hypervisor or cloud provider",
+			}
+		default:
+			return Kvm{
+				Reason: "cpu has no vmx or svm flag, virtualization isn't supported or is disabled",
+				Hint:   "enable Intel VT-x or AMD-V in BIOS/UEFI settings",
+			}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(modulesDir, module)); os.IsNotExist(err) {
+		return Kvm{
+			Reason: fmt.Sprintf("kernel module %s isn't loaded", module),
+			Hint:   "sudo modprobe " + module,
+		}
+	}
+
+	return Kvm{
+		Reason: fmt.Sprintf("kernel module is loaded, but %s doesn't exist", kvmDevice),
+		Hint:   "check that udev is running or create device: sudo mknod " + kvmDevice + " c 10 232",
+	}
+}
+
+// openKvm checks existing device can be opened for reading and writing
+func openKvm(info os.FileInfo) Kvm {
+	f, err := os.OpenFile(kvmDevice, os.O_RDWR, 0)
+	if err == nil {
+		f.Close()
+		return Kvm{Usable: true}
+	}
+
+	if !os.IsPermission(err) {
+		return Kvm{Reason: fmt.Sprintf("error opening %s - %s", kvmDevice, err)}
+	}
+
+	hint := `device is accessible by its owner only, allow kvm group via udev rule KERNEL=="kvm", GROUP="kvm", MODE="0660"`
+
+	if info.Mode().Perm()&0060 == 0060 {
+		group := "kvm"
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if g, err := user.LookupGroupId(strconv.Itoa(int(st.Gid))); err == nil {
+				group = g.Name
+			}
+		}
+
+		hint = fmt.Sprintf("sudo usermod -aG %s $USER and log in again", group)
+	}
+
+	return Kvm{
+		Reason: fmt.Sprintf("no permission to read and write %s", kvmDevice),
+		Hint:   hint,
+	}
+}
+
+// cpuFlags returns flags of the first cpu
+func cpuFlags() (map[string]bool, error) {
+	b, err := ioutil.ReadFile(cpuInfoFile)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]bool)
+
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "flags" {
+			continue
+		}
+
+		for _, flag := range strings.Fields(parts[1]) {
+			result[flag] = true
+		}
+
+		break
+	}
+
+	return result, nil
+}
@@ -0,0 +1,189 @@
+package depcheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// accelerators of -accel option and qemu versions which support them
+var accelSince = map[string]string{
+	"tcg":  minQemuVersion,
+	"kvm":  minQemuVersion,
+	"hax":  "2.9.0",
+	"hvf":  "2.12.0",
+	"whpx": "3.0.0",
+}
+
+var (
+	qemuVersion = regexp.MustCompile(`version (\d+\.\d+(\.\d+)?)`)
+	deviceName  = regexp.MustCompile(`name "([^"]+)"`)
+	deviceAlias = regexp.MustCompile(`alias "([^"]+)"`)
+)
+
+// Qemu is what qemu binary supports, it's probed once and cached until
+// the binary is changed
+type Qemu struct {
+	Binary   string    `json:"binary"`
+	ModTime  time.Time `json:"modtime"`
+	Version  string    `json:"version"`
+	Machines []string  `json:"machines"`
+	Devices  []string  `json:"devices"`
+}
+
+// ProbeQemu returns capabilities of qemu binary, they're cached in
+// cacheFile by path of binary, empty cacheFile disables caching
+func (d DepCehck) ProbeQemu(binary, cacheFile string) (Qemu, error) {
+	out, err := d.r.Shell("which " + binary)
+	if err != nil {
+		return Qemu{}, fmt.Errorf("%s not found, install it with: %s", binary, InstallHint("qemu"))
+	}
+
+	path := strings.TrimSpace(string(out))
+
+	// dry run has nothing to probe
+	if path == "" {
+		return Qemu{Binary: binary}, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Qemu{}, fmt.Errorf("error accessing %s - %s", path, err)
+	}
+
+	cache := loadQemuCache(cacheFile)
+
+	if q, ok := cache[path]; ok && q.ModTime.Equal(info.ModTime()) {
+		return q, nil
+	}
+
+	q := Qemu{Binary: path, ModTime: info.ModTime()}
+
+	if out, err = d.r.Shell(path + " -version"); err != nil {
+		return Qemu{}, fmt.Errorf("error running %s -version - %s\n%s", path, err, out)
+	}
+
+	if m := qemuVersion.FindStringSubmatch(string(out)); m != nil {
+		q.Version = m[1]
+	}
+
+	if out, err = d.r.Shell(path + " -machine help"); err != nil {
+		return Qemu{}, fmt.Errorf("error listing machines of %s - %s\n%s", path, err, out)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasSuffix(line, ":") {
+			continue
+		}
+
+		q.Machines = append(q.Machines, fields[0])
+	}
+
+	if out, err = d.r.Shell(path + " -device help"); err != nil {
+		return Qemu{}, fmt.Errorf("error listing devices of %s - %s\n%s", path, err, out)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := deviceName.FindStringSubmatch(line); m != nil {
+			q.Devices = append(q.Devices, m[1])
+		}
+
+		if m := deviceAlias.FindStringSubmatch(line); m != nil {
+			q.Devices = append(q.Devices, m[1])
+		}
+	}
+
+	if cacheFile == "" {
+		return q, nil
+	}
+
+	cache[path] = q
+
+	b, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return Qemu{}, err
+	}
+
+	if err := ioutil.WriteFile(cacheFile, b, 0644); err != nil {
+		return Qemu{}, fmt.Errorf("error saving qemu capabilities - %s", err)
+	}
+
+	return q, nil
+}
+
+// loadQemuCache reads cached capabilities, broken cache is probed again
+func loadQemuCache(file string) map[string]Qemu {
+	result := make(map[string]Qemu)
+
+	if file == "" {
+		return result
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return result
+	}
+
+	if err := json.Unmarshal(b, &result); err != nil {
+		return make(map[string]Qemu)
+	}
+
+	return result
+}
+
+// Known is false if nothing was probed, e.g. in dry run
+func (q Qemu) Known() bool {
+	return q.Version != "" || len(q.Machines) > 0 || len(q.Devices) > 0
+}
+
+func (q Qemu) HasMachine(name string) bool {
+	for _, m := range q.Machines {
+		if m == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasDevice checks device by its name or alias
+func (q Qemu) HasDevice(name string) bool {
+	for _, d := range q.Devices {
+		if d == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AccelSince returns qemu version which is needed for accelerator, empty
+// string for unknown one
+func AccelSince(accel string) string {
+	return accelSince[accel]
+}
+
+// HasAccel checks -accel option supports accelerator, availability of
+// accelerator on host isn't checked
+func (q Qemu) HasAccel(accel string) bool {
+	since, ok := accelSince[accel]
+	if !ok {
+		return false
+	}
+
+	return versionAtLeast(q.Version, since)
+}
+
+// Supported fails with explanation if qemu is too old for instances
+func (q Qemu) Supported() error {
+	if q.Version != "" && !versionAtLeast(q.Version, minQemuVersion) {
+		return fmt.Errorf("%s %s is too old, %s or newer is needed, upgrade it with: %s", q.Binary, q.Version, minQemuVersion, InstallHint("qemu"))
+	}
+
+	return nil
+}
@@ -0,0 +1,377 @@
+// Package download fetches files over http in parallel. Files are
+// downloaded to .part files first, interrupted downloads are resumed
+// with range requests and files are renamed only when all of them are
+// complete.
+package download
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PartSuffix is added to files being downloaded, ETag of part file is
+// kept next to it with ETagSuffix, so it's resumed only from the same
+// version of file
+const (
+	PartSuffix = ".part"
+	ETagSuffix = ".etag"
+)
+
+// Job is a file to download, Name identifies it in progress events.
+// Job with ETag of cached copy is skipped if server reports it isn't
+// modified, ETag is updated with one of downloaded file. Job with Fetch
+// is downloaded by it to given file instead of http, e.g. by api client
+// with its own endpoints and auth, such job isn't resumed.
+type Job struct {
+	Name   string
+	URL    string
+	File   string
+	ETag   string
+	Cached bool
+	Fetch  func(dst string) error
+}
+
+// Event kinds reported to Progress
+const (
+	EventStart    = "start"
+	EventProgress = "progress"
+	EventRetry    = "retry"
+	EventDone     = "done"
+	EventCached   = "cached"
+	EventError    = "error"
+)
+
+// Event is reported for every job, Total is -1 if server doesn't tell
+// the size of file
+type Event struct {
+	Name  string `json:"name"`
+	Event string `json:"event"`
+	Bytes int64  `json:"bytes"`
+	Total int64  `json:"total"`
+	Error string `json:"error,omitempty"`
+}
+
+type Manager struct {
+	Client   *http.Client
+	Header   http.Header
+	Parallel int
+	Retries  int
+	Backoff  time.Duration
+
+	// Progress is called from download goroutines, nil disables reports
+	Progress func(Event)
+
+	mu sync.Mutex
+}
+
+func New() *Manager {
+	return &Manager{
+		Client:   http.DefaultClient,
+		Header:   http.Header{},
+		Parallel: 4,
+		Retries:  5,
+		Backoff:  time.Second,
+	}
+}
+
+// statusError is returned for unexpected http status, client errors
+// aren't retried
+type statusError struct {
+	url  string
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d of %s", e.code, e.url)
+}
+
+func (e statusError) temporary() bool {
+	return e.code >= 500 || e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests
+}
+
+// Fetch downloads all jobs, files are renamed into place only if every
+// job succeeds, otherwise .part files are left to resume next time.
+// Cached jobs are marked, their files are left untouched.
+func (m *Manager) Fetch(jobs []Job) error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(jobs))
+		sem  = make(chan struct{}, m.parallel())
+	)
+
+	for _, job := range jobs {
+		m.report(Event{Name: job.Name, Event: EventStart, Total: -1})
+	}
+
+	for i := range jobs {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			errs[i] = m.fetch(&jobs[i])
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, job := range jobs {
+		if job.Cached {
+			continue
+		}
+
+		if err := os.Rename(job.File+PartSuffix, job.File); err != nil {
+			return fmt.Errorf("error saving %s - %s", job.Name, err)
+		}
+
+		os.Remove(job.File + PartSuffix + ETagSuffix)
+	}
+
+	return nil
+}
+
+func (m *Manager) parallel() int {
+	if m.Parallel < 1 {
+		return 1
+	}
+
+	return m.Parallel
+}
+
+// fetch retries job with exponential backoff
+func (m *Manager) fetch(job *Job) error {
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		if err = m.get(job); err == nil {
+			break
+		}
+
+		if se, ok := err.(statusError); (ok && !se.temporary()) || attempt >= m.Retries {
+			break
+		}
+
+		m.report(Event{Name: job.Name, Event: EventRetry, Total: -1, Error: err.Error()})
+
+		time.Sleep(m.Backoff << uint(attempt))
+	}
+
+	if err != nil {
+		m.report(Event{Name: job.Name, Event: EventError, Total: -1, Error: err.Error()})
+		return fmt.Errorf("error downloading %s - %s", job.Name, err)
+	}
+
+	return nil
+}
+
+// get downloads job to .part file, continuing from its end
+func (m *Manager) get(job *Job) error {
+	part := job.File + PartSuffix
+
+	if job.Fetch != nil {
+		os.Remove(part)
+
+		if err := job.Fetch(part); err != nil {
+			return err
+		}
+
+		info, err := os.Stat(part)
+		if err != nil {
+			return err
+		}
+
+		m.report(Event{Name: job.Name, Event: EventDone, Bytes: info.Size(), Total: info.Size()})
+
+		return nil
+	}
+
+	var (
+		offset   int64
+		partETag string
+	)
+
+	// part file of unknown version isn't resumed
+	if info, err := os.Stat(part); err == nil {
+		if b, err := ioutil.ReadFile(part + ETagSuffix); err == nil && len(b) > 0 {
+			offset = info.Size()
+			partETag = string(b)
+		}
+	}
+
+	req, err := http.NewRequest("GET", job.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range m.Header {
+		req.Header[k] = v
+	}
+
+	if offset > 0 {
+		// server sends whole file if it's changed since part was started
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		req.Header.Set("If-Range", partETag)
+	} else if job.ETag != "" {
+		req.Header.Set("If-None-Match", job.ETag)
+	}
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		job.Cached = true
+		m.report(Event{Name: job.Name, Event: EventCached})
+		return nil
+
+	case http.StatusOK:
+		// server ignores range or file is changed, it's downloaded from
+		// start
+		offset = 0
+		flags |= os.O_TRUNC
+
+		if err := saveETag(part, resp.Header.Get("ETag")); err != nil {
+			return err
+		}
+
+	case http.StatusPartialContent:
+		if start, _ := contentRange(resp.Header.Get("Content-Range")); start != offset {
+			os.Remove(part)
+			return fmt.Errorf("server resumed %s from wrong offset", job.Name)
+		}
+
+		flags |= os.O_APPEND
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		// part file could be complete already
+		if _, size := contentRange(resp.Header.Get("Content-Range")); size == offset {
+			m.report(Event{Name: job.Name, Event: EventDone, Bytes: offset, Total: offset})
+			return nil
+		}
+
+		os.Remove(part)
+		return fmt.Errorf("part file of %s doesn't match server one", job.Name)
+
+	default:
+		return statusError{job.URL, resp.StatusCode}
+	}
+
+	job.ETag = resp.Header.Get("ETag")
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+
+	wr, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer wr.Close()
+
+	pw := &progressWriter{m: m, event: Event{Name: job.Name, Event: EventProgress, Bytes: offset, Total: total}}
+
+	if _, err := io.Copy(io.MultiWriter(wr, pw), resp.Body); err != nil {
+		return err
+	}
+
+	if total >= 0 && pw.event.Bytes != total {
+		return io.ErrUnexpectedEOF
+	}
+
+	m.report(Event{Name: job.Name, Event: EventDone, Bytes: pw.event.Bytes, Total: pw.event.Bytes})
+
+	return nil
+}
+
+// saveETag records version of part file, part without strong ETag can't
+// be resumed safely, so its record is removed
+func saveETag(part, etag string) error {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		os.Remove(part + ETagSuffix)
+		return nil
+	}
+
+	if err := ioutil.WriteFile(part+ETagSuffix, []byte(etag), 0644); err != nil {
+		return fmt.Errorf("error saving etag of %s - %s", part, err)
+	}
+
+	return nil
+}
+
+func (m *Manager) report(e Event) {
+	if m.Progress == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Progress(e)
+}
+
+// contentRange parses "bytes start-end/size" and "bytes */size", unknown
+// values are -1
+func contentRange(s string) (int64, int64) {
+	start, size := int64(-1), int64(-1)
+
+	s = strings.TrimPrefix(s, "bytes ")
+
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return start, size
+	}
+
+	if v, err := strconv.ParseInt(s[i+1:], 10, 64); err == nil {
+		size = v
+	}
+
+	if j := strings.Index(s[:i], "-"); j > 0 {
+		if v, err := strconv.ParseInt(s[:j], 10, 64); err == nil {
+			start = v
+		}
+	}
+
+	return start, size
+}
+
+// progressWriter reports bytes written at most every progressInterval
+type progressWriter struct {
+	m     *Manager
+	event Event
+	last  time.Time
+}
+
+const progressInterval = 100 * time.Millisecond
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.event.Bytes += int64(len(b))
+
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.m.report(p.event)
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,291 @@
+package download
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer serves files with range support, the first request of
+// every file is cut in the middle
+type flakyServer struct {
+	mu       sync.Mutex
+	files    map[string][]byte
+	etag     string
+	requests map[string][]string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	content, ok := s.files[r.URL.Path]
+	s.requests[r.URL.Path] = append(s.requests[r.URL.Path], r.Header.Get("Range"))
+	first := len(s.requests[r.URL.Path]) == 1
+	etag := s.etag
+	s.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+
+	if first {
+		w.Header().Set("Content-Length", "1000000")
+		w.Write(content[:len(content)/2])
+		return
+	}
+
+	http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(content))
+}
+
+func newServer() (*httptest.Server, *flakyServer) {
+	s := &flakyServer{
+		files: map[string][]byte{
+			"/kernel": bytes.Repeat([]byte("kernel"), 10000),
+			"/vol1":   bytes.Repeat([]byte("volume"), 20000),
+		},
+		etag:     `"v1"`,
+		requests: make(map[string][]string),
+	}
+
+	return httptest.NewServer(s), s
+}
+
+func newManager() *Manager {
+	m := New()
+	m.Backoff = time.Millisecond
+
+	return m
+}
+
+func TestFetch(t *testing.T) {
+	ts, s := newServer()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "virgo-download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	events := []Event{}
+
+	m := newManager()
+	m.Progress = func(e Event) { events = append(events, e) }
+
+	jobs := []Job{
+		{Name: "kernel", URL: ts.URL + "/kernel", File: filepath.Join(dir, "kernel")},
+		{Name: "vol1", URL: ts.URL + "/vol1", File: filepath.Join(dir, "vol1")},
+	}
+
+	if err := m.Fetch(jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, job := range jobs {
+		b, err := ioutil.ReadFile(job.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := s.files["/"+job.Name]; !bytes.Equal(b, expected) {
+			t.Fatalf("Expected %d bytes of %s, obtained %d\n", len(expected), job.Name, len(b))
+		}
+
+		// second request resumes from the end of part file
+		if r := s.requests["/"+job.Name]; len(r) != 2 || r[0] != "" || !strings.HasPrefix(r[1], "bytes=") {
+			t.Fatalf("Expected resumed request of %s, obtained %q\n", job.Name, r)
+		}
+
+		if _, err := os.Stat(job.File + PartSuffix); !os.IsNotExist(err) {
+			t.Fatalf("Expected part file of %s to be renamed, obtained %v\n", job.Name, err)
+		}
+	}
+
+	kinds := make(map[string]int)
+	for _, e := range events {
+		kinds[e.Event]++
+	}
+
+	if kinds[EventStart] != 2 || kinds[EventRetry] != 2 || kinds[EventDone] != 2 {
+		t.Fatalf("Unexpected events %v\n", kinds)
+	}
+}
+
+func TestFetchChanged(t *testing.T) {
+	ts, s := newServer()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "virgo-download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newManager()
+
+	// file is changed upstream after first attempt is cut
+	m.Progress = func(e Event) {
+		if e.Event == EventRetry {
+			s.mu.Lock()
+			s.files["/kernel"] = bytes.Repeat([]byte("KERNEL"), 10000)
+			s.etag = `"v2"`
+			s.mu.Unlock()
+		}
+	}
+
+	job := Job{Name: "kernel", URL: ts.URL + "/kernel", File: filepath.Join(dir, "kernel")}
+
+	if err := m.Fetch([]Job{job}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile(job.File); !bytes.Equal(b, s.files["/kernel"]) {
+		t.Fatalf("Expected changed kernel to be downloaded from start, obtained %d bytes\n", len(b))
+	}
+
+	if _, err := os.Stat(job.File + PartSuffix + ETagSuffix); !os.IsNotExist(err) {
+		t.Fatalf("Expected etag of part file to be removed, obtained %v\n", err)
+	}
+}
+
+func TestFetchFailed(t *testing.T) {
+	ts, s := newServer()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "virgo-download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newManager()
+
+	jobs := []Job{
+		{Name: "kernel", URL: ts.URL + "/kernel", File: filepath.Join(dir, "kernel")},
+		{Name: "vol2", URL: ts.URL + "/vol2", File: filepath.Join(dir, "vol2")},
+	}
+
+	if err := m.Fetch(jobs); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Expected not found error, obtained %v\n", err)
+	}
+
+	// client errors aren't retried
+	if r := s.requests["/vol2"]; len(r) != 1 {
+		t.Fatalf("Expected single request of missing file, obtained %d\n", len(r))
+	}
+
+	// nothing is renamed unless every file is downloaded
+	if _, err := os.Stat(jobs[0].File); !os.IsNotExist(err) {
+		t.Fatalf("Expected kernel not to be saved, obtained %v\n", err)
+	}
+
+	if _, err := os.Stat(jobs[0].File + PartSuffix); err != nil {
+		t.Fatalf("Expected part file to be kept - %s\n", err)
+	}
+}
+
+func TestFetchFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	calls := 0
+
+	job := Job{
+		Name: "kernel",
+		URL:  "https://api.local/kernel",
+		File: filepath.Join(dir, "kernel"),
+		Fetch: func(dst string) error {
+			calls++
+
+			// partial file of failed attempt isn't resumed
+			if _, err := os.Stat(dst); err == nil {
+				return fmt.Errorf("part file is left")
+			}
+
+			if err := ioutil.WriteFile(dst, []byte("kernel"), 0644); err != nil || calls == 1 {
+				return fmt.Errorf("connection reset")
+			}
+
+			return nil
+		},
+	}
+
+	if err := newManager().Fetch([]Job{job}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ioutil.ReadFile(job.File); err != nil || string(b) != "kernel" || calls != 2 {
+		t.Fatalf("Expected kernel fetched on second attempt, obtained '%s' after %d calls, %v\n", b, calls, err)
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	cases := []struct {
+		header      string
+		start, size int64
+	}{
+		{"bytes 100-199/200", 100, 200},
+		{"bytes */200", -1, 200},
+		{"bytes 0-99/*", 0, -1},
+		{"", -1, -1},
+	}
+
+	for _, c := range cases {
+		if start, size := contentRange(c.header); start != c.start || size != c.size {
+			t.Fatalf("Expected %d, %d for '%s', obtained %d, %d\n", c.start, c.size, c.header, start, size)
+		}
+	}
+}
+
+func TestFetchNotModified(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v2"`)
+		w.Write([]byte("kernel"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "virgo-download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jobs := []Job{
+		{Name: "cached", URL: ts.URL, File: filepath.Join(dir, "cached"), ETag: `"v1"`},
+		{Name: "changed", URL: ts.URL, File: filepath.Join(dir, "changed"), ETag: `"v0"`},
+	}
+
+	if err := newManager().Fetch(jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	if !jobs[0].Cached || jobs[1].Cached {
+		t.Fatalf("Expected only first job to be cached, obtained %v\n", jobs)
+	}
+
+	if _, err := os.Stat(jobs[0].File); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file of cached job, obtained %v\n", err)
+	}
+
+	if jobs[1].ETag != `"v2"` {
+		t.Fatalf("Expected etag of downloaded file, obtained %s\n", jobs[1].ETag)
+	}
+}
@@ -0,0 +1,75 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/deferpanic/virgo/pkg/stats"
+)
+
+const barWidth = 30
+
+// Bar returns Progress func drawing single line with overall progress of
+// all jobs, errors and retries are printed on their own lines
+func Bar(w io.Writer) func(Event) {
+	jobs := make(map[string]Event)
+	order := []string{}
+
+	return func(e Event) {
+		if _, ok := jobs[e.Name]; !ok {
+			order = append(order, e.Name)
+		}
+
+		jobs[e.Name] = e
+
+		if e.Event == EventRetry || e.Event == EventError {
+			fmt.Fprintf(w, "\r\033[K%s: %s\n", e.Name, e.Error)
+		}
+
+		var (
+			bytes, total int64
+			done         int
+			known        = true
+		)
+
+		for _, name := range order {
+			job := jobs[name]
+
+			bytes += job.Bytes
+
+			if job.Total < 0 {
+				known = false
+			} else {
+				total += job.Total
+			}
+
+			if job.Event == EventDone || job.Event == EventCached {
+				done++
+			}
+		}
+
+		line := fmt.Sprintf("%d/%d files %s", done, len(order), stats.HumanBytes(uint64(bytes)))
+
+		if known && total > 0 {
+			filled := int(bytes * barWidth / total)
+			line = fmt.Sprintf("[%s%s] %3d%% %s/%s", strings.Repeat("#", filled), strings.Repeat(" ", barWidth-filled), bytes*100/total, line, stats.HumanBytes(uint64(total)))
+		}
+
+		fmt.Fprintf(w, "\r\033[K%s", line)
+
+		if done == len(order) {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// JSON returns Progress func writing every event as json line
+func JSON(w io.Writer) func(Event) {
+	enc := json.NewEncoder(w)
+
+	return func(e Event) {
+		enc.Encode(e)
+	}
+}
@@ -0,0 +1,363 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TypeTCP  = "tcp"
+	TypeHTTP = "http"
+	TypeLog  = "log"
+
+	StatusNone      = "none"
+	StatusStarting  = "starting"
+	StatusHealthy   = "healthy"
+	StatusUnhealthy = "unhealthy"
+
+	defaultInterval = 5 * time.Second
+	defaultTimeout  = 2 * time.Second
+	defaultRetries  = 3
+)
+
+// Duration is time.Duration, which is represented in json as "5s"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string, e.g. \"5s\" - %s", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = v
+
+	return nil
+}
+
+// Check describes how instance health is probed. It could be declared in
+// manifest file as "Healthcheck" object or by run flags.
+type Check struct {
+	Type     string   // tcp, http or log
+	Port     int      `json:",omitempty"` // tcp and http
+	Path     string   `json:",omitempty"` // http
+	Status   int      `json:",omitempty"` // http, expected status code
+	Regex    string   `json:",omitempty"` // log, pattern to find in serial log
+	Interval Duration `json:",omitempty"`
+	Timeout  Duration `json:",omitempty"`
+	Retries  int      `json:",omitempty"` // consecutive failures to become unhealthy
+
+	// failures within StartPeriod after start keep instance starting,
+	// so slow booting unikernels aren't reported unhealthy
+	StartPeriod Duration `json:",omitempty"`
+}
+
+// Parse creates check from spec, supported formats are:
+//
+//	tcp:3000
+//	http:3000/path, http:3000/path=204
+//	log:regex
+func Parse(spec string) (*Check, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("wrong health check format '%s', should be tcp:port, http:port/path[=status] or log:regex", spec)
+	}
+
+	c := &Check{Type: parts[0]}
+
+	switch c.Type {
+	case TypeTCP:
+		port, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("wrong port in health check '%s' - %s", spec, err)
+		}
+
+		c.Port = port
+
+	case TypeHTTP:
+		target := parts[1]
+
+		// "=" of query parameter, e.g.: /ready?full=1, isn't a status
+		if i := strings.LastIndex(target, "="); i != -1 && isStatus(target[:i], target[i+1:]) {
+			c.Status, _ = strconv.Atoi(target[i+1:])
+			target = target[:i]
+		}
+
+		port := target
+		if i := strings.Index(target, "/"); i != -1 {
+			port = target[:i]
+			c.Path = target[i:]
+		}
+
+		v, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("wrong port in health check '%s' - %s", spec, err)
+		}
+
+		c.Port = v
+
+	case TypeLog:
+		c.Regex = parts[1]
+
+	default:
+		return nil, fmt.Errorf("unsupported health check type '%s'", c.Type)
+	}
+
+	return c, c.Validate()
+}
+
+// isStatus tells whether suffix after "=" of http check is expected status,
+// it has to be a number following the whole path including query
+func isStatus(path, suffix string) bool {
+	if suffix == "" || strings.TrimLeft(suffix, "0123456789") != "" {
+		return false
+	}
+
+	if i := strings.LastIndexAny(path, "?&"); i != -1 {
+		return strings.Contains(path[i:], "=")
+	}
+
+	return true
+}
+
+func (c *Check) Validate() error {
+	switch c.Type {
+	case TypeTCP, TypeHTTP:
+		if c.Port <= 0 || c.Port > 65535 {
+			return fmt.Errorf("wrong port %d in %s health check", c.Port, c.Type)
+		}
+	case TypeLog:
+		if _, err := regexp.Compile(c.Regex); err != nil {
+			return fmt.Errorf("wrong regex in log health check - %s", err)
+		}
+	default:
+		return fmt.Errorf("unsupported health check type '%s'", c.Type)
+	}
+
+	if c.Interval.Duration < 0 || c.Timeout.Duration < 0 || c.Retries < 0 || c.StartPeriod.Duration < 0 {
+		return fmt.Errorf("health check interval, timeout, retries and start period can't be negative")
+	}
+
+	return nil
+}
+
+// SetDefaults fills empty settings with default values
+func (c *Check) SetDefaults() {
+	if c.Interval.Duration == 0 {
+		c.Interval.Duration = defaultInterval
+	}
+
+	if c.Timeout.Duration == 0 {
+		c.Timeout.Duration = defaultTimeout
+	}
+
+	if c.Retries == 0 {
+		c.Retries = defaultRetries
+	}
+
+	if c.Type == TypeHTTP && c.Status == 0 {
+		c.Status = http.StatusOK
+	}
+
+	if c.Type == TypeHTTP && c.Path == "" {
+		c.Path = "/"
+	}
+}
+
+func (c *Check) String() string {
+	switch c.Type {
+	case TypeTCP:
+		return fmt.Sprintf("tcp:%d", c.Port)
+	case TypeHTTP:
+		return fmt.Sprintf("http:%d%s=%d", c.Port, c.Path, c.Status)
+	case TypeLog:
+		return "log:" + c.Regex
+	}
+
+	return ""
+}
+
+// Probe checks instance once, serial log is used by log check only
+func (c *Check) Probe(ip string, serialLog string) error {
+	addr := net.JoinHostPort(ip, strconv.Itoa(c.Port))
+
+	switch c.Type {
+	case TypeTCP:
+		conn, err := net.DialTimeout("tcp", addr, c.Timeout.Duration)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+
+	case TypeHTTP:
+		client := &http.Client{Timeout: c.Timeout.Duration}
+
+		resp, err := client.Get("http://" + addr + c.Path)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != c.Status {
+			return fmt.Errorf("expected status %d, obtained %s", c.Status, resp.Status)
+		}
+
+		return nil
+
+	case TypeLog:
+		b, err := ioutil.ReadFile(serialLog)
+		if err != nil {
+			return err
+		}
+
+		if !regexp.MustCompile(c.Regex).Match(b) {
+			return fmt.Errorf("'%s' not found in serial log", c.Regex)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unsupported health check type '%s'", c.Type)
+}
+
+// State is a result of health monitoring, saved in a file per instance
+type State struct {
+	Status        string
+	FailingStreak int
+	LastCheck     time.Time
+	LastError     string `json:",omitempty"`
+}
+
+func LoadState(file string) (State, error) {
+	s := State{}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return s, err
+	}
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("error unmarshalling %s - %s", file, err)
+	}
+
+	return s, nil
+}
+
+// Save writes state atomically, so readers never get partial file
+func (s State) Save(file string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("error marshalling health state - %s", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".health")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file - %s", err)
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing file '%s' - %s", tmp.Name(), err)
+	}
+
+	tmp.Close()
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// Monitor probes instance every interval and saves state to file until
+// alive returns false. Instance is healthy after first successful probe
+// and unhealthy after Retries consecutive failures, failures of starting
+// instance within StartPeriod aren't counted.
+func Monitor(c *Check, ip, serialLog, stateFile string, alive func() bool) error {
+	s := State{Status: StatusStarting}
+	start := time.Now()
+
+	if err := s.Save(stateFile); err != nil {
+		return err
+	}
+
+	for alive() {
+		err := c.Probe(ip, serialLog)
+
+		s.LastCheck = time.Now()
+
+		if err == nil {
+			s.Status = StatusHealthy
+			s.FailingStreak = 0
+			s.LastError = ""
+		} else if s.Status == StatusStarting && time.Since(start) < c.StartPeriod.Duration {
+			s.LastError = err.Error()
+		} else {
+			s.FailingStreak++
+			s.LastError = err.Error()
+
+			if s.FailingStreak >= c.Retries {
+				s.Status = StatusUnhealthy
+			}
+		}
+
+		if err := s.Save(stateFile); err != nil {
+			return err
+		}
+
+		time.Sleep(c.Interval.Duration)
+	}
+
+	s.Status = StatusUnhealthy
+	s.LastError = "instance is not running"
+
+	return s.Save(stateFile)
+}
+
+// Wait blocks until state in file becomes healthy or unhealthy, instance
+// dies or timeout is exceeded, zero timeout means wait forever
+func Wait(stateFile string, timeout time.Duration, alive func() bool) (State, error) {
+	start := time.Now()
+
+	for {
+		if !alive() {
+			return State{}, fmt.Errorf("instance exited before becoming healthy")
+		}
+
+		s, err := LoadState(stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return s, err
+		}
+
+		switch s.Status {
+		case StatusHealthy:
+			return s, nil
+		case StatusUnhealthy:
+			return s, fmt.Errorf("instance is unhealthy - %s", s.LastError)
+		}
+
+		if timeout > 0 && time.Since(start) > timeout {
+			return s, fmt.Errorf("timeout waiting for instance to become healthy")
+		}
+
+		time.Sleep(200 * time.Millisecond)
+	}
+}
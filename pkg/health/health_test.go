@@ -0,0 +1,191 @@
+package health
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tt := []struct {
+		Spec     string
+		Expected string
+	}{
+		{"tcp:3000", "tcp:3000"},
+		{"http:8080", "http:8080/=200"},
+		{"http:8080/status", "http:8080/status=200"},
+		{"http:8080/status=204", "http:8080/status=204"},
+		{"http:8080/ready?full=1", "http:8080/ready?full=1=200"},
+		{"http:8080/ready?full=1=204", "http:8080/ready?full=1=204"},
+		{"log:listening on .*", "log:listening on .*"},
+	}
+
+	for _, tc := range tt {
+		c, err := Parse(tc.Spec)
+		if err != nil {
+			t.Errorf("Unexpected error for '%s' - %s\n", tc.Spec, err)
+			continue
+		}
+
+		c.SetDefaults()
+
+		if obtained := c.String(); obtained != tc.Expected {
+			t.Errorf("Expected '%s', obtained '%s'\n", tc.Expected, obtained)
+		}
+	}
+
+	for _, spec := range []string{"", "tcp", "tcp:", "tcp:abc", "tcp:70000", "http:abc/", "http:80=ok", "log:(", "udp:53"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Expecting error for '%s'\n", spec)
+		}
+	}
+}
+
+func TestManifestCheck(t *testing.T) {
+	c := Check{}
+
+	if err := json.Unmarshal([]byte(`{"Type":"http","Port":3000,"Interval":"1s","Retries":5}`), &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Interval.Duration != time.Second || c.Retries != 5 {
+		t.Fatalf("Unexpected check: %#v\n", c)
+	}
+
+	if err := json.Unmarshal([]byte(`{"Type":"http","Interval":5}`), &c); err == nil {
+		t.Fatal("Expecting error for numeric interval")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	serialLog := filepath.Join(dir, "serial.log")
+	if err := ioutil.WriteFile(serialLog, []byte("rumprun booted\napp listening on 3000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		Spec    string
+		Healthy bool
+	}{
+		{"tcp:" + port, true},
+		{"http:" + port + "/ok", true},
+		{"http:" + port + "/fail", false},
+		{"http:" + port + "/fail=503", true},
+		{"log:listening on [0-9]+", true},
+		{"log:panic", false},
+	}
+
+	for _, tc := range tt {
+		c, err := Parse(tc.Spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.SetDefaults()
+
+		if err := c.Probe(host, serialLog); (err == nil) != tc.Healthy {
+			t.Errorf("Expected healthy %v for '%s', obtained error %v\n", tc.Healthy, tc.Spec, err)
+		}
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	c := &Check{Type: TypeTCP, Port: port, Retries: 2}
+	c.SetDefaults()
+	c.Interval.Duration = time.Millisecond
+
+	stateFile := filepath.Join(dir, "health.json")
+	probes := 0
+
+	alive := func() bool {
+		probes++
+		return probes <= 3
+	}
+
+	if err := Monitor(c, "127.0.0.1", "", stateFile, alive); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := LoadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Status != StatusUnhealthy || s.FailingStreak != 3 {
+		t.Fatalf("Unexpected state: %#v\n", s)
+	}
+
+	if _, err := Wait(stateFile, time.Second, func() bool { return true }); err == nil {
+		t.Fatal("Expecting error waiting for unhealthy instance")
+	}
+
+	if err := (State{Status: StatusHealthy}).Save(stateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Wait(stateFile, time.Second, func() bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Wait(filepath.Join(dir, "missing"+strconv.Itoa(port)), time.Second, func() bool { return false }); err == nil {
+		t.Fatal("Expecting error waiting for dead instance")
+	}
+
+	// failures within start period keep instance starting
+	c.StartPeriod.Duration = time.Hour
+	probes = 0
+
+	alive = func() bool {
+		probes++
+		if probes > 3 {
+			return false
+		}
+
+		if s, err := LoadState(stateFile); err != nil || s.Status != StatusStarting || s.FailingStreak != 0 {
+			t.Fatalf("Expected starting state within start period, obtained %#v, %v\n", s, err)
+		}
+
+		return true
+	}
+
+	if err := Monitor(c, "127.0.0.1", "", stateFile, alive); err != nil {
+		t.Fatal(err)
+	}
+}
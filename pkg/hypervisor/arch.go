@@ -0,0 +1,137 @@
+package hypervisor
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+const (
+	ArchX86_64  = "x86_64"
+	ArchAarch64 = "aarch64"
+	ArchRiscv64 = "riscv64"
+)
+
+// Arch is guest architecture with qemu settings to run it. Guest console
+// is the default serial port of machine, -serial attaches it to serial log:
+// 16550 on pc and riscv64 virt, pl011 on aarch64 virt.
+type Arch struct {
+	Name     string
+	Binary   string   // qemu system binary
+	Machine  string   // machine type, default one if empty
+	Cpu      string   // cpu model used under emulation, default if empty
+	Firmware []string // images to boot disks with, the first found is used
+	SBI      bool     // firmware is a payload of opensbi bundled with qemu
+}
+
+var arches = map[string]Arch{
+	ArchX86_64: {
+		Name:   ArchX86_64,
+		Binary: "qemu-system-x86_64",
+	},
+	ArchAarch64: {
+		Name:    ArchAarch64,
+		Binary:  "qemu-system-aarch64",
+		Machine: "virt",
+		Cpu:     "cortex-a57",
+		Firmware: []string{
+			"/usr/share/qemu-efi-aarch64/QEMU_EFI.fd",
+			"/usr/share/AAVMF/AAVMF_CODE.fd",
+			"/usr/share/edk2/aarch64/QEMU_EFI.fd",
+			"/usr/share/qemu/edk2-aarch64-code.fd",
+			"/usr/local/share/qemu/edk2-aarch64-code.fd",
+			"/opt/homebrew/share/qemu/edk2-aarch64-code.fd",
+		},
+	},
+	ArchRiscv64: {
+		Name:    ArchRiscv64,
+		Binary:  "qemu-system-riscv64",
+		Machine: "virt",
+		SBI:     true,
+		Firmware: []string{
+			"/usr/lib/u-boot/qemu-riscv64_smode/uboot.elf",
+			"/usr/lib/u-boot/qemu-riscv64_smode/u-boot.bin",
+			"/usr/share/uboot/qemu-riscv64_smode/u-boot.bin",
+			"/usr/local/share/u-boot/qemu-riscv64_smode/u-boot.bin",
+		},
+	},
+}
+
+// names go uses for architectures
+var archAliases = map[string]string{
+	"amd64": ArchX86_64,
+	"arm64": ArchAarch64,
+}
+
+// GetArch returns architecture by name, empty name is the host one
+func GetArch(name string) (Arch, error) {
+	if name == "" {
+		name = HostArch()
+	}
+
+	if alias, ok := archAliases[name]; ok {
+		name = alias
+	}
+
+	a, ok := arches[name]
+	if !ok {
+		return Arch{}, fmt.Errorf("unsupported architecture '%s', supported are: %s", name, strings.Join(ArchNames(), ", "))
+	}
+
+	return a, nil
+}
+
+// ArchNames returns sorted names of supported architectures
+func ArchNames() []string {
+	result := []string{}
+
+	for name := range arches {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// HostArch returns architecture of host, as qemu names it
+func HostArch() string {
+	if name, ok := archAliases[runtime.GOARCH]; ok {
+		return name
+	}
+
+	return runtime.GOARCH
+}
+
+// Native checks if guests of architecture can run without emulation
+func (a Arch) Native() bool {
+	return a.Name == HostArch()
+}
+
+// FindFirmware returns the first existing firmware image, empty string if
+// there is none
+func (a Arch) FindFirmware() string {
+	for _, file := range a.Firmware {
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+
+	return ""
+}
+
+// nativeOnly fails for backends which can't emulate foreign guests
+func nativeOnly(name string, m Machine) error {
+	a, err := GetArch(m.Arch)
+	if err != nil {
+		return err
+	}
+
+	if !a.Native() {
+		return fmt.Errorf("%s can't run %s guests on %s host, use qemu", name, a.Name, HostArch())
+	}
+
+	return nil
+}
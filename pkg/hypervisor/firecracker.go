@@ -0,0 +1,250 @@
+package hypervisor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/runner"
+	"github.com/deferpanic/virgo/pkg/volume"
+)
+
+const firecrackerBinary = "firecracker"
+
+// time firecracker has to create its api socket
+var socketTimeout = 3 * time.Second
+
+// firecracker is configured via api socket once its process is started,
+// guest console goes to stdout of process
+type firecracker struct{}
+
+func (f firecracker) Name() string {
+	return Firecracker
+}
+
+// Firecracker supports raw drives only, overlays are copies of volumes
+func (f firecracker) DiskFormat() string {
+	return volume.FormatRaw
+}
+
+func (f firecracker) Args(r runner.Runner, m Machine) (string, []string, error) {
+	if m.Socket == "" {
+		return "", nil, fmt.Errorf("no api socket of firecracker given")
+	}
+
+	return firecrackerBinary, []string{"--api-sock", m.Socket}, nil
+}
+
+// firecrackerRequest is api call, which configures instance
+type firecrackerRequest struct {
+	path string
+	body interface{}
+}
+
+// requests returns api calls in order they are made, the last one boots
+// instance
+func (f firecracker) requests(m Machine) []firecrackerRequest {
+	memory := m.Memory
+	if memory == 0 {
+		memory = 128
+	}
+
+	cpus := m.Cpus
+	if cpus == 0 {
+		cpus = 1
+	}
+
+	result := []firecrackerRequest{
+		{"/machine-config", map[string]interface{}{
+			"vcpu_count":   cpus,
+			"mem_size_mib": memory,
+		}},
+		{"/boot-source", map[string]interface{}{
+			"kernel_image_path": m.Kernel,
+			"boot_args":         m.Config,
+		}},
+	}
+
+	for i, d := range m.Drives {
+		id := "drive" + strconv.Itoa(i)
+
+		result = append(result, firecrackerRequest{"/drives/" + id, map[string]interface{}{
+			"drive_id":       id,
+			"path_on_host":   d.File,
+			"is_root_device": false,
+			"is_read_only":   d.ReadOnly,
+		}})
+	}
+
+	result = append(result,
+		firecrackerRequest{"/network-interfaces/" + m.Net.Id, map[string]interface{}{
+			"iface_id":      m.Net.Id,
+			"guest_mac":     m.Net.Mac,
+			"host_dev_name": m.Net.Iface,
+		}},
+		firecrackerRequest{"/actions", map[string]interface{}{
+			"action_type": "InstanceStart",
+		}},
+	)
+
+	return result
+}
+
+func (f firecracker) Start(r runner.Runner, m Machine) error {
+	if err := nativeOnly(Firecracker, m); err != nil {
+		return err
+	}
+
+	if err := rawDrives(Firecracker, m); err != nil {
+		return err
+	}
+
+	if err := needKvm(Firecracker, r); err != nil {
+		return err
+	}
+
+	cmd, args, err := f.Args(r, m)
+	if err != nil {
+		return err
+	}
+
+	if err := createTap(r, m.Net); err != nil {
+		return err
+	}
+
+	// socket left by instance which wasn't stopped
+	os.Remove(m.Socket)
+
+	if err := exec(r, m, cmd, args...); err != nil {
+		deleteTap(r, m.Net)
+		return err
+	}
+
+	proc, ok := r.(*runner.ExecRunner)
+	if !ok {
+		for _, req := range f.requests(m) {
+			b, _ := json.Marshal(req.body)
+			fmt.Printf("\nPUT %s %s", req.path, b)
+		}
+
+		return nil
+	}
+
+	client := firecrackerClient(m.Socket)
+
+	for _, req := range f.requests(m) {
+		if err := firecrackerCall(client, http.MethodPut, req.path, req.body, nil); err != nil {
+			f.Stop(proc, m)
+			return fmt.Errorf("error configuring %s - %s", m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (f firecracker) Stop(proc *runner.ExecRunner, m Machine) error {
+	if err := stop(proc); err != nil {
+		return err
+	}
+
+	os.Remove(m.Socket)
+
+	return deleteTap(proc, m.Net)
+}
+
+// Status asks firecracker for state of instance, instance which doesn't
+// answer is stopped
+func (f firecracker) Status(proc *runner.ExecRunner, m Machine) string {
+	if pidStatus(proc) == StatusStopped {
+		return StatusStopped
+	}
+
+	info := struct {
+		State string `json:"state"`
+	}{}
+
+	if err := firecrackerCall(firecrackerClient(m.Socket), http.MethodGet, "/", nil, &info); err != nil {
+		return StatusStopped
+	}
+
+	switch info.State {
+	case "Running":
+		return StatusRunning
+	case "Paused":
+		return StatusPaused
+	}
+
+	return StatusStopped
+}
+
+// firecrackerClient returns http client of api socket, it waits for
+// socket to be created by starting process
+func firecrackerClient(socket string) *http.Client {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			conn, err := d.DialContext(ctx, "unix", socket)
+			if err == nil || time.Since(start) > socketTimeout {
+				return conn, err
+			}
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{DialContext: dial},
+		Timeout:   socketTimeout + 5*time.Second,
+	}
+}
+
+func firecrackerCall(client *http.Client, method, path string, body, result interface{}) error {
+	var rd *bytes.Reader
+
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		rd = bytes.NewReader(b)
+	} else {
+		rd = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, "http://localhost"+path, rd)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s - %s %s", method, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	if result != nil {
+		return json.Unmarshal(b, result)
+	}
+
+	return nil
+}
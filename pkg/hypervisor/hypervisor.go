@@ -0,0 +1,237 @@
+// Package hypervisor starts instances of unikernels. QEMU is the default
+// backend, Firecracker and solo5 boot lightweight unikernels much faster,
+// but support less devices.
+package hypervisor
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/depcheck"
+	"github.com/deferpanic/virgo/pkg/network"
+	"github.com/deferpanic/virgo/pkg/runner"
+	"github.com/deferpanic/virgo/pkg/tools"
+	"github.com/deferpanic/virgo/pkg/volume"
+)
+
+const (
+	Qemu        = "qemu"
+	Firecracker = "firecracker"
+	Hvt         = "solo5-hvt"
+	Spt         = "solo5-spt"
+
+	StatusRunning = "running"
+	StatusPaused  = "paused"
+	StatusStopped = "stopped"
+)
+
+// Machine describes instance the same way for every backend, backends
+// use parts they support
+type Machine struct {
+	Name      string // instance name, e.g. hello-1
+	Arch      string // guest architecture, host one if empty
+	Kernel    string
+	Multiboot bool
+	Config    string   // rumprun config, it's passed as kernel command line
+	Cmdline   string   // command line of manifest
+	Env       []string // env of guest, rumprun gets it in Config
+	Memory    int
+	Cpus      int
+	Drives    []volume.Attached
+	Net       Net
+	SerialLog string
+	Headless  bool
+	Socket    string // api socket of firecracker
+
+	// qemu settings, binary and firmware of architecture are used if
+	// they're empty
+	Binary       string
+	Accel        string
+	Vga          string
+	Firmware     string
+	Capabilities string // cache of probed qemu capabilities
+}
+
+// Net is network interface of instance, tap interfaces are configured by
+// ifup and ifdown scripts of project
+type Net struct {
+	Mode   string
+	Id     string // e.g. vmnet1
+	Iface  string // e.g. tap1
+	Mac    string
+	Ip     string // guest address
+	Gw     string // host side address of tap interface
+	IfUp   string
+	IfDown string
+}
+
+type Hypervisor interface {
+	Name() string
+
+	// Args returns command instance is started with
+	Args(r runner.Runner, m Machine) (string, []string, error)
+
+	// Start runs instance detached, r is *runner.ExecRunner with pid of
+	// instance once it's started
+	Start(r runner.Runner, m Machine) error
+
+	// Stop stops instance and releases resources it holds
+	Stop(proc *runner.ExecRunner, m Machine) error
+
+	// Status returns one of running, paused or stopped
+	Status(proc *runner.ExecRunner, m Machine) string
+
+	// DiskFormat is format of manifest volume overlays
+	DiskFormat() string
+}
+
+var hypervisors = map[string]Hypervisor{
+	Qemu:        qemu{},
+	Firecracker: firecracker{},
+	Hvt:         solo5{tender: Hvt},
+	Spt:         solo5{tender: Spt},
+}
+
+// HasEnv is false for hypervisors which guests get no env, solo5
+// unikernels are given command line only
+func HasEnv(name string) bool {
+	return name != Hvt && name != Spt
+}
+
+// Get returns hypervisor by name, empty name is qemu, which runtime saved
+// by older versions has
+func Get(name string) (Hypervisor, error) {
+	if name == "" {
+		name = Qemu
+	}
+
+	hv, ok := hypervisors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hypervisor '%s', available are: %s", name, strings.Join(Names(), ", "))
+	}
+
+	return hv, nil
+}
+
+// Names returns sorted names of hypervisors
+func Names() []string {
+	result := []string{}
+
+	for name := range hypervisors {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// how long stopped instance has to exit before it's given up
+const stopTimeout = 30 * time.Second
+
+// stop stops instance and waits until it exits, so resources it holds,
+// such as tap interface, can be released. Instance which is already gone
+// isn't an error.
+func stop(proc *runner.ExecRunner) error {
+	err := proc.Stop()
+
+	for start := time.Now(); runner.IsPidAlive(proc.Pid); time.Sleep(100 * time.Millisecond) {
+		if time.Since(start) > stopTimeout {
+			if err != nil {
+				return fmt.Errorf("error stopping process %d - %s", proc.Pid, err)
+			}
+
+			return fmt.Errorf("process %d is still running %s after it was stopped", proc.Pid, stopTimeout)
+		}
+	}
+
+	return nil
+}
+
+// pidStatus is status of backends without own api
+func pidStatus(proc *runner.ExecRunner) string {
+	if proc != nil && runner.IsPidAlive(proc.Pid) {
+		return StatusRunning
+	}
+
+	return StatusStopped
+}
+
+// exec starts instance with console redirected to serial log, it's how
+// backends without serial device option log guest output
+func exec(r runner.Runner, m Machine, cmd string, args ...string) error {
+	r.SetDetached(true)
+
+	if proc, ok := r.(*runner.ExecRunner); ok {
+		wr, err := os.OpenFile(m.SerialLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening file '%s' - %s", m.SerialLog, err)
+		}
+		defer wr.Close()
+
+		proc.SetOutput(wr, wr)
+	}
+
+	if err := r.Exec(cmd, args...); err != nil {
+		return fmt.Errorf("error running '%s %s' - %s", cmd, tools.Join(args, " "), err)
+	}
+
+	return nil
+}
+
+// needKvm fails if backend, which can't run without kvm, can't use it
+func needKvm(name string, r runner.Runner) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+
+	if kvm := depcheck.New(r).Kvm(); !kvm.Usable {
+		return fmt.Errorf("%s needs kvm, which isn't usable - %s, run 'virgo doctor' for details", name, kvm.Reason)
+	}
+
+	return nil
+}
+
+// rawDrives fails if any drive isn't raw image
+func rawDrives(name string, m Machine) error {
+	for _, d := range m.Drives {
+		if d.Format != volume.FormatRaw {
+			return fmt.Errorf("%s supports raw volumes only, %s is %s", name, d.File, d.Format)
+		}
+	}
+
+	return nil
+}
+
+// createTap makes persistent tap interface owned by user and configures
+// it, it's done by privileged helper
+func createTap(r runner.Runner, n Net) error {
+	if n.Mode != "" && n.Mode != network.ModeTap {
+		return fmt.Errorf("%s network isn't supported, only tap one is", n.Mode)
+	}
+
+	if err := network.RunHelper(r, network.OpTapCreate, n.Iface); err != nil {
+		return err
+	}
+
+	if out, err := r.Shell(n.IfUp + " " + n.Iface); err != nil {
+		deleteTap(r, n)
+		return fmt.Errorf("error configuring %s - %s\n%s", n.Iface, err, out)
+	}
+
+	return nil
+}
+
+// deleteTap removes tap interface with its address, nat of its subnet is
+// removed as well
+func deleteTap(r runner.Runner, n Net) error {
+	if n.Gw != "" {
+		network.RunHelper(r, network.OpNatDel, n.Iface, network.Subnet(n.Gw))
+	}
+
+	return network.RunHelper(r, network.OpTapDelete, n.Iface)
+}
@@ -0,0 +1,351 @@
+package hypervisor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/deferpanic/virgo/pkg/config"
+	"github.com/deferpanic/virgo/pkg/depcheck"
+	"github.com/deferpanic/virgo/pkg/network"
+	"github.com/deferpanic/virgo/pkg/runner"
+	"github.com/deferpanic/virgo/pkg/volume"
+)
+
+func sampleMachine() Machine {
+	return Machine{
+		Name:      "hello-2",
+		Kernel:    "/tmp/hello",
+		Config:    `{"cmdline": "hello"}`,
+		Cmdline:   "hello --port=80",
+		Memory:    64,
+		SerialLog: "/tmp/serial-2.log",
+		Accel:     config.AccelTcg,
+		Net: Net{
+			Mode:   network.ModeTap,
+			Id:     "vmnet2",
+			Iface:  "tap2",
+			Mac:    "52:54:00:00:00:01",
+			IfUp:   "/tmp/ifup.sh",
+			IfDown: "/tmp/ifdown.sh",
+		},
+		Drives: []volume.Attached{
+			{File: "/tmp/vol1.qcow2", Format: volume.FormatQcow2},
+			{File: "/tmp/conf.iso", Format: volume.FormatRaw, ReadOnly: true},
+		},
+	}
+}
+
+func TestGet(t *testing.T) {
+	for _, name := range append(Names(), "") {
+		if _, err := Get(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Get("xen"); err == nil {
+		t.Fatalf("Expected error for unknown hypervisor\n")
+	}
+}
+
+func TestQemuArgs(t *testing.T) {
+	m := sampleMachine()
+	m.Arch = ArchX86_64
+	m.Headless = true
+
+	cmd, args, err := qemu{}.Args(runner.NewDryRunner(ioutil.Discard), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd != "qemu-system-x86_64" {
+		t.Fatalf("Expected qemu-system-x86_64, obtained %s\n", cmd)
+	}
+
+	expected := "-accel tcg -nographic -serial file:/tmp/serial-2.log -vga none -m 64 " +
+		"-netdev tap,id=vmnet2,ifname=tap2,script=/tmp/ifup.sh,downscript=/tmp/ifdown.sh " +
+		"-device virtio-net-pci,netdev=vmnet2,mac=52:54:00:00:00:01 " +
+		"-drive if=virtio,file=/tmp/vol1.qcow2,format=qcow2 " +
+		"-drive if=virtio,file=/tmp/conf.iso,format=raw,readonly=on " +
+		"-drive file=/tmp/hello,index=0,media=disk,format=raw,snapshot=on"
+
+	if obtained := strings.Join(args, " "); obtained != expected {
+		t.Fatalf("Expected '%s', obtained '%s'\n", expected, obtained)
+	}
+}
+
+func TestQemuForeignArch(t *testing.T) {
+	foreign := ArchAarch64
+	if HostArch() == ArchAarch64 {
+		foreign = ArchRiscv64
+	}
+
+	a, err := GetArch(foreign)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := sampleMachine()
+	m.Arch = foreign
+	m.Accel = config.AccelAuto
+	m.Multiboot = true
+
+	cmd, args, err := qemu{}.Args(runner.NewDryRunner(ioutil.Discard), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obtained := strings.Join(args, " ")
+
+	if cmd != a.Binary || !strings.HasPrefix(obtained, "-accel tcg -machine virt ") || strings.Contains(obtained, "-vga") {
+		t.Fatalf("Expected emulated %s guest, obtained '%s %s'\n", foreign, cmd, obtained)
+	}
+
+	if !strings.HasSuffix(obtained, "-kernel /tmp/hello -append "+m.Config) {
+		t.Fatalf("Expected kernel boot, obtained '%s'\n", obtained)
+	}
+
+	// disk images are booted by firmware
+	m.Multiboot = false
+	m.Firmware = "/tmp/firmware.fd"
+
+	if _, args, err = (qemu{}).Args(runner.NewDryRunner(ioutil.Discard), m); err != nil {
+		t.Fatal(err)
+	}
+
+	boot := "-bios /tmp/firmware.fd -drive"
+	if a.SBI {
+		boot = "-bios default -kernel /tmp/firmware.fd -drive"
+	}
+
+	if obtained := strings.Join(args, " "); !strings.Contains(obtained, boot+" if=none,id=boot,format=raw,snapshot=on,file=/tmp/hello") {
+		t.Fatalf("Expected firmware boot, obtained '%s'\n", obtained)
+	}
+
+	// riscv64 u-boot is loaded by opensbi of qemu
+	if riscv, _ := GetArch(ArchRiscv64); !riscv.SBI || len(riscv.Firmware) == 0 {
+		t.Fatalf("Expected riscv64 firmware to be found, obtained %+v\n", riscv)
+	}
+
+	m.Accel = config.AccelKvm
+
+	if _, _, err := (qemu{}).Args(runner.NewDryRunner(ioutil.Discard), m); err == nil {
+		t.Fatalf("Expected error of kvm for foreign guest\n")
+	}
+
+	if _, err := GetArch("arm64"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetArch("mips"); err == nil {
+		t.Fatalf("Expected error of unsupported architecture\n")
+	}
+}
+
+func TestQemuSupported(t *testing.T) {
+	m := sampleMachine()
+	m.Arch = ArchX86_64
+	m.Accel = config.AccelHax
+
+	_, args, err := qemu{}.Args(runner.NewDryRunner(ioutil.Discard), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caps := depcheck.Qemu{
+		Binary:   "/usr/bin/qemu-system-x86_64",
+		Version:  "2.8.1",
+		Machines: []string{"pc", "q35"},
+		Devices:  []string{"virtio-net-pci", "virtio-blk-pci"},
+	}
+
+	if err := (qemu{}).supported(caps, args); err == nil || !strings.Contains(err.Error(), "hax accelerator, 2.9.0 or newer") {
+		t.Fatalf("Expected hax error, obtained %v\n", err)
+	}
+
+	m.Accel = config.AccelTcg
+	m.Arch = ArchAarch64
+	m.Multiboot = true
+
+	if _, args, err = (qemu{}).Args(runner.NewDryRunner(ioutil.Discard), m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (qemu{}).supported(caps, args); err == nil || !strings.Contains(err.Error(), "virt machine") {
+		t.Fatalf("Expected machine error, obtained %v\n", err)
+	}
+
+	caps.Machines = append(caps.Machines, "virt")
+	caps.Devices = caps.Devices[:1]
+
+	if err := (qemu{}).supported(caps, args); err == nil || !strings.Contains(err.Error(), "virtio-blk-pci device") {
+		t.Fatalf("Expected device error, obtained %v\n", err)
+	}
+
+	caps.Devices = append(caps.Devices, "virtio-blk-pci")
+
+	if err := (qemu{}).supported(caps, args); err != nil {
+		t.Fatal(err)
+	}
+
+	caps.Version = "2.5.0"
+
+	if err := (qemu{}).supported(caps, args); err == nil || !strings.Contains(err.Error(), "too old") {
+		t.Fatalf("Expected version error, obtained %v\n", err)
+	}
+
+	// nothing is known in dry run
+	if err := (qemu{}).supported(depcheck.Qemu{}, args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSolo5Args(t *testing.T) {
+	m := sampleMachine()
+
+	cmd, args, err := solo5{tender: Hvt}.Args(runner.NewDryRunner(ioutil.Discard), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "--mem=64 --net:service=tap2 --net-mac:service=52:54:00:00:00:01 " +
+		"--block:storage=/tmp/vol1.qcow2 --block:storage1=/tmp/conf.iso -- /tmp/hello hello --port=80"
+
+	if obtained := strings.Join(args, " "); cmd != Hvt || obtained != expected {
+		t.Fatalf("Expected '%s %s', obtained '%s %s'\n", Hvt, expected, cmd, obtained)
+	}
+
+	// address goes to unikernel, env can't
+	m.Net.Ip, m.Net.Gw = "10.1.2.2", "10.1.2.1"
+
+	if _, args, err = (solo5{tender: Hvt}).Args(runner.NewDryRunner(ioutil.Discard), m); err != nil || !strings.Contains(strings.Join(args, " "), "/tmp/hello --ipv4=10.1.2.2/24 --ipv4-gateway=10.1.2.1 hello") {
+		t.Fatalf("Expected address of instance, obtained %v, %v\n", args, err)
+	}
+
+	m.Env = []string{"CACHE_HOST=10.1.3.2"}
+
+	if _, _, err := (solo5{tender: Hvt}).Args(runner.NewDryRunner(ioutil.Discard), m); err == nil {
+		t.Fatalf("Expected env error\n")
+	}
+
+	m.Env = nil
+
+	// qcow2 overlays are refused before anything is started
+	if err := (solo5{tender: Hvt}).Start(runner.NewDryRunner(ioutil.Discard), m); err == nil || !strings.Contains(err.Error(), "raw") {
+		t.Fatalf("Expected raw volumes error, obtained %v\n", err)
+	}
+
+	m.Cpus = 2
+
+	if _, _, err := (solo5{tender: Spt}).Args(runner.NewDryRunner(ioutil.Discard), m); err == nil {
+		t.Fatalf("Expected single cpu error\n")
+	}
+}
+
+func TestFirecrackerApi(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-hypervisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := sampleMachine()
+	m.Socket = filepath.Join(dir, "api.sock")
+
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/" {
+			w.Write([]byte(`{"id":"anonymous-instance","state":"Running"}`))
+			return
+		}
+
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, `{"fault_message":"bad body"}`, http.StatusBadRequest)
+			return
+		}
+
+		if r.URL.Path == "/boot-source" && body["kernel_image_path"] == "" {
+			http.Error(w, `{"fault_message":"no kernel"}`, http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	l, err := net.Listen("unix", m.Socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go http.Serve(l, mux)
+	defer l.Close()
+
+	client := firecrackerClient(m.Socket)
+
+	for _, req := range (firecracker{}).requests(m) {
+		if err := firecrackerCall(client, http.MethodPut, req.path, req.body, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := "PUT /machine-config, PUT /boot-source, PUT /drives/drive0, PUT /drives/drive1, PUT /network-interfaces/vmnet2, PUT /actions"
+
+	if obtained := strings.Join(requests, ", "); obtained != expected {
+		t.Fatalf("Expected '%s', obtained '%s'\n", expected, obtained)
+	}
+
+	m.Kernel = ""
+
+	if err := firecrackerCall(client, http.MethodPut, "/boot-source", (firecracker{}).requests(m)[1].body, nil); err == nil || !strings.Contains(err.Error(), "no kernel") {
+		t.Fatalf("Expected api error, obtained %v\n", err)
+	}
+
+	proc := &runner.ExecRunner{Pid: os.Getpid()}
+
+	if status := (firecracker{}).Status(proc, m); status != StatusRunning {
+		t.Fatalf("Expected %s, obtained %s\n", StatusRunning, status)
+	}
+
+	l.Close()
+
+	if status := (firecracker{}).Status(&runner.ExecRunner{}, m); status != StatusStopped {
+		t.Fatalf("Expected %s, obtained %s\n", StatusStopped, status)
+	}
+}
+
+func TestStopWaits(t *testing.T) {
+	proc := runner.NewExecRunner(os.Stdout, os.Stderr, true)
+
+	// process exits a bit later than it's signalled, as qemu running its
+	// downscript does
+	if err := proc.Exec("sh", "-c", "trap 'sleep 0.5; exit 0' TERM; while true; do sleep 0.1; done"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := sampleMachine()
+	m.Net.Mode = network.ModeUser
+
+	if err := (qemu{}).Stop(proc, m); err != nil {
+		t.Fatal(err)
+	}
+
+	if runner.IsPidAlive(proc.Pid) {
+		t.Fatalf("Expected process %d to exit before Stop returns\n", proc.Pid)
+	}
+}
@@ -0,0 +1,288 @@
+package hypervisor
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/deferpanic/virgo/pkg/config"
+	"github.com/deferpanic/virgo/pkg/depcheck"
+	"github.com/deferpanic/virgo/pkg/network"
+	"github.com/deferpanic/virgo/pkg/runner"
+	"github.com/deferpanic/virgo/pkg/tools"
+	"github.com/deferpanic/virgo/pkg/volume"
+)
+
+type qemu struct{}
+
+func (q qemu) Name() string {
+	return Qemu
+}
+
+func (q qemu) DiskFormat() string {
+	return volume.FormatQcow2
+}
+
+func (q qemu) Args(r runner.Runner, m Machine) (string, []string, error) {
+	var (
+		bootLine  []string
+		accel     []string
+		nographic string
+	)
+
+	arch, err := GetArch(m.Arch)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// kernel image is hard linked to cache and other tags, guest writes
+	// go to temporary snapshot
+	switch {
+	case m.Multiboot:
+		bootLine = []string{"-kernel", m.Kernel, "-append", m.Config}
+	case arch.Name == ArchX86_64:
+		bootLine = []string{"-drive", "file=" + m.Kernel + ",index=0,media=disk,format=raw,snapshot=on"}
+	default:
+		// virt machines have no ide, disk is booted by firmware from
+		// virtio device
+		firmware := m.Firmware
+		if firmware == "" {
+			firmware = arch.FindFirmware()
+		}
+
+		if firmware == "" {
+			return "", nil, fmt.Errorf("no firmware found to boot %s disk image, set it via qemu.firmware setting", arch.Name)
+		}
+
+		bootLine = []string{"-bios", firmware}
+
+		// riscv64 u-boot runs in supervisor mode on top of opensbi
+		if arch.SBI {
+			bootLine = []string{"-bios", "default", "-kernel", firmware}
+		}
+
+		bootLine = append(bootLine,
+			"-drive", "if=none,id=boot,format=raw,snapshot=on,file="+m.Kernel,
+			"-device", "virtio-blk-pci,drive=boot,bootindex=0",
+		)
+	}
+
+	switch {
+	case !arch.Native():
+		// foreign guests are emulated
+		if m.Accel != "" && m.Accel != config.AccelAuto && m.Accel != config.AccelTcg {
+			return "", nil, fmt.Errorf("%s guests can't use %s accelerator on %s host, only tcg", arch.Name, m.Accel, HostArch())
+		}
+
+		accel = []string{"-accel", "tcg"}
+	case m.Accel == config.AccelKvm:
+		if kvm := depcheck.New(r).Kvm(); !kvm.Usable {
+			return "", nil, fmt.Errorf("kvm isn't usable - %s, run 'virgo doctor' for details or use --accel=tcg", kvm.Reason)
+		}
+
+		accel = []string{"-enable-kvm"}
+	case m.Accel == config.AccelHax:
+		accel = []string{"-accel", "hax"}
+	case m.Accel == config.AccelTcg:
+		accel = []string{"-accel", "tcg"}
+	case runtime.GOOS == "linux":
+		kvm := depcheck.New(r).Kvm()
+		if kvm.Usable {
+			accel = []string{"-enable-kvm"}
+			break
+		}
+
+		log.Printf("Warning: kvm isn't usable - %s, falling back to slow tcg emulation, run 'virgo doctor' for details\n", kvm.Reason)
+
+		accel = []string{"-accel", "tcg"}
+	case runtime.GOOS == "darwin":
+		dep := depcheck.New(r)
+
+		if err := dep.RunAll(); err != nil {
+			return "", nil, err
+		}
+
+		if dep.HasHAX() {
+			accel = []string{"-accel", "hax"}
+		}
+	default:
+		accel = []string{"-accel", "tcg"}
+	}
+
+	if m.Headless {
+		nographic = "-nographic"
+	}
+
+	netdev := "tap,id=" + m.Net.Id + ",ifname=" + m.Net.Iface + ",script=" + m.Net.IfUp + ",downscript=" + m.Net.IfDown
+	if m.Net.Mode == network.ModeUser {
+		netdev = "user,id=" + m.Net.Id
+	}
+
+	cmd := m.Binary
+	if cmd == "" {
+		cmd = arch.Binary
+	}
+
+	args := accel
+
+	if arch.Machine != "" {
+		args = append(args, "-machine", arch.Machine)
+	}
+
+	if arch.Cpu != "" {
+		cpu := arch.Cpu
+		if len(accel) > 0 && accel[0] == "-enable-kvm" {
+			cpu = "host"
+		}
+
+		args = append(args, "-cpu", cpu)
+	}
+
+	args = append(args, nographic, "-serial", "file:"+m.SerialLog)
+
+	// vga is x86 only, virt machines have no display by default
+	if arch.Name == ArchX86_64 {
+		vga := m.Vga
+		if vga == "" {
+			vga = config.DefaultVga
+		}
+
+		args = append(args, "-vga", vga)
+	}
+
+	args = append(args,
+		"-m", strconv.Itoa(m.Memory),
+		"-netdev", netdev,
+		"-device", "virtio-net-pci,netdev="+m.Net.Id+",mac="+m.Net.Mac,
+	)
+	if m.Cpus > 0 {
+		args = append(args, "-smp", strconv.Itoa(m.Cpus))
+	}
+
+	for _, d := range m.Drives {
+		drive := "if=virtio,file=" + d.File + ",format=" + d.Format
+		if d.ReadOnly {
+			drive += ",readonly=on"
+		}
+
+		args = append(args, "-drive", drive)
+	}
+
+	args = append(args, bootLine...)
+
+	return cmd, args, nil
+}
+
+// Start runs qemu, it writes serial log and creates tap interface itself
+func (q qemu) Start(r runner.Runner, m Machine) error {
+	cmd, args, err := q.Args(r, m)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := r.(*runner.ExecRunner); ok {
+		dep := depcheck.New(r)
+
+		if err := dep.Preflight(cmd, m.Net.Mode != network.ModeUser); err != nil {
+			return err
+		}
+
+		caps, err := dep.ProbeQemu(cmd, m.Capabilities)
+		if err != nil {
+			return err
+		}
+
+		if err := q.supported(caps, args); err != nil {
+			return err
+		}
+	}
+
+	// qemu opens tap interface created for user, it's configured by ifup
+	// script of project
+	if m.Net.Mode != network.ModeUser {
+		if err := network.RunHelper(r, network.OpTapCreate, m.Net.Iface); err != nil {
+			return err
+		}
+	}
+
+	r.SetDetached(true)
+
+	if err := r.Exec(cmd, args...); err != nil {
+		q.deleteTap(r, m)
+		return fmt.Errorf("error running '%s %s' - %s", cmd, tools.Join(args, " "), err)
+	}
+
+	return nil
+}
+
+// deleteTap removes tap interface, qemu runs ifdown script itself
+func (q qemu) deleteTap(r runner.Runner, m Machine) error {
+	if m.Net.Mode == network.ModeUser {
+		return nil
+	}
+
+	return network.RunHelper(r, network.OpTapDelete, m.Net.Iface)
+}
+
+// supported rejects options which qemu binary doesn't support, so it
+// fails before boot instead of exiting with unclear error
+func (q qemu) supported(caps depcheck.Qemu, args []string) error {
+	if !caps.Known() {
+		return nil
+	}
+
+	if err := caps.Supported(); err != nil {
+		return err
+	}
+
+	devices := []string{}
+
+	for i := 0; i < len(args)-1; i++ {
+		value := strings.Split(args[i+1], ",")[0]
+
+		switch args[i] {
+		case "-accel":
+			if caps.Version != "" && !caps.HasAccel(value) {
+				return fmt.Errorf("%s %s doesn't support %s accelerator, %s or newer is needed, use --accel=tcg or upgrade qemu", caps.Binary, caps.Version, value, depcheck.AccelSince(value))
+			}
+		case "-machine":
+			if len(caps.Machines) > 0 && !caps.HasMachine(value) {
+				return fmt.Errorf("%s doesn't support %s machine, run '%s -machine help' to list supported ones", caps.Binary, value, caps.Binary)
+			}
+		case "-device":
+			devices = append(devices, value)
+		case "-drive":
+			if strings.HasPrefix(args[i+1], "if=virtio,") {
+				devices = append(devices, "virtio-blk-pci")
+			}
+		}
+	}
+
+	if len(caps.Devices) == 0 {
+		return nil
+	}
+
+	for _, device := range devices {
+		if !caps.HasDevice(device) {
+			return fmt.Errorf("%s doesn't support %s device, run '%s -device help' to list supported ones", caps.Binary, device, caps.Binary)
+		}
+	}
+
+	return nil
+}
+
+// Stop waits for qemu to exit, it runs ifdown script and closes tap
+// interface, before tap interface is removed
+func (q qemu) Stop(proc *runner.ExecRunner, m Machine) error {
+	if err := stop(proc); err != nil {
+		return err
+	}
+
+	return q.deleteTap(proc, m)
+}
+
+func (q qemu) Status(proc *runner.ExecRunner, m Machine) string {
+	return pidStatus(proc)
+}
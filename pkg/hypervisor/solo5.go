@@ -0,0 +1,112 @@
+package hypervisor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/deferpanic/virgo/pkg/runner"
+	"github.com/deferpanic/virgo/pkg/volume"
+)
+
+// solo5 runs unikernels built for solo5 tenders, hvt one uses hardware
+// virtualization and spt one runs them as sandboxed host processes.
+// Devices are named the way unikernel manifest declares them, network is
+// service and drives are storage, storage1, storage2 etc. Address of
+// instance is passed as MirageOS boot parameters, unikernels have no env.
+type solo5 struct {
+	tender string
+}
+
+func (s solo5) Name() string {
+	return s.tender
+}
+
+func (s solo5) DiskFormat() string {
+	return volume.FormatRaw
+}
+
+func (s solo5) Args(r runner.Runner, m Machine) (string, []string, error) {
+	if m.Cpus > 1 {
+		return "", nil, fmt.Errorf("%s supports single cpu only", s.tender)
+	}
+
+	if len(m.Env) > 0 {
+		return "", nil, fmt.Errorf("%s unikernels have no env, unable to pass %s", s.tender, strings.Join(m.Env, " "))
+	}
+
+	args := []string{}
+
+	if m.Memory > 0 {
+		args = append(args, "--mem="+strconv.Itoa(m.Memory))
+	}
+
+	args = append(args,
+		"--net:service="+m.Net.Iface,
+		"--net-mac:service="+m.Net.Mac,
+	)
+
+	for i, d := range m.Drives {
+		name := "storage"
+		if i > 0 {
+			name += strconv.Itoa(i)
+		}
+
+		args = append(args, "--block:"+name+"="+d.File)
+	}
+
+	args = append(args, "--", m.Kernel)
+
+	if m.Net.Ip != "" {
+		args = append(args, "--ipv4="+m.Net.Ip+"/24", "--ipv4-gateway="+m.Net.Gw)
+	}
+
+	args = append(args, strings.Fields(m.Cmdline)...)
+
+	return s.tender, args, nil
+}
+
+func (s solo5) Start(r runner.Runner, m Machine) error {
+	if err := nativeOnly(s.tender, m); err != nil {
+		return err
+	}
+
+	if err := rawDrives(s.tender, m); err != nil {
+		return err
+	}
+
+	// spt runs unikernel as sandboxed process, only hvt one is virtualized
+	if s.tender == Hvt {
+		if err := needKvm(s.tender, r); err != nil {
+			return err
+		}
+	}
+
+	cmd, args, err := s.Args(r, m)
+	if err != nil {
+		return err
+	}
+
+	if err := createTap(r, m.Net); err != nil {
+		return err
+	}
+
+	if err := exec(r, m, cmd, args...); err != nil {
+		deleteTap(r, m.Net)
+		return err
+	}
+
+	return nil
+}
+
+func (s solo5) Stop(proc *runner.ExecRunner, m Machine) error {
+	if err := stop(proc); err != nil {
+		return err
+	}
+
+	return deleteTap(proc, m.Net)
+}
+
+func (s solo5) Status(proc *runner.ExecRunner, m Machine) string {
+	return pidStatus(proc)
+}
@@ -0,0 +1,618 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 2048
+
+	// system area is followed by primary, joliet and terminator descriptors
+	firstDescriptor = 16
+	pathTableSector = firstDescriptor + 3
+
+	maxNameLen       = 30 // level 2, including ";1"
+	maxJolietNameLen = 64 // in UCS-2 characters
+
+	flagDirectory = 2
+)
+
+type node struct {
+	name     string // primary name, d-characters only
+	jname    string // joliet name, close to original one
+	path     string
+	dir      bool
+	size     int64
+	mtime    time.Time
+	parent   *node
+	children []*node
+
+	extent  uint32 // primary directory or file data
+	jextent uint32 // joliet directory, files share data with primary tree
+	dsize   uint32 // primary directory size
+	jdsize  uint32
+	number  uint16 // position in path table
+}
+
+// Build writes ISO9660 image of dir to file. Names are kept in Joliet
+// tree, primary tree has them converted to upper case d-characters.
+func Build(dir, file string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", dir)
+	}
+
+	root := &node{dir: true, path: dir, mtime: info.ModTime()}
+
+	if err := scan(root); err != nil {
+		return err
+	}
+
+	dirs := levels(root)
+
+	for i, d := range dirs {
+		d.number = uint16(i + 1)
+		d.dsize = dirSize(d, false)
+		d.jdsize = dirSize(d, true)
+	}
+
+	ptSize := pathTableSize(dirs, false)
+	jptSize := pathTableSize(dirs, true)
+
+	// L and M path tables of both trees
+	next := uint32(pathTableSector)
+	ptL := next
+	next += sectors(ptSize)
+	ptM := next
+	next += sectors(ptSize)
+	jptL := next
+	next += sectors(jptSize)
+	jptM := next
+	next += sectors(jptSize)
+
+	for _, d := range dirs {
+		d.extent = next
+		next += sectors(d.dsize)
+	}
+
+	for _, d := range dirs {
+		d.jextent = next
+		next += sectors(d.jdsize)
+	}
+
+	for _, d := range dirs {
+		for _, c := range d.children {
+			if c.dir || c.size == 0 {
+				continue
+			}
+
+			c.extent = next
+			next += sectors(uint32(c.size))
+		}
+	}
+
+	wr, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := &writer{w: wr}
+	now := time.Now()
+	volume := volumeID(filepath.Base(dir))
+
+	w.pad(firstDescriptor * sectorSize)
+	w.write(descriptor(1, volume, next, ptSize, ptL, ptM, root, false, now))
+	w.write(descriptor(2, volume, next, jptSize, jptL, jptM, root, true, now))
+	w.write(terminator())
+
+	w.write(pathTable(dirs, binary.LittleEndian, false))
+	w.write(pathTable(dirs, binary.BigEndian, false))
+	w.write(pathTable(dirs, binary.LittleEndian, true))
+	w.write(pathTable(dirs, binary.BigEndian, true))
+
+	for _, joliet := range []bool{false, true} {
+		for _, d := range dirs {
+			w.write(dirExtent(d, joliet))
+		}
+	}
+
+	for _, d := range dirs {
+		for _, c := range d.children {
+			if !c.dir && c.size > 0 {
+				w.copyFile(c)
+			}
+		}
+	}
+
+	if w.err != nil {
+		wr.Close()
+		os.Remove(file)
+		return fmt.Errorf("error writing %s - %s", file, w.err)
+	}
+
+	return wr.Close()
+}
+
+// scan reads directory tree, symlinks are followed for files only
+func scan(n *node) error {
+	list, err := ioutil.ReadDir(n.path)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	jnames := make(map[string]bool)
+
+	for _, info := range list {
+		path := filepath.Join(n.path, info.Name())
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(path); err != nil || info.IsDir() {
+				continue
+			}
+		}
+
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+
+		if info.Size() > 0xffffffff {
+			return fmt.Errorf("%s is too big for ISO9660 image", path)
+		}
+
+		c := &node{
+			path:   path,
+			dir:    info.IsDir(),
+			size:   info.Size(),
+			mtime:  info.ModTime(),
+			parent: n,
+		}
+
+		if c.dir {
+			c.size = 0
+		}
+
+		c.name = unique(primaryName(info.Name(), c.dir), names, maxNameLen)
+		c.jname = unique(jolietName(info.Name()), jnames, maxJolietNameLen)
+
+		if !c.dir {
+			c.name += ";1"
+			c.jname += ";1"
+		}
+
+		n.children = append(n.children, c)
+	}
+
+	sort.Slice(n.children, func(i, j int) bool { return n.children[i].name < n.children[j].name })
+
+	for _, c := range n.children {
+		if c.dir {
+			if err := scan(c); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// levels returns directories in path table order
+func levels(root *node) []*node {
+	result := []*node{root}
+
+	for i := 0; i < len(result); i++ {
+		for _, c := range result[i].children {
+			if c.dir {
+				result = append(result, c)
+			}
+		}
+	}
+
+	return result
+}
+
+// primaryName converts name to d-characters, dot is kept for files only
+func primaryName(name string, dir bool) string {
+	ext := ""
+
+	if i := strings.LastIndex(name, "."); i > 0 && !dir {
+		name, ext = name[:i], name[i+1:]
+	}
+
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+				return r
+			}
+
+			return '_'
+		}, s)
+	}
+
+	name = clean(name)
+
+	if ext != "" {
+		if len(ext) > 8 {
+			ext = ext[:8]
+		}
+
+		return truncate(name, maxNameLen-len(";1")-len(ext)-1) + "." + clean(ext)
+	}
+
+	if dir {
+		return truncate(name, maxNameLen)
+	}
+
+	return truncate(name, maxNameLen-len(";1"))
+}
+
+func jolietName(name string) string {
+	if r := []rune(name); len(r) > maxJolietNameLen-len(";1") {
+		return string(r[:maxJolietNameLen-len(";1")])
+	}
+
+	return name
+}
+
+// unique resolves name collisions by replacing the end of name with ~N
+func unique(name string, taken map[string]bool, max int) string {
+	result := name
+
+	for i := 1; taken[result]; i++ {
+		suffix := "~" + strconv.Itoa(i)
+
+		base, ext := name, ""
+		if j := strings.LastIndex(name, "."); j > 0 {
+			base, ext = name[:j], name[j:]
+		}
+
+		result = truncate(base, max-len(suffix)-len(ext)-len(";1")) + suffix + ext
+	}
+
+	taken[result] = true
+
+	return result
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+
+	return s
+}
+
+func volumeID(name string) string {
+	return truncate(primaryName(name, true), 32)
+}
+
+func identifier(n *node, joliet bool) []byte {
+	if joliet {
+		return ucs2(n.jname)
+	}
+
+	return []byte(n.name)
+}
+
+func ucs2(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+
+	for i, c := range u {
+		binary.BigEndian.PutUint16(b[i*2:], c)
+	}
+
+	return b
+}
+
+func recordLen(id int) int {
+	l := 33 + id
+	if l%2 == 1 {
+		l++
+	}
+
+	return l
+}
+
+// dirSize returns directory extent size, records can't cross sectors
+func dirSize(d *node, joliet bool) uint32 {
+	size := uint32(recordLen(1) * 2)
+
+	for _, c := range children(d, joliet) {
+		l := uint32(recordLen(len(identifier(c, joliet))))
+
+		if size%sectorSize+l > sectorSize {
+			size += sectorSize - size%sectorSize
+		}
+
+		size += l
+	}
+
+	return sectors(size) * sectorSize
+}
+
+// children returns directory entries sorted by identifier of given tree
+func children(d *node, joliet bool) []*node {
+	if !joliet {
+		return d.children
+	}
+
+	result := append([]*node{}, d.children...)
+	sort.Slice(result, func(i, j int) bool { return result[i].jname < result[j].jname })
+
+	return result
+}
+
+func dirExtent(d *node, joliet bool) []byte {
+	size := d.dsize
+	if joliet {
+		size = d.jdsize
+	}
+
+	b := make([]byte, size)
+
+	parent := d
+	if d.parent != nil {
+		parent = d.parent
+	}
+
+	off := copy(b, record(d, []byte{0}, joliet))
+	off += copy(b[off:], record(parent, []byte{1}, joliet))
+
+	for _, c := range children(d, joliet) {
+		r := record(c, identifier(c, joliet), joliet)
+
+		if off%sectorSize+len(r) > sectorSize {
+			off += sectorSize - off%sectorSize
+		}
+
+		off += copy(b[off:], r)
+	}
+
+	return b
+}
+
+func record(n *node, id []byte, joliet bool) []byte {
+	b := make([]byte, recordLen(len(id)))
+
+	extent, size := n.extent, uint32(n.size)
+
+	if n.dir {
+		size = n.dsize
+
+		if joliet {
+			extent, size = n.jextent, n.jdsize
+		}
+	}
+
+	b[0] = byte(len(b))
+	both32(b[2:], extent)
+	both32(b[10:], size)
+	copy(b[18:], recordDate(n.mtime))
+
+	if n.dir {
+		b[25] = flagDirectory
+	}
+
+	both16(b[28:], 1)
+	b[32] = byte(len(id))
+	copy(b[33:], id)
+
+	return b
+}
+
+func pathTableSize(dirs []*node, joliet bool) uint32 {
+	size := uint32(0)
+
+	for _, d := range dirs {
+		size += uint32(pathRecordLen(d, joliet))
+	}
+
+	return size
+}
+
+func pathRecordLen(d *node, joliet bool) int {
+	l := 8 + pathID(d, joliet)
+	if l%2 == 1 {
+		l++
+	}
+
+	return l
+}
+
+func pathID(d *node, joliet bool) int {
+	if d.parent == nil {
+		return 1
+	}
+
+	return len(identifier(d, joliet))
+}
+
+func pathTable(dirs []*node, order binary.ByteOrder, joliet bool) []byte {
+	b := make([]byte, sectors(pathTableSize(dirs, joliet))*sectorSize)
+	off := 0
+
+	for _, d := range dirs {
+		extent := d.extent
+		if joliet {
+			extent = d.jextent
+		}
+
+		parent := uint16(1)
+		if d.parent != nil {
+			parent = d.parent.number
+		}
+
+		b[off] = byte(pathID(d, joliet))
+		order.PutUint32(b[off+2:], extent)
+		order.PutUint16(b[off+6:], parent)
+
+		if d.parent != nil {
+			copy(b[off+8:], identifier(d, joliet))
+		}
+
+		off += pathRecordLen(d, joliet)
+	}
+
+	return b
+}
+
+// descriptor returns primary (type 1) or joliet supplementary (type 2)
+// volume descriptor
+func descriptor(kind byte, volume string, total, ptSize, ptL, ptM uint32, root *node, joliet bool, now time.Time) []byte {
+	b := make([]byte, sectorSize)
+
+	b[0] = kind
+	copy(b[1:], "CD001")
+	b[6] = 1
+
+	text := func(off, size int, s string) {
+		if joliet {
+			t := ucs2(s)
+			for i := len(t); i+1 < size; i += 2 {
+				t = append(t, 0, ' ')
+			}
+			copy(b[off:off+size], t)
+			return
+		}
+
+		copy(b[off:off+size], s+strings.Repeat(" ", size))
+	}
+
+	text(8, 32, "")
+	text(40, 32, volume)
+	both32(b[80:], total)
+
+	if joliet {
+		// UCS-2 level 3
+		copy(b[88:], "%/E")
+	}
+
+	both16(b[120:], 1)
+	both16(b[124:], 1)
+	both16(b[128:], sectorSize)
+	both32(b[132:], ptSize)
+	binary.LittleEndian.PutUint32(b[140:], ptL)
+	binary.BigEndian.PutUint32(b[148:], ptM)
+
+	id := []byte{0}
+	copy(b[156:], record(root, id, joliet))
+
+	text(190, 128, "")
+	text(318, 128, "")
+	text(446, 128, "")
+	text(574, 128, "VIRGO")
+	text(702, 37, "")
+	text(739, 37, "")
+	text(776, 37, "")
+
+	copy(b[813:], volumeDate(now))
+	copy(b[830:], volumeDate(now))
+	copy(b[847:], volumeDate(time.Time{}))
+	copy(b[864:], volumeDate(time.Time{}))
+	b[881] = 1
+
+	return b
+}
+
+func terminator() []byte {
+	b := make([]byte, sectorSize)
+
+	b[0] = 255
+	copy(b[1:], "CD001")
+	b[6] = 1
+
+	return b
+}
+
+func recordDate(t time.Time) []byte {
+	t = t.UTC()
+
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+func volumeDate(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte(strings.Repeat("0", 16)), 0)
+	}
+
+	return append([]byte(t.UTC().Format("20060102150405")+"00"), 0)
+}
+
+func both16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func both32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func sectors(size uint32) uint32 {
+	return (size + sectorSize - 1) / sectorSize
+}
+
+// writer keeps the first error, so image can be written without checking
+// every step
+type writer struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.err = err
+}
+
+func (w *writer) pad(n int) {
+	w.write(make([]byte, n))
+}
+
+func (w *writer) copyFile(n *node) {
+	if w.err != nil {
+		return
+	}
+
+	rd, err := os.Open(n.path)
+	if err != nil {
+		w.err = err
+		return
+	}
+	defer rd.Close()
+
+	written, err := io.CopyN(w.w, rd, n.size)
+	w.n += written
+
+	if err != nil {
+		w.err = fmt.Errorf("%s changed while building image - %s", n.path, err)
+		return
+	}
+
+	if rest := w.n % sectorSize; rest != 0 {
+		w.pad(int(sectorSize - rest))
+	}
+}
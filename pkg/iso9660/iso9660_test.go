@@ -0,0 +1,276 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+type entry struct {
+	name   string
+	dir    bool
+	extent uint32
+	size   uint32
+}
+
+// readDir parses directory extent, "." and ".." are skipped
+func readDir(img []byte, extent, size uint32, joliet bool) []entry {
+	result := []entry{}
+	b := img[extent*sectorSize : extent*sectorSize+size]
+
+	for off := 0; off < len(b); {
+		l := int(b[off])
+		if l == 0 {
+			// rest of sector is padding
+			off += sectorSize - off%sectorSize
+			continue
+		}
+
+		r := b[off : off+l]
+		id := r[33 : 33+int(r[32])]
+		off += l
+
+		if len(id) == 1 && id[0] <= 1 {
+			continue
+		}
+
+		name := string(id)
+		if joliet {
+			u := make([]uint16, len(id)/2)
+			for i := range u {
+				u[i] = binary.BigEndian.Uint16(id[i*2:])
+			}
+			name = string(utf16.Decode(u))
+		}
+
+		result = append(result, entry{
+			name:   name,
+			dir:    r[25]&flagDirectory != 0,
+			extent: binary.LittleEndian.Uint32(r[2:]),
+			size:   binary.LittleEndian.Uint32(r[10:]),
+		})
+	}
+
+	return result
+}
+
+// walk returns files of image with their contents, names are taken from
+// primary or joliet tree
+func walk(t *testing.T, img []byte, joliet bool) map[string]string {
+	desc := img[firstDescriptor*sectorSize:]
+	if joliet {
+		desc = img[(firstDescriptor+1)*sectorSize:]
+
+		if desc[0] != 2 || string(desc[88:91]) != "%/E" {
+			t.Fatal("Joliet descriptor not found")
+		}
+	}
+
+	if string(desc[1:6]) != "CD001" {
+		t.Fatal("Wrong descriptor signature")
+	}
+
+	if total := binary.LittleEndian.Uint32(desc[80:]); int(total)*sectorSize != len(img) {
+		t.Fatalf("Expected image size %d, obtained %d\n", total*sectorSize, len(img))
+	}
+
+	root := desc[156:]
+	result := make(map[string]string)
+
+	var visit func(prefix string, extent, size uint32)
+
+	visit = func(prefix string, extent, size uint32) {
+		for _, e := range readDir(img, extent, size, joliet) {
+			if e.dir {
+				visit(prefix+e.name+"/", e.extent, e.size)
+				continue
+			}
+
+			result[prefix+e.name] = string(img[e.extent*sectorSize : e.extent*sectorSize+e.size])
+		}
+	}
+
+	visit("", binary.LittleEndian.Uint32(root[2:]), binary.LittleEndian.Uint32(root[10:]))
+
+	return result
+}
+
+func keys(m map[string]string) []string {
+	result := []string{}
+	for k := range m {
+		result = append(result, k)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+func TestBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-iso-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"app.conf":                          "listen 3000\n",
+		"empty":                             "",
+		"nested/deeper/settings.json":       `{"debug":true}`,
+		"nested/Upper-Case.yml":             strings.Repeat("x", 5000),
+		"a-very-long-file-name-for-iso.txt": "long",
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// many entries to make directory span several sectors
+	for i := 0; i < 100; i++ {
+		name := filepath.Join(dir, "many", strings.Repeat("f", 20)+string(rune('a'+i%26))+strings.Repeat("g", i/26))
+
+		os.MkdirAll(filepath.Dir(name), 0755)
+
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(dir, "..", filepath.Base(dir)+".iso")
+	defer os.Remove(out)
+
+	if err := Build(dir, out); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obtained := walk(t, img, true)
+
+	for name, data := range files {
+		if obtained[name+";1"] != data {
+			t.Errorf("Expected '%s' to contain %d bytes, obtained %d\n", name, len(data), len(obtained[name+";1"]))
+		}
+	}
+
+	if len(obtained) != len(files)+100 {
+		t.Fatalf("Expected %d files, obtained %v\n", len(files)+100, keys(obtained))
+	}
+
+	primary := walk(t, img, false)
+
+	for _, name := range []string{"APP.CONF;1", "EMPTY;1", "NESTED/DEEPER/SETTINGS.JSON;1", "NESTED/UPPER_CASE.YML;1", "A_VERY_LONG_FILE_NAME_FO.TXT;1"} {
+		if _, ok := primary[name]; !ok {
+			t.Errorf("Expected primary tree to contain %s, obtained %v\n", name, keys(primary))
+		}
+	}
+
+	if len(primary) != len(obtained) {
+		t.Fatalf("Expected trees of the same size, obtained %d and %d\n", len(primary), len(obtained))
+	}
+
+	if !bytes.Equal(img[(firstDescriptor+2)*sectorSize:(firstDescriptor+2)*sectorSize+6], []byte("\xffCD001")) {
+		t.Fatal("Expected terminator descriptor")
+	}
+}
+
+func TestUnique(t *testing.T) {
+	taken := make(map[string]bool)
+
+	for _, expected := range []string{"CONFIG.YML", "CONFIG~1.YML", "CONFIG~2.YML"} {
+		if obtained := unique("CONFIG.YML", taken, maxNameLen); obtained != expected {
+			t.Errorf("Expected '%s', obtained '%s'\n", expected, obtained)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-iso-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"etc/app.conf":      "listen 3000\n",
+		"etc/empty":         "",
+		"data/Records.json": strings.Repeat("r", 3000),
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, "src", name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(dir, "out.iso")
+
+	if err := Build(filepath.Join(dir, "src"), out); err != nil {
+		t.Fatal(err)
+	}
+
+	rd, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+
+	obtained := make(map[string]string)
+	dirs := []string{}
+
+	err = Walk(rd, func(f File) error {
+		if f.Dir {
+			dirs = append(dirs, f.Path)
+			return nil
+		}
+
+		b, err := ioutil.ReadAll(f.Reader)
+		obtained[f.Path] = string(b)
+
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(dirs, ",") != "data,etc" {
+		t.Fatalf("Expected directories data,etc, obtained %v\n", dirs)
+	}
+
+	for name, data := range files {
+		if obtained[name] != data {
+			t.Errorf("Expected '%s' to contain %d bytes, obtained %d\n", name, len(data), len(obtained[name]))
+		}
+	}
+
+	if len(obtained) != len(files) {
+		t.Fatalf("Expected %d files, obtained %v\n", len(files), keys(obtained))
+	}
+
+	if err := Walk(strings.NewReader(strings.Repeat("x", 40000)), func(File) error { return nil }); err == nil {
+		t.Fatal("Expected error walking non ISO9660 data")
+	}
+}
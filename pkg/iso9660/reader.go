@@ -0,0 +1,164 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// File is an entry of image passed to WalkFunc, Reader is nil for
+// directories
+type File struct {
+	Path    string // slash separated, relative to image root
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+	Reader  io.Reader
+}
+
+type WalkFunc func(f File) error
+
+// Walk calls fn for every file and directory of image, parents go before
+// their children. Joliet names are used if image has them.
+func Walk(image io.ReaderAt, fn WalkFunc) error {
+	var (
+		root   []byte
+		joliet bool
+	)
+
+	for i := int64(firstDescriptor); ; i++ {
+		desc := make([]byte, sectorSize)
+
+		if _, err := image.ReadAt(desc, i*sectorSize); err != nil {
+			return fmt.Errorf("error reading volume descriptor - %s", err)
+		}
+
+		if string(desc[1:6]) != "CD001" {
+			return fmt.Errorf("not an ISO9660 image")
+		}
+
+		switch desc[0] {
+		case 1:
+			if root == nil {
+				root = desc[156 : 156+34]
+			}
+		case 2:
+			if esc := string(desc[88:91]); esc == "%/@" || esc == "%/C" || esc == "%/E" {
+				root, joliet = desc[156:156+34], true
+			}
+		}
+
+		if desc[0] == 255 {
+			break
+		}
+	}
+
+	if root == nil {
+		return fmt.Errorf("primary volume descriptor not found")
+	}
+
+	return walkDir(image, "", binary.LittleEndian.Uint32(root[2:]), binary.LittleEndian.Uint32(root[10:]), joliet, fn, 0)
+}
+
+func walkDir(image io.ReaderAt, dir string, extent, size uint32, joliet bool, fn WalkFunc, depth int) error {
+	// guards against directory loops in broken images
+	if depth > 64 {
+		return fmt.Errorf("directory %s is nested too deep", dir)
+	}
+
+	b := make([]byte, size)
+
+	if _, err := image.ReadAt(b, int64(extent)*sectorSize); err != nil {
+		return fmt.Errorf("error reading directory '%s' - %s", dir, err)
+	}
+
+	for off := 0; off < len(b); {
+		l := int(b[off])
+		if l == 0 {
+			// rest of sector is padding
+			off += sectorSize - off%sectorSize
+			continue
+		}
+
+		if l < 34 || off+l > len(b) || 33+int(b[off+32]) > l {
+			return fmt.Errorf("broken record in directory '%s'", dir)
+		}
+
+		r := b[off : off+l]
+		id := r[33 : 33+int(r[32])]
+		off += l
+
+		if len(id) == 1 && id[0] <= 1 {
+			continue
+		}
+
+		f := File{
+			Path:    path.Join(dir, fileName(id, joliet)),
+			Dir:     r[25]&flagDirectory != 0,
+			Size:    int64(binary.LittleEndian.Uint32(r[10:])),
+			ModTime: parseDate(r[18:25]),
+		}
+
+		extent := binary.LittleEndian.Uint32(r[2:])
+
+		if f.Dir {
+			if err := fn(f); err != nil {
+				return err
+			}
+
+			if err := walkDir(image, f.Path, extent, uint32(f.Size), joliet, fn, depth+1); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		f.Reader = io.NewSectionReader(image, int64(extent)*sectorSize, f.Size)
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fileName decodes identifier and strips version, primary names are
+// lower cased the same way as BSD and linux do it
+func fileName(id []byte, joliet bool) string {
+	name := string(id)
+
+	if joliet {
+		u := make([]uint16, len(id)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(id[i*2:])
+		}
+
+		name = string(utf16.Decode(u))
+	} else {
+		name = strings.ToLower(name)
+	}
+
+	if i := strings.LastIndex(name, ";"); i > 0 {
+		name = name[:i]
+	}
+
+	name = strings.TrimSuffix(name, ".")
+
+	// names can't escape directory they're extracted to
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+
+	return strings.Replace(name, "/", "_", -1)
+}
+
+func parseDate(b []byte) time.Time {
+	offset := time.Duration(int8(b[6])) * 15 * time.Minute
+
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, time.UTC).Add(-offset)
+}
@@ -0,0 +1,162 @@
+package limits
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/runner"
+)
+
+const (
+	cgroupRoot   = "/sys/fs/cgroup"
+	cgroupParent = "virgo"
+	cpuPeriod    = 100000
+
+	releaseRetries = 10
+	releaseDelay   = 200 * time.Millisecond
+
+	EnforcerCgroup   = "cgroup"
+	EnforcerCpulimit = "cpulimit"
+)
+
+// Limits describes resources given to single instance
+type Limits struct {
+	Memory   int    // guest memory in MB
+	Cpus     int    // number of virtual cpus, 0 - hypervisor default
+	CpuQuota int    // percent of one host cpu, 0 - unlimited
+	Enforcer string `json:",omitempty"` // how CpuQuota is enforced
+}
+
+func (l Limits) Validate() error {
+	if l.Memory < 0 {
+		return fmt.Errorf("memory can't be negative")
+	}
+
+	if l.Cpus < 0 {
+		return fmt.Errorf("cpus can't be negative")
+	}
+
+	if l.CpuQuota < 0 {
+		return fmt.Errorf("cpu quota can't be negative")
+	}
+
+	return nil
+}
+
+func (l Limits) String() string {
+	result := []string{}
+
+	if l.Memory > 0 {
+		result = append(result, strconv.Itoa(l.Memory)+"M")
+	}
+
+	if l.Cpus > 0 {
+		result = append(result, strconv.Itoa(l.Cpus)+"cpu")
+	}
+
+	if l.CpuQuota > 0 {
+		result = append(result, strconv.Itoa(l.CpuQuota)+"%")
+	}
+
+	return strings.Join(result, " ")
+}
+
+// Apply enforces cpu quota for process with given pid. On linux with
+// cgroups v2 process is moved to its own cgroup, otherwise cpulimit is
+// used if installed. Chosen way is saved in l.Enforcer.
+func (l *Limits) Apply(r runner.Runner, name string, pid int) error {
+	if l.CpuQuota == 0 {
+		return nil
+	}
+
+	if hasCgroup2(r) {
+		l.Enforcer = EnforcerCgroup
+		return applyCgroup(r, name, pid, l.CpuQuota)
+	}
+
+	if _, err := r.Shell("which cpulimit"); err == nil {
+		l.Enforcer = EnforcerCpulimit
+		return applyCpulimit(r, pid, l.CpuQuota)
+	}
+
+	return fmt.Errorf("unable to enforce cpu quota - neither writable cgroup v2 hierarchy nor cpulimit found\nYou can install cpulimit\n- via homebrew: brew install cpulimit\n- via port: port install cpulimit\n- manually: https://github.com/opsengine/cpulimit")
+}
+
+// Release cleans up after instance is stopped. cpulimit exits on its
+// own together with limited process, so only cgroup has to be removed.
+func (l Limits) Release(r runner.Runner, name string) error {
+	if l.Enforcer != EnforcerCgroup {
+		return nil
+	}
+
+	var err error
+
+	// cgroup can't be removed until stopped process really exits
+	for i := 0; i < releaseRetries; i++ {
+		if _, err = r.Shell("rmdir " + CgroupDir(name)); err == nil {
+			return nil
+		}
+
+		time.Sleep(releaseDelay)
+	}
+
+	return fmt.Errorf("error removing cgroup '%s' - %s", CgroupDir(name), err)
+}
+
+// CgroupDir returns cgroup of instance, e.g.: /sys/fs/cgroup/virgo/hello-1
+func CgroupDir(name string) string {
+	return filepath.Join(cgroupRoot, cgroupParent, strings.Replace(name, "/", "_", -1))
+}
+
+// CpuMax returns content of cgroup v2 cpu.max file for quota in percents
+func CpuMax(quota int) string {
+	return fmt.Sprintf("%d %d", quota*cpuPeriod/100, cpuPeriod)
+}
+
+func hasCgroup2(r runner.Runner) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+
+	if _, err := r.Shell("test -f " + filepath.Join(cgroupRoot, "cgroup.controllers") + " && test -w " + cgroupRoot + "/cgroup.subtree_control"); err != nil {
+		return false
+	}
+
+	return true
+}
+
+func applyCgroup(r runner.Runner, name string, pid int, quota int) error {
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	dir := CgroupDir(name)
+
+	cmds := []string{
+		"echo +cpu > " + filepath.Join(cgroupRoot, "cgroup.subtree_control"),
+		"mkdir -p " + parent,
+		"echo +cpu > " + filepath.Join(parent, "cgroup.subtree_control"),
+		"mkdir -p " + dir,
+		"echo '" + CpuMax(quota) + "' > " + filepath.Join(dir, "cpu.max"),
+		"echo " + strconv.Itoa(pid) + " > " + filepath.Join(dir, "cgroup.procs"),
+	}
+
+	for _, cmd := range cmds {
+		if out, err := r.Shell(cmd); err != nil {
+			return fmt.Errorf("error applying cgroup limits '%s' - %s %s", cmd, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	return nil
+}
+
+func applyCpulimit(r runner.Runner, pid int, quota int) error {
+	cmd := fmt.Sprintf("cpulimit -z -b -p %d -l %d", pid, quota)
+
+	if out, err := r.Shell(cmd); err != nil {
+		return fmt.Errorf("error running '%s' - %s %s", cmd, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package limits
+
+import (
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	tt := []struct {
+		Limits   Limits
+		Expected string
+	}{
+		{Limits{}, ""},
+		{Limits{Memory: 64}, "64M"},
+		{Limits{Memory: 128, Cpus: 2}, "128M 2cpu"},
+		{Limits{Memory: 128, Cpus: 2, CpuQuota: 50}, "128M 2cpu 50%"},
+	}
+
+	for _, tc := range tt {
+		if obtained := tc.Limits.String(); obtained != tc.Expected {
+			t.Errorf("Expected '%s', obtained '%s'\n", tc.Expected, obtained)
+		}
+	}
+}
+
+func TestCpuMax(t *testing.T) {
+	tt := map[int]string{
+		50:  "50000 100000",
+		100: "100000 100000",
+		250: "250000 100000",
+	}
+
+	for quota, expected := range tt {
+		if obtained := CpuMax(quota); obtained != expected {
+			t.Errorf("Expected '%s' for %d%%, obtained '%s'\n", expected, quota, obtained)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (Limits{Memory: 64, Cpus: 1, CpuQuota: 10}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, l := range []Limits{{Memory: -1}, {Cpus: -1}, {CpuQuota: -1}} {
+		if err := l.Validate(); err == nil {
+			t.Errorf("Expecting error for %#v\n", l)
+		}
+	}
+}
+
+func TestCgroupDir(t *testing.T) {
+	if dir := CgroupDir("user/project-1"); dir != "/sys/fs/cgroup/virgo/user_project-1" {
+		t.Fatalf("Unexpected cgroup dir '%s'\n", dir)
+	}
+}
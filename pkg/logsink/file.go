@@ -0,0 +1,37 @@
+package logsink
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// JSONFile appends entries to file, one json object per line.
+type JSONFile struct {
+	wr  *os.File
+	enc *json.Encoder
+}
+
+func NewJSONFile(file string) (*JSONFile, error) {
+	wr, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file '%s' - %s", file, err)
+	}
+
+	return &JSONFile{
+		wr:  wr,
+		enc: json.NewEncoder(wr),
+	}, nil
+}
+
+func (f *JSONFile) Write(e Entry) error {
+	if err := f.enc.Encode(e); err != nil {
+		return fmt.Errorf("error writing file '%s' - %s", f.wr.Name(), err)
+	}
+
+	return nil
+}
+
+func (f *JSONFile) Close() error {
+	return f.wr.Close()
+}
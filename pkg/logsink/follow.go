@@ -0,0 +1,85 @@
+package logsink
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var pollInterval = 500 * time.Millisecond
+
+// Follow reads file line by line and sends every line to sink using e as
+// a template. When end of file is reached it waits for new data until
+// alive returns false. Entries sink fails to write are logged and dropped,
+// so broken collector doesn't stop shipping.
+func Follow(file string, s Sink, e Entry, alive func() bool) error {
+	var (
+		fd  *os.File
+		err error
+	)
+
+	// guest could be not started yet, wait for serial log to appear
+	for {
+		if fd, err = os.Open(file); err == nil {
+			break
+		}
+
+		if !os.IsNotExist(err) || !alive() {
+			return err
+		}
+
+		time.Sleep(pollInterval)
+	}
+	defer fd.Close()
+
+	rd := bufio.NewReader(fd)
+	line := ""
+	done := false
+
+	for {
+		chunk, err := rd.ReadString('\n')
+		line += chunk
+
+		if err == nil {
+			e.Time = time.Now()
+			e.Message = strings.TrimRight(line, "\r\n")
+			line = ""
+
+			write(s, e)
+
+			continue
+		}
+
+		if err != io.EOF {
+			return err
+		}
+
+		if done {
+			if line != "" {
+				e.Time = time.Now()
+				e.Message = strings.TrimRight(line, "\r\n")
+
+				write(s, e)
+			}
+
+			return nil
+		}
+
+		// drain the rest of file before exit
+		if !alive() {
+			done = true
+			continue
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+func write(s Sink, e Entry) {
+	if err := s.Write(e); err != nil {
+		log.Printf("error shipping log entry - %s", err)
+	}
+}
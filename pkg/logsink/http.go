@@ -0,0 +1,73 @@
+package logsink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// post attempts and delay before first retry, delay is doubled after
+// every failed attempt
+var (
+	httpAttempts = 4
+	httpBackoff  = 500 * time.Millisecond
+)
+
+// HTTP posts every entry as json object to the endpoint. Failed posts are
+// retried with backoff, except ones rejected by client error status.
+type HTTP struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTP(url string) *HTTP {
+	return &HTTP{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (h *HTTP) Write(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error marshalling log entry - %s", err)
+	}
+
+	delay := httpBackoff
+
+	for i := 1; ; i++ {
+		retry, err := h.post(b)
+		if err == nil || !retry || i >= httpAttempts {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends entry once, retry is false if endpoint rejected it
+func (h *HTTP) post(b []byte) (bool, error) {
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return true, fmt.Errorf("error posting log entry to '%s' - %s", h.url, err)
+	}
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("error posting log entry to '%s' - %s", h.url, resp.Status)
+	}
+
+	return false, nil
+}
+
+func (h *HTTP) Close() error {
+	return nil
+}
@@ -0,0 +1,127 @@
+package logsink
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Entry is a single line of guest serial output together with the
+// metadata of the instance which produced it.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	Project  string    `json:"project"`
+	Instance int       `json:"instance"`
+	Message  string    `json:"message"`
+}
+
+type Sink interface {
+	Write(e Entry) error
+	Close() error
+}
+
+// New creates sink by uri, supported formats are:
+//
+//	syslog+udp://host:514
+//	syslog+tcp://host:514
+//	syslog+unix:///dev/log
+//	jsonl:///path/to/file.log
+//	http://host/path, https://host/path
+func New(uri string) (Sink, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing log sink '%s' - %s", uri, err)
+	}
+
+	switch u.Scheme {
+	case "syslog+udp", "syslog+tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("no address found in log sink '%s'", uri)
+		}
+
+		return NewSyslog(strings.TrimPrefix(u.Scheme, "syslog+"), u.Host)
+
+	case "syslog+unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("no socket path found in log sink '%s'", uri)
+		}
+
+		return NewSyslog("unix", u.Path)
+
+	case "jsonl":
+		if u.Path == "" {
+			return nil, fmt.Errorf("no file path found in log sink '%s'", uri)
+		}
+
+		return NewJSONFile(u.Path)
+
+	case "http", "https":
+		return NewHTTP(uri), nil
+	}
+
+	return nil, fmt.Errorf("unsupported log sink '%s'", uri)
+}
+
+// ReadConfig returns list of sink uris from file, one uri per line.
+// Empty lines and lines started with '#' are skipped.
+func ReadConfig(file string) ([]string, error) {
+	result := []string{}
+
+	fd, err := os.Open(file)
+	if err != nil && os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s - %s", file, err)
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		result = append(result, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s - %s", file, err)
+	}
+
+	return result, nil
+}
+
+// Multi sends every entry to all sinks, returning first error occurred.
+type Multi []Sink
+
+func (m Multi) Write(e Entry) error {
+	var result error
+
+	for _, s := range m {
+		if err := s.Write(e); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+func (m Multi) Close() error {
+	var result error
+
+	for _, s := range m {
+		if err := s.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
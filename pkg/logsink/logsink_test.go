@@ -0,0 +1,287 @@
+package logsink
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sampleEntry() Entry {
+	return Entry{
+		Time:     time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+		Host:     "testhost",
+		Project:  "hello",
+		Instance: 2,
+		Message:  "rumprun booted",
+	}
+}
+
+func TestFormat5424(t *testing.T) {
+	expected := `<14>1 2017-01-02T03:04:05Z testhost virgo - serial [virgo@32473 project="hello" instance="2"] rumprun booted`
+
+	if obtained := Format5424(sampleEntry()); obtained != expected {
+		t.Fatalf("Expected '%s', obtained '%s'\n", expected, obtained)
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s, err := New("syslog+udp://" + l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Write(sampleEntry()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n, _, err := l.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if obtained := string(buf[:n]); obtained != Format5424(sampleEntry()) {
+		t.Fatalf("Unexpected message received: '%s'\n", obtained)
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan string, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+
+		line, _ := bufio.NewReader(conn).ReadString(']')
+		received <- line
+	}()
+
+	s, err := New("syslog+tcp://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Write(sampleEntry()); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := Format5424(sampleEntry())
+
+	select {
+	case line := <-received:
+		if !strings.HasPrefix(line, strconv.Itoa(len(msg))+" <14>1") {
+			t.Fatalf("Expected octet counted frame of %d bytes, obtained '%s'\n", len(msg), line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for syslog message")
+	}
+}
+
+func TestJSONFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "out.jsonl")
+
+	s, err := New("jsonl://" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Write(sampleEntry()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.Close()
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, obtained %d\n", len(lines))
+	}
+
+	e := Entry{}
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Project != "hello" || e.Instance != 2 || e.Message != "rumprun booted" {
+		t.Fatalf("Unexpected entry: %v\n", e)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	received := make(chan Entry, 1)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := Entry{}
+		json.NewDecoder(r.Body).Decode(&e)
+		received <- e
+	}))
+	defer ts.Close()
+
+	s, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Write(sampleEntry()); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := <-received; e.Project != "hello" || e.Instance != 2 {
+		t.Fatalf("Unexpected entry: %v\n", e)
+	}
+}
+
+func TestHTTPRetry(t *testing.T) {
+	defer func(d time.Duration) { httpBackoff = d }(httpBackoff)
+	httpBackoff = time.Millisecond
+
+	posts := 0
+	status := http.StatusServiceUnavailable
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		if posts < 3 {
+			w.WriteHeader(status)
+		}
+	}))
+	defer ts.Close()
+
+	s := NewHTTP(ts.URL)
+
+	if err := s.Write(sampleEntry()); err != nil || posts != 3 {
+		t.Fatalf("Expected success after 3 posts, obtained %d posts, error %v\n", posts, err)
+	}
+
+	// rejected entries aren't retried
+	posts = 0
+	status = http.StatusBadRequest
+
+	if err := s.Write(sampleEntry()); err == nil || posts != 1 {
+		t.Fatalf("Expected error after 1 post, obtained %d posts, error %v\n", posts, err)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	for _, uri := range []string{"ftp://host", "syslog+udp://", "jsonl://"} {
+		if _, err := New(uri); err == nil {
+			t.Errorf("Expecting error for '%s'\n", uri)
+		}
+	}
+}
+
+type memSink []Entry
+
+func (m *memSink) Write(e Entry) error { *m = append(*m, e); return nil }
+func (m *memSink) Close() error        { return nil }
+
+type failSink struct{ memSink }
+
+func (f *failSink) Write(e Entry) error {
+	f.memSink.Write(e)
+	return fmt.Errorf("collector is down")
+}
+
+func TestFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "serial.log")
+
+	if err := ioutil.WriteFile(file, []byte("line1\nline2\npartial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &memSink{}
+
+	if err := Follow(file, s, sampleEntry(), func() bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*s) != 3 || (*s)[2].Message != "partial" || (*s)[0].Project != "hello" {
+		t.Fatalf("Unexpected entries: %v\n", *s)
+	}
+
+	// failed writes don't stop following
+	f := &failSink{}
+
+	if err := Follow(file, f, sampleEntry(), func() bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.memSink) != 3 {
+		t.Fatalf("Expected 3 entries attempted, obtained %v\n", f.memSink)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "logsink")
+
+	if list, err := ReadConfig(file); err != nil || len(list) != 0 {
+		t.Fatalf("Expected empty list for missing file, obtained %v, %v\n", list, err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("# collector\nsyslog+udp://127.0.0.1:514\n\n  jsonl:///tmp/out.jsonl\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := ReadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 2 || list[1] != "jsonl:///tmp/out.jsonl" {
+		t.Fatalf("Unexpected sinks: %v\n", list)
+	}
+}
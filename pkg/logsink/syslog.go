@@ -0,0 +1,109 @@
+package logsink
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// facility user (1), severity informational (6)
+	syslogPriority = 1*8 + 6
+	syslogAppName  = "virgo"
+	syslogMsgId    = "serial"
+
+	// private enterprise number used for structured data id
+	syslogSdId = "virgo@32473"
+)
+
+// Syslog sends entries as RFC5424 messages. Messages sent over tcp are
+// framed with octet counting as described in RFC6587.
+type Syslog struct {
+	network string
+	addr    string
+	conn    net.Conn
+}
+
+func NewSyslog(network, addr string) (*Syslog, error) {
+	s := &Syslog{
+		network: network,
+		addr:    addr,
+	}
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Syslog) connect() error {
+	var err error
+
+	if s.network == "unix" {
+		// most of syslog daemons are listening datagram socket
+		if s.conn, err = net.Dial("unixgram", s.addr); err == nil {
+			return nil
+		}
+	}
+
+	if s.conn, err = net.DialTimeout(s.network, s.addr, 5*time.Second); err != nil {
+		return fmt.Errorf("error connecting to syslog %s://%s - %s", s.network, s.addr, err)
+	}
+
+	return nil
+}
+
+func (s *Syslog) Write(e Entry) error {
+	msg := Format5424(e)
+
+	if s.network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		// stream connection may be dropped by collector, retry once
+		s.conn.Close()
+
+		if err := s.connect(); err != nil {
+			return err
+		}
+
+		if _, err = s.conn.Write([]byte(msg)); err != nil {
+			return fmt.Errorf("error writing to syslog %s://%s - %s", s.network, s.addr, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Syslog) Close() error {
+	return s.conn.Close()
+}
+
+// Format5424 returns entry formatted as RFC5424 syslog message:
+// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG
+func Format5424(e Entry) string {
+	host := e.Host
+	if host == "" {
+		host = "-"
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s %s - %s [%s project=\"%s\" instance=\"%d\"] %s",
+		syslogPriority,
+		e.Time.Format(time.RFC3339Nano),
+		host,
+		syslogAppName,
+		syslogMsgId,
+		syslogSdId,
+		escapeSdValue(e.Project),
+		e.Instance,
+		e.Message,
+	)
+}
+
+func escapeSdValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
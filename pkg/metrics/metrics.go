@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/deferpanic/virgo/pkg/stats"
+)
+
+// Source returns instances to export, it's called on every scrape, so
+// instances started or killed after exporter start are picked up.
+type Source func() ([]stats.Target, error)
+
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value func(s stats.Sample) float64
+}
+
+var metrics = []metric{
+	{
+		name: "virgo_instance_up",
+		help: "Whether the instance process is running.",
+		kind: "gauge",
+		value: func(s stats.Sample) float64 {
+			if s.Running {
+				return 1
+			}
+			return 0
+		},
+	},
+	{
+		name:  "virgo_instance_restarts_total",
+		help:  "Number of instance restarts.",
+		kind:  "counter",
+		value: func(s stats.Sample) float64 { return float64(s.Restarts) },
+	},
+	{
+		name:  "virgo_instance_cpu_seconds_total",
+		help:  "Total user and system cpu time of hypervisor process in seconds.",
+		kind:  "counter",
+		value: func(s stats.Sample) float64 { return s.CPUTime.Seconds() },
+	},
+	{
+		name:  "virgo_instance_memory_rss_bytes",
+		help:  "Resident memory size of hypervisor process in bytes.",
+		kind:  "gauge",
+		value: func(s stats.Sample) float64 { return float64(s.RSS) },
+	},
+	{
+		name:  "virgo_instance_network_receive_bytes_total",
+		help:  "Bytes received by host tap interface of the instance.",
+		kind:  "counter",
+		value: func(s stats.Sample) float64 { return float64(s.RxBytes) },
+	},
+	{
+		name:  "virgo_instance_network_transmit_bytes_total",
+		help:  "Bytes transmitted by host tap interface of the instance.",
+		kind:  "counter",
+		value: func(s stats.Sample) float64 { return float64(s.TxBytes) },
+	},
+	{
+		name:  "virgo_instance_uptime_seconds",
+		help:  "Time since hypervisor process start in seconds.",
+		kind:  "gauge",
+		value: func(s stats.Sample) float64 { return s.Uptime.Seconds() },
+	},
+}
+
+// WriteText writes samples in prometheus text exposition format
+func WriteText(w io.Writer, samples []stats.Sample) error {
+	buf := &bytes.Buffer{}
+
+	for _, m := range metrics {
+		fmt.Fprintf(buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", m.name, m.kind)
+
+		for _, s := range samples {
+			fmt.Fprintf(buf, "%s{project=\"%s\",instance_id=\"%d\"} %s\n",
+				m.name,
+				escapeLabel(s.Project),
+				s.Instance,
+				strconv.FormatFloat(m.value(s), 'g', -1, 64),
+			)
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
+
+func Handler(src Source) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targets, err := src()
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		if err := WriteText(w, stats.NewCollector().Collect(targets)); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// ListenAndServe exports metrics on /metrics path
+func ListenAndServe(addr string, src Source) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(src))
+
+	return http.ListenAndServe(addr, mux)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
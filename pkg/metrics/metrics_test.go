@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/stats"
+)
+
+func TestWriteText(t *testing.T) {
+	samples := []stats.Sample{
+		{
+			Project:  "hello",
+			Instance: 1,
+			Running:  true,
+			Restarts: 2,
+			CPUTime:  1500 * time.Millisecond,
+			RSS:      1048576,
+			RxBytes:  100,
+			TxBytes:  200,
+			Uptime:   time.Minute,
+		},
+		{
+			Project:  `user/"quoted"`,
+			Instance: 2,
+		},
+	}
+
+	buf := &bytes.Buffer{}
+
+	if err := WriteText(buf, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"# TYPE virgo_instance_up gauge",
+		`virgo_instance_up{project="hello",instance_id="1"} 1`,
+		`virgo_instance_up{project="user/\"quoted\"",instance_id="2"} 0`,
+		`virgo_instance_restarts_total{project="hello",instance_id="1"} 2`,
+		`virgo_instance_cpu_seconds_total{project="hello",instance_id="1"} 1.5`,
+		`virgo_instance_memory_rss_bytes{project="hello",instance_id="1"} 1.048576e+06`,
+		`virgo_instance_network_receive_bytes_total{project="hello",instance_id="1"} 100`,
+		`virgo_instance_network_transmit_bytes_total{project="hello",instance_id="1"} 200`,
+		`virgo_instance_uptime_seconds{project="hello",instance_id="1"} 60`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Output doesn't contain '%s'\n", line)
+		}
+	}
+
+	if t.Failed() {
+		t.Log(buf.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	src := func() ([]stats.Target, error) {
+		return []stats.Target{{Project: "hello", Instance: 1}}, nil
+	}
+
+	ts := httptest.NewServer(Handler(src))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), `virgo_instance_up{project="hello",instance_id="1"} 0`) {
+		t.Fatalf("Unexpected output:\n%s\n", b)
+	}
+}
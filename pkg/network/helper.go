@@ -0,0 +1,465 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/deferpanic/virgo/pkg/runner"
+)
+
+// Host network is changed by privileged helper, so virgo itself runs
+// unprivileged. Helper is installed setuid root and accepts only these
+// operations with validated arguments.
+const (
+	DefaultHelper = "virgo-net"
+
+	OpTapCreate = "tap-create" // tap-create tap1
+	OpTapDelete = "tap-delete" // tap-delete tap1
+	OpAddr      = "addr"       // addr tap1 10.1.2.1
+	OpDown      = "down"       // down tap1
+	OpNatAdd    = "nat-add"    // nat-add tap1 10.1.2.0/24
+	OpNatDel    = "nat-del"    // nat-del tap1 10.1.2.0/24
+
+	// pool helper accepts addresses of if HelperPoolFile doesn't exist,
+	// it's network of config.DefaultPool
+	DefaultHelperPool = "10.1.0.0/16"
+)
+
+// helper binary, it's changed by config
+var helper = DefaultHelper
+
+// HelperPoolFile has network pool helper accepts addresses of, e.g.
+// 10.1.0.0/16. It's set at install time and must be owned by root, so users
+// can't widen the pool by editing config.
+var HelperPoolFile = "/etc/virgo-net.conf"
+
+// files host network is read from, tests point them to fake ones
+var (
+	sysNetDir      = "/sys/class/net"
+	devDir         = "/dev"
+	procRouteFile  = "/proc/net/route"
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return iface.Addrs()
+	}
+)
+
+// number of arguments of operations
+var argCount = map[string]int{
+	OpTapCreate: 1,
+	OpTapDelete: 1,
+	OpAddr:      2,
+	OpDown:      1,
+	OpNatAdd:    2,
+	OpNatDel:    2,
+}
+
+var ifaceName = regexp.MustCompile(`^tap[0-9]{1,5}$`)
+
+// networks helper pool can be part of
+var privateNets = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+
+// SetHelper changes binary of privileged helper
+func SetHelper(path string) {
+	if path != "" {
+		helper = path
+	}
+}
+
+// Helper returns binary of privileged helper
+func Helper() string {
+	return helper
+}
+
+// RunHelper changes host network by privileged helper
+func RunHelper(r runner.Runner, op string, args ...string) error {
+	cmd := helper + " " + op + " " + strings.Join(args, " ")
+
+	if out, err := r.Shell(cmd); err != nil {
+		return fmt.Errorf("error running '%s' - %s\n%s", cmd, err, out)
+	}
+
+	return nil
+}
+
+// Subnet returns /24 network of gateway
+func Subnet(gw string) string {
+	_, n, err := net.ParseCIDR(gw + "/24")
+	if err != nil {
+		return ""
+	}
+
+	return n.String()
+}
+
+// Request is validated operation of helper, uid is user who runs helper
+type Request struct {
+	Op     string
+	Iface  string
+	Addr   net.IP
+	Subnet *net.IPNet
+	Uid    int
+}
+
+// Command is host command of request, failure of optional one is ignored
+type Command struct {
+	Args     []string
+	Stdin    string
+	Optional bool
+}
+
+// LoadHelperPool reads pool of HelperPoolFile, default one is used if file
+// doesn't exist. File which isn't owned by root or is writable by others
+// is refused.
+func LoadHelperPool(file string) (*net.IPNet, error) {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		_, pool, _ := net.ParseCIDR(DefaultHelperPool)
+		return pool, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error accessing %s - %s", file, err)
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); !ok || st.Uid != 0 || info.Mode().Perm()&0022 != 0 {
+		return nil, fmt.Errorf("%s should be owned by root and writable by root only", file)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s - %s", file, err)
+	}
+
+	ip, pool, err := net.ParseCIDR(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("wrong pool in %s - %s", file, err)
+	}
+
+	if ones, bits := pool.Mask.Size(); ip.To4() == nil || bits != 32 || ones > 24 || !private(pool.IP) {
+		return nil, fmt.Errorf("pool in %s should be private IPv4 network with prefix up to /24", file)
+	}
+
+	return pool, nil
+}
+
+// ParseRequest validates arguments of helper, only tap interfaces and
+// addresses of pool are accepted
+func ParseRequest(args []string, uid int, pool *net.IPNet) (Request, error) {
+	if len(args) == 0 {
+		return Request{}, fmt.Errorf("operation is missing")
+	}
+
+	req := Request{Op: args[0], Uid: uid}
+
+	want, ok := argCount[req.Op]
+	if !ok {
+		return Request{}, fmt.Errorf("unknown operation '%s'", req.Op)
+	}
+
+	if len(args)-1 != want {
+		return Request{}, fmt.Errorf("%s expects %d arguments, %d given", req.Op, want, len(args)-1)
+	}
+
+	if !ifaceName.MatchString(args[1]) {
+		return Request{}, fmt.Errorf("wrong interface '%s', only tap interfaces are accepted", args[1])
+	}
+
+	req.Iface = args[1]
+
+	switch req.Op {
+	case OpAddr:
+		if req.Addr = net.ParseIP(args[2]).To4(); req.Addr == nil || !pool.Contains(req.Addr) {
+			return Request{}, fmt.Errorf("address '%s' should be IPv4 one of %s", args[2], pool)
+		}
+
+		_, req.Subnet, _ = net.ParseCIDR(req.Addr.String() + "/24")
+
+		if req.Addr.Equal(req.Subnet.IP) {
+			return Request{}, fmt.Errorf("address '%s' is network address", args[2])
+		}
+	case OpNatAdd, OpNatDel:
+		ip, n, err := net.ParseCIDR(args[2])
+		if err != nil {
+			return Request{}, fmt.Errorf("wrong subnet '%s' - %s", args[2], err)
+		}
+
+		if ones, _ := n.Mask.Size(); ones != 24 || !ip.Equal(n.IP) || !pool.Contains(ip) {
+			return Request{}, fmt.Errorf("subnet '%s' should be /24 network of %s", args[2], pool)
+		}
+
+		req.Subnet = n
+	}
+
+	return req, nil
+}
+
+func private(ip net.IP) bool {
+	for _, s := range privateNets {
+		_, n, _ := net.ParseCIDR(s)
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authorize checks user may change interface of request, other users'
+// interfaces are refused, root may change any of them. Address mustn't
+// overlap host networks and nat is changed only for subnet of interface.
+func (req Request) Authorize(goos string) error {
+	if err := req.authorizeOwner(goos); err != nil {
+		return err
+	}
+
+	switch req.Op {
+	case OpAddr:
+		return checkOverlap(goos, req.Subnet, req.Iface)
+	case OpNatAdd, OpNatDel:
+		addrs, err := interfaceAddrs(req.Iface)
+		if err != nil {
+			return fmt.Errorf("error reading addresses of %s - %s", req.Iface, err)
+		}
+
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && req.Subnet.Contains(n.IP) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%s isn't assigned to %s", req.Subnet, req.Iface)
+	}
+
+	return nil
+}
+
+func (req Request) authorizeOwner(goos string) error {
+	switch {
+	case req.Uid == 0:
+		return nil
+	case req.Op == OpTapCreate && goos == "linux":
+		// new interface is created for the user, existing persistent one
+		// would be given to the user, so it has to be owned already
+		if _, err := os.Stat(filepath.Join(sysNetDir, req.Iface)); os.IsNotExist(err) {
+			return nil
+		}
+	}
+
+	owner, err := ifaceOwner(goos, req.Iface)
+	if err != nil {
+		return err
+	}
+
+	// free tuntaposx devices belong to root
+	if req.Op == OpTapCreate && goos != "linux" && owner == 0 {
+		return nil
+	}
+
+	if owner != req.Uid {
+		return fmt.Errorf("%s belongs to another user", req.Iface)
+	}
+
+	return nil
+}
+
+// checkOverlap fails if subnet overlaps address or route of host, ones of
+// interface itself are skipped, so address can be assigned again
+func checkOverlap(goos string, subnet *net.IPNet, iface string) error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("error listing interfaces - %s", err)
+	}
+
+	for _, i := range ifaces {
+		if i.Name == iface {
+			continue
+		}
+
+		addrs, err := interfaceAddrs(i.Name)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && overlaps(subnet, n) {
+				return fmt.Errorf("%s overlaps %s of %s", subnet, n, i.Name)
+			}
+		}
+	}
+
+	// darwin has no route file, its connected routes are covered by
+	// interface addresses
+	if goos != "linux" {
+		return nil
+	}
+
+	routes, err := linuxRoutes()
+	if err != nil {
+		return err
+	}
+
+	for dev, nets := range routes {
+		if dev == iface {
+			continue
+		}
+
+		for _, n := range nets {
+			if overlaps(subnet, n) {
+				return fmt.Errorf("%s overlaps route %s of %s", subnet, n, dev)
+			}
+		}
+	}
+
+	return nil
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// linuxRoutes returns routes by interface, default ones are skipped
+func linuxRoutes() (map[string][]*net.IPNet, error) {
+	b, err := ioutil.ReadFile(procRouteFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading routes - %s", err)
+	}
+
+	result := make(map[string][]*net.IPNet)
+
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ..., addresses
+	// are little endian hex
+	for _, line := range strings.Split(string(b), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+
+		dst, err1 := strconv.ParseUint(fields[1], 16, 32)
+		mask, err2 := strconv.ParseUint(fields[7], 16, 32)
+		if err1 != nil || err2 != nil || mask == 0 {
+			continue
+		}
+
+		n := &net.IPNet{
+			IP:   net.IPv4(byte(dst), byte(dst>>8), byte(dst>>16), byte(dst>>24)).To4(),
+			Mask: net.IPv4Mask(byte(mask), byte(mask>>8), byte(mask>>16), byte(mask>>24)),
+		}
+
+		result[fields[0]] = append(result[fields[0]], n)
+	}
+
+	return result, nil
+}
+
+// ifaceOwner returns uid of tap interface owner, it's persistent
+// interface owner on linux and device owner on darwin
+func ifaceOwner(goos, iface string) (int, error) {
+	if goos != "linux" {
+		info, err := os.Stat(filepath.Join(devDir, iface))
+		if err != nil {
+			return -1, fmt.Errorf("error accessing %s - %s", iface, err)
+		}
+
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return -1, fmt.Errorf("unable to get owner of %s", iface)
+		}
+
+		return int(st.Uid), nil
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(sysNetDir, iface, "owner"))
+	if err != nil {
+		return -1, fmt.Errorf("error reading owner of %s - %s", iface, err)
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// Commands returns host commands of request, they're run by helper with
+// clean environment
+func (req Request) Commands(goos string) ([]Command, error) {
+	switch goos {
+	case "linux":
+		return req.linuxCommands(), nil
+	case "darwin":
+		return req.darwinCommands(), nil
+	}
+
+	return nil, fmt.Errorf("%s isn't supported, only linux and darwin are", goos)
+}
+
+func (req Request) linuxCommands() []Command {
+	switch req.Op {
+	case OpTapCreate:
+		return []Command{{Args: []string{"ip", "tuntap", "add", "dev", req.Iface, "mode", "tap", "user", strconv.Itoa(req.Uid)}}}
+	case OpTapDelete:
+		return []Command{{Args: []string{"ip", "tuntap", "del", "dev", req.Iface, "mode", "tap"}}}
+	case OpAddr:
+		return []Command{
+			{Args: []string{"ip", "addr", "replace", req.Addr.String() + "/24", "dev", req.Iface}},
+			{Args: []string{"ip", "link", "set", "dev", req.Iface, "up"}},
+		}
+	case OpDown:
+		return []Command{{Args: []string{"ip", "link", "set", "dev", req.Iface, "down"}}}
+	}
+
+	masquerade := func(action string) []string {
+		s := req.Subnet.String()
+		return []string{"iptables", "-t", "nat", action, "POSTROUTING", "-s", s, "!", "-d", s, "-j", "MASQUERADE"}
+	}
+
+	if req.Op == OpNatAdd {
+		return []Command{
+			{Args: []string{"sysctl", "-w", "net.ipv4.ip_forward=1"}},
+			// rule left by instance which wasn't stopped
+			{Args: masquerade("-D"), Optional: true},
+			{Args: masquerade("-A")},
+		}
+	}
+
+	return []Command{{Args: masquerade("-D")}}
+}
+
+// pfAnchor is anchor of nat rules of interface, anchors of com.apple are
+// evaluated by default pf.conf, so main ruleset isn't changed
+func (req Request) pfAnchor() string {
+	return "com.apple/virgo-" + req.Iface
+}
+
+func (req Request) darwinCommands() []Command {
+	switch req.Op {
+	case OpTapCreate:
+		return []Command{{Args: []string{"chown", strconv.Itoa(req.Uid), filepath.Join(devDir, req.Iface)}}}
+	case OpTapDelete:
+		return []Command{{Args: []string{"chown", "0", filepath.Join(devDir, req.Iface)}}}
+	case OpAddr:
+		return []Command{{Args: []string{"ifconfig", req.Iface, req.Addr.String(), "netmask", "255.255.255.0", "up"}}}
+	case OpDown:
+		return []Command{{Args: []string{"ifconfig", req.Iface, "down"}}}
+	case OpNatAdd:
+		return []Command{
+			{Args: []string{"sysctl", "-w", "net.inet.ip.forwarding=1"}},
+			{Args: []string{"sysctl", "-w", "net.link.ether.inet.proxyall=1"}},
+			// needed by os x 10.11.4 - 10.11.6 only
+			{Args: []string{"sysctl", "-w", "net.inet.ip.fw.enable=1"}, Optional: true},
+			{Args: []string{"pfctl", "-a", req.pfAnchor(), "-f", "-"}, Stdin: "nat on en0 from " + req.Subnet.String() + " to any -> (en0)\n"},
+			// pf is already enabled on most hosts
+			{Args: []string{"pfctl", "-e"}, Optional: true},
+		}
+	}
+
+	return []Command{{Args: []string{"pfctl", "-a", req.pfAnchor(), "-F", "nat"}}}
+}
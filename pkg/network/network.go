@@ -9,28 +9,37 @@ import (
 	"github.com/deferpanic/virgo/pkg/registry"
 )
 
+// Instances get tap interfaces bridged to host in tap mode, user mode
+// needs no root, but instances are reachable only via ports they connect
+// to, every one of them has the same address
+const (
+	ModeTap  = "tap"
+	ModeUser = "user"
+
+	UserIp = "10.0.2.15"
+	UserGw = "10.0.2.2"
+)
+
 type Network struct {
 	Gw  string
 	Ip  string
 	Mac string
 }
 
-var ifupTpl = template.Must(template.New("").Parse(`#!/bin/bash
-sudo ifconfig $1 {{ .Gw }} netmask 255.255.255.0 up
-
-unamestr=` + "`uname`" + `
-if [[ "$unamestr" == 'Darwin' ]]; then
-	sudo pfctl -d
-	echo "nat on en0 from $1:network to any -> (en0)" > rulez
-	sudo pfctl -f ./rulez -e
-fi
+// tap interface is configured by privileged helper, so qemu and the rest
+// of virgo don't need root
+var ifupTpl = template.Must(template.New("").Parse(`#!/bin/sh
+{{ .Helper }} addr $1 {{ .Gw }} && {{ .Helper }} nat-add $1 {{ .Subnet }}
 `))
 
-var ifdownTpl = template.Must(template.New("").Parse(`#!/bin/bash
-ifconfig $1 down
+var ifdownTpl = template.Must(template.New("").Parse(`#!/bin/sh
+{{ .Helper }} nat-del $1 {{ .Subnet }}
+{{ .Helper }} down $1
 `))
 
-func New(p registry.Project, ip, gw string) (Network, error) {
+// New creates network of instance num, its tap scripts are written per
+// instance, as every instance has its own subnet
+func New(p registry.Project, num int, ip, gw string) (Network, error) {
 	if ip == "" || gw == "" {
 		return Network{}, fmt.Errorf("ip and gw can't be empty")
 	}
@@ -41,21 +50,27 @@ func New(p registry.Project, ip, gw string) (Network, error) {
 		Mac: (Network{}).generateMAC(),
 	}
 
-	wr, err := os.OpenFile(p.IfUpFile(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	wr, err := os.OpenFile(p.IfUpFile(num), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
 	if err != nil {
-		return Network{}, fmt.Errorf("error creating %s file - %s\n", p.IfUpFile(), err)
+		return Network{}, fmt.Errorf("error creating %s file - %s\n", p.IfUpFile(num), err)
 	}
 
-	ifupTpl.Execute(wr, network)
+	scripts := struct {
+		Helper string
+		Gw     string
+		Subnet string
+	}{helper, gw, Subnet(gw)}
+
+	ifupTpl.Execute(wr, scripts)
 
 	wr.Close()
 
-	wr, err = os.OpenFile(p.IfDownFile(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	wr, err = os.OpenFile(p.IfDownFile(num), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
 	if err != nil {
-		return Network{}, fmt.Errorf("error creating %s file - %s\n", p.IfUpFile(), err)
+		return Network{}, fmt.Errorf("error creating %s file - %s\n", p.IfDownFile(num), err)
 	}
 
-	ifdownTpl.Execute(wr, nil)
+	ifdownTpl.Execute(wr, scripts)
 
 	wr.Close()
 
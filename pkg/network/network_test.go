@@ -2,7 +2,14 @@ package network
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/deferpanic/virgo/pkg/registry"
 )
 
 func TestGenerateMAC(t *testing.T) {
@@ -10,3 +17,258 @@ func TestGenerateMAC(t *testing.T) {
 		fmt.Println((Network{}).generateMAC())
 	}
 }
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-network-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := registry.New(filepath.Join(dir, ".virgo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr, err := r.AddProject("project1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// instances of project keep their own subnets in scripts
+	for num, gw := range map[int]string{1: "10.1.2.1", 2: "10.1.3.1"} {
+		if _, err := New(pr, num, "10.1.0.2", gw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for num, subnet := range map[int]string{1: "10.1.2.0/24", 2: "10.1.3.0/24"} {
+		b, err := ioutil.ReadFile(pr.IfDownFile(num))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(b), "nat-del $1 "+subnet) {
+			t.Fatalf("Expected ifdown of instance %d to remove nat of %s, obtained:\n%s\n", num, subnet, b)
+		}
+	}
+}
+
+func testPool(t *testing.T) *net.IPNet {
+	_, pool, err := net.ParseCIDR(DefaultHelperPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pool
+}
+
+func TestParseRequest(t *testing.T) {
+	valid := [][]string{
+		{"tap-create", "tap1"},
+		{"tap-delete", "tap12"},
+		{"addr", "tap1", "10.1.2.1"},
+		{"down", "tap1"},
+		{"nat-add", "tap1", "10.1.3.0/24"},
+		{"nat-del", "tap1", "10.1.7.0/24"},
+	}
+
+	for _, args := range valid {
+		if _, err := ParseRequest(args, 1000, testPool(t)); err != nil {
+			t.Fatalf("Expected %v to be valid, obtained %s\n", args, err)
+		}
+	}
+
+	invalid := [][]string{
+		{},
+		{"route-add", "0.0.0.0/0"},
+		{"tap-create"},
+		{"tap-create", "eth0"},
+		{"tap-create", "../tap1"},
+		{"down", "tap1", "tap2"},
+		{"addr", "tap1", "192.168.1.5"},
+		{"addr", "tap1", "10.1.2.0"},
+		{"addr", "tap1", "fd00::1"},
+		{"nat-add", "10.1.2.0/24"},
+		{"nat-add", "tap1", "10.1.2.1/24"},
+		{"nat-add", "tap1", "10.0.0.0/8"},
+		{"nat-del", "tap1", "10.2.0.0/24"},
+		{"nat-del", "eth0", "10.1.2.0/24"},
+	}
+
+	for _, args := range invalid {
+		if _, err := ParseRequest(args, 1000, testPool(t)); err == nil {
+			t.Fatalf("Expected %v to be refused\n", args)
+		}
+	}
+}
+
+func TestLoadHelperPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-network-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "virgo-net.conf")
+
+	if pool, err := LoadHelperPool(file); err != nil || pool.String() != DefaultHelperPool {
+		t.Fatalf("Expected default pool, obtained %v, %v\n", pool, err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("172.20.0.0/16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// file of other users than root is refused
+	pool, err := LoadHelperPool(file)
+	if os.Getuid() != 0 {
+		if err == nil {
+			t.Fatalf("Expected error of file which isn't owned by root\n")
+		}
+
+		return
+	}
+
+	if err != nil || pool.String() != "172.20.0.0/16" {
+		t.Fatalf("Expected 172.20.0.0/16, obtained %v, %v\n", pool, err)
+	}
+
+	if err := os.Chmod(file, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadHelperPool(file); err == nil {
+		t.Fatalf("Expected error of file writable by others\n")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("8.8.0.0/16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(file, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadHelperPool(file); err == nil {
+		t.Fatalf("Expected error of public pool\n")
+	}
+}
+
+func TestRequestCommands(t *testing.T) {
+	req, err := ParseRequest([]string{"tap-create", "tap1"}, 1000, testPool(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmds, err := req.Commands("linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if obtained := strings.Join(cmds[0].Args, " "); obtained != "ip tuntap add dev tap1 mode tap user 1000" {
+		t.Fatalf("Unexpected command '%s'\n", obtained)
+	}
+
+	if req, err = ParseRequest([]string{"nat-add", "tap1", "10.1.2.0/24"}, 1000, testPool(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if cmds, err = req.Commands("darwin"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cmds {
+		if c.Args[0] == "pfctl" && c.Stdin != "" {
+			if obtained := strings.Join(c.Args, " "); obtained != "pfctl -a com.apple/virgo-tap1 -f -" || c.Stdin != "nat on en0 from 10.1.2.0/24 to any -> (en0)\n" {
+				t.Fatalf("Unexpected pf rule '%s' of '%s'\n", c.Stdin, obtained)
+			}
+		}
+
+		if strings.Join(c.Args, " ") == "pfctl -d" {
+			t.Fatalf("Expected pf to be kept enabled\n")
+		}
+	}
+
+	if _, err := req.Commands("windows"); err == nil {
+		t.Fatalf("Expected error of unsupported os\n")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-network-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(dir, routes string, addrs func(string) ([]net.Addr, error)) {
+		sysNetDir, procRouteFile, interfaceAddrs = dir, routes, addrs
+	}(sysNetDir, procRouteFile, interfaceAddrs)
+
+	sysNetDir = dir
+	procRouteFile = filepath.Join(dir, "route")
+
+	// host interfaces have no addresses, taps are known by routes only
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		if name == "tap1" {
+			return []net.Addr{&net.IPNet{IP: net.IPv4(10, 1, 2, 1), Mask: net.CIDRMask(24, 32)}}, nil
+		}
+
+		return nil, nil
+	}
+
+	routes := "Iface\tDestination\tGateway\tFlags\tRefCnt\tUse\tMetric\tMask\tMTU\tWindow\tIRTT\n" +
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n" +
+		"eth0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"tap1\t0002010A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"tap2\t0003010A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n"
+
+	if err := ioutil.WriteFile(procRouteFile, []byte(routes), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for iface, owner := range map[string]string{"tap1": "1000", "tap2": "1001"} {
+		if err := os.MkdirAll(filepath.Join(dir, iface), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, iface, "owner"), []byte(owner+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		args []string
+		uid  int
+		ok   bool
+	}{
+		{[]string{"addr", "tap1", "10.1.2.1"}, 1000, true},
+		{[]string{"addr", "tap1", "10.1.3.1"}, 1000, false},
+		{[]string{"addr", "tap2", "10.1.4.1"}, 1000, false},
+		{[]string{"tap-delete", "tap2"}, 1000, false},
+		{[]string{"tap-delete", "tap2"}, 0, true},
+		{[]string{"tap-delete", "tap3"}, 1000, false},
+		{[]string{"tap-create", "tap3"}, 1000, true},
+		{[]string{"tap-create", "tap1"}, 1000, true},
+		{[]string{"tap-create", "tap2"}, 1000, false},
+		{[]string{"nat-add", "tap1", "10.1.2.0/24"}, 1000, true},
+		{[]string{"nat-del", "tap1", "10.1.3.0/24"}, 1000, false},
+		{[]string{"nat-del", "tap2", "10.1.3.0/24"}, 1000, false},
+	} {
+		req, err := ParseRequest(c.args, c.uid, testPool(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := req.Authorize("linux"); (err == nil) != c.ok {
+			t.Fatalf("Expected %v of uid %d to be allowed: %t, obtained %v\n", c.args, c.uid, c.ok, err)
+		}
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	if s := Subnet("10.1.2.1"); s != "10.1.2.0/24" {
+		t.Fatalf("Expected 10.1.2.0/24, obtained %s\n", s)
+	}
+}
@@ -0,0 +1,51 @@
+package project
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Mount is a host directory given to instance as read-only ISO9660 image
+type Mount struct {
+	Host  string // absolute path
+	Guest string
+}
+
+func (m Mount) String() string {
+	return m.Host + ":" + m.Guest
+}
+
+// ParseMount parses host:guest[:ro] spec, e.g.: ./conf:/etc/app. Images
+// are read-only, so ro is accepted for clarity only.
+func ParseMount(spec string) (Mount, error) {
+	parts := strings.Split(spec, ":")
+
+	if len(parts) == 3 {
+		if parts[2] != "ro" {
+			return Mount{}, fmt.Errorf("wrong mount option '%s' in '%s', host directories are mounted read-only", parts[2], spec)
+		}
+
+		parts = parts[:2]
+	}
+
+	if len(parts) != 2 || parts[0] == "" {
+		return Mount{}, fmt.Errorf("wrong mount '%s', should be host:guest[:ro]", spec)
+	}
+
+	if !strings.HasPrefix(parts[1], "/") || strings.ContainsAny(parts[1], "\" ") {
+		return Mount{}, fmt.Errorf("wrong mountpoint '%s', should be absolute path", parts[1])
+	}
+
+	host, err := filepath.Abs(parts[0])
+	if err != nil {
+		return Mount{}, err
+	}
+
+	if info, err := os.Stat(host); err != nil || !info.IsDir() {
+		return Mount{}, fmt.Errorf("host directory '%s' not found", parts[0])
+	}
+
+	return Mount{Host: host, Guest: parts[1]}, nil
+}
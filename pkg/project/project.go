@@ -1,29 +1,55 @@
 package project
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"runtime"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/deferpanic/dpcli/api"
-	"github.com/deferpanic/virgo/pkg/depcheck"
+	"github.com/deferpanic/virgo/pkg/health"
+	"github.com/deferpanic/virgo/pkg/hypervisor"
+	"github.com/deferpanic/virgo/pkg/iso9660"
+	"github.com/deferpanic/virgo/pkg/limits"
 	"github.com/deferpanic/virgo/pkg/network"
 	"github.com/deferpanic/virgo/pkg/registry"
 	"github.com/deferpanic/virgo/pkg/runner"
-	"github.com/deferpanic/virgo/pkg/tools"
+	"github.com/deferpanic/virgo/pkg/volume"
 )
 
 type Project struct {
 	registry.Project
-	manifest api.Manifest
-	Process  runner.Runner
-	Network  network.Network
-	num      int
+	manifest    api.Manifest
+	Process     runner.Runner
+	Network     network.Network
+	Limits      limits.Limits
+	Healthcheck *health.Check
+	Env         []string // appended to manifest env
+	LogSinks    []string
+	Volumes     []volume.Attached
+	Ephemeral   bool // overlays are removed on kill
+	Mounts      []Mount
+	ReuseMounts bool // keep images of mounts built by previous run
+	Stack       string
+	Service     string
+	Arch        string // guest architecture, host one if empty
+	Binary      string // qemu binary, the one of architecture if empty
+	Accel       string // accelerator, auto detected if empty
+	Vga         string
+	Firmware    string
+	NetworkMode string
+	Hypervisor  hypervisor.Hypervisor // qemu if it's nil
+	num         int
+}
+
+// manifest settings which are not known to api
+type manifestExtra struct {
+	Healthcheck *health.Check
+	Arch        string
 }
 
 func New(pr registry.Project, n network.Network, r runner.Runner, projectNum int) (*Project, error) {
@@ -43,25 +69,52 @@ func New(pr registry.Project, n network.Network, r runner.Runner, projectNum int
 		return nil, fmt.Errorf("unable to load manifest file - %s", err)
 	}
 
+	if len(p.manifest.Processes) > 0 {
+		p.Limits.Memory = p.manifest.Processes[0].Memory
+	}
+
+	extra := manifestExtra{}
+
+	if err := json.Unmarshal(b, &extra); err != nil {
+		return nil, fmt.Errorf("unable to load manifest file - %s", err)
+	}
+
+	p.Healthcheck = extra.Healthcheck
+	p.Arch = extra.Arch
+
 	return p, nil
 }
 
 func (p *Project) Run(headless bool) error {
-	var (
-		env       string
-		bootLine  []string
-		kflag     string
-		nographic string
-	)
+	var env string
 
 	if len(p.manifest.Processes) == 0 {
 		return fmt.Errorf("no processes found in manifest file, unable to proceed")
 	}
 
-	blocks, drives := p.createQemuBlocks()
+	if err := p.Limits.Validate(); err != nil {
+		return err
+	}
+
+	if p.Healthcheck != nil {
+		if err := p.Healthcheck.Validate(); err != nil {
+			return err
+		}
+	}
 
-	if p.manifest.Processes[0].Env != "" {
-		env = p.formatEnv(p.manifest.Processes[0].Env)
+	if err := p.createOverlays(); err != nil {
+		return err
+	}
+
+	if err := p.buildMounts(); err != nil {
+		return err
+	}
+
+	blocks, drives := p.createBlocks()
+
+	envs := append(strings.Fields(p.manifest.Processes[0].Env), p.Env...)
+	if len(envs) > 0 {
+		env = p.formatEnv(strings.Join(envs, " "))
 	}
 
 	ip := p.Network.Ip
@@ -69,60 +122,139 @@ func (p *Project) Run(headless bool) error {
 
 	appendline := `{"net" : {"if":"vioif0", "type":"inet", "method":"static", "addr":"` + ip + `",  "mask":"24", "gw":"` + gw + `"}, ` + env + blocks + ` "cmdline": "` + p.manifest.Processes[0].Cmdline + `"}`
 
-	if p.manifest.Processes[0].Multiboot {
-		bootLine = []string{"-kernel", p.KernelFile(), "-append", appendline}
-	} else {
-		bootLine = []string{"-hda", p.KernelFile()}
+	m := p.machine()
+	m.Multiboot = p.manifest.Processes[0].Multiboot
+	m.Config = appendline
+	m.Cmdline = p.manifest.Processes[0].Cmdline
+	m.Env = envs
+	m.Net.Ip = ip
+	m.Drives = drives
+	m.Headless = headless
+
+	if err := p.hypervisor().Start(p.Process, m); err != nil {
+		return err
 	}
 
-	switch runtime.GOOS {
-	case "linux":
-		if p.kvmEnabled() {
-			kflag = "-enable-kvm"
-		}
-	case "darwin":
-		dep := depcheck.New(p.Process)
+	if err := p.Limits.Apply(p.Process, p.InstanceName(), p.Pid()); err != nil {
+		p.Stop()
+		return err
+	}
 
-		if err := dep.RunAll(); err != nil {
-			return err
+	if _, ok := p.Process.(*runner.ExecRunner); ok {
+		if err := ioutil.WriteFile(p.LastRunFile(), []byte(time.Now().Format(time.RFC3339)+"\n"), 0644); err != nil {
+			log.Printf("error saving time of run - %s", err)
 		}
+	}
 
-		if dep.HasHAX() {
-			kflag = "-accel hax"
-		}
-	default:
-		kflag = "-no-kvm"
+	// log.Printf("open up http://%s:3000", ip)
+
+	return nil
+}
+
+// machine returns settings of instance which are needed to stop it as
+// well, the rest is filled by Run
+func (p *Project) machine() hypervisor.Machine {
+	num := strconv.Itoa(p.num)
+
+	return hypervisor.Machine{
+		Name:         p.InstanceName(),
+		Arch:         p.Arch,
+		Kernel:       p.KernelFile(),
+		Memory:       p.Limits.Memory,
+		Cpus:         p.Limits.Cpus,
+		SerialLog:    p.SerialLogFile(p.num),
+		Socket:       p.socket(),
+		Binary:       p.Binary,
+		Accel:        p.Accel,
+		Vga:          p.Vga,
+		Firmware:     p.Firmware,
+		Capabilities: p.CapabilitiesFile(),
+		Net: hypervisor.Net{
+			Mode:   p.NetworkMode,
+			Id:     "vmnet" + num,
+			Iface:  p.instance().Iface(),
+			Mac:    p.Network.Mac,
+			Gw:     p.Network.Gw,
+			IfUp:   p.IfUpFile(p.num),
+			IfDown: p.IfDownFile(p.num),
+		},
 	}
+}
 
-	if headless {
-		nographic = "-nographic"
+// hypervisor returns backend of instance, qemu is the default one
+func (p *Project) hypervisor() hypervisor.Hypervisor {
+	if p.Hypervisor == nil {
+		hv, _ := hypervisor.Get(hypervisor.Qemu)
+		return hv
 	}
 
-	mac := p.Network.Mac
-	num := strconv.Itoa(p.num)
+	return p.Hypervisor
+}
 
-	cmd := "qemu-system-x86_64"
-	args := []string{
-		kflag,
-		nographic,
-		"-serial", "file:" + p.LogsDir() + "/blah.log",
-		"-vga", "none",
-		"-m", strconv.Itoa(p.manifest.Processes[0].Memory),
-		"-netdev", "tap,id=vmnet" + num + ",ifname=tap" + num + ",script=" + p.Root() + "/ifup.sh,downscript=" + p.Root() + "/ifdown.sh",
-		"-device", "virtio-net-pci,netdev=vmnet" + num + ",mac=" + mac,
+// socket returns api socket of instance, only firecracker has it
+func (p *Project) socket() string {
+	if p.hypervisor().Name() != hypervisor.Firecracker {
+		return ""
 	}
-	args = append(args, drives...)
-	args = append(args, bootLine...)
 
-	p.Process.SetDetached(true)
+	return p.SocketFile(p.num)
+}
+
+// Returns instance number, it's unique across all running projects
+func (p *Project) Num() int {
+	return p.num
+}
+
+// Returns unique instance name, e.g.: hello-1
+func (p *Project) InstanceName() string {
+	return instanceName(p.Name(), p.num)
+}
 
-	if err := p.Process.Exec(cmd, args...); err != nil {
-		return fmt.Errorf("error running '%s %s' - %s", cmd, tools.Join(args, " "), err)
+// Returns pid of running instance, 0 for dry run
+func (p *Project) Pid() int {
+	if proc, ok := p.Process.(*runner.ExecRunner); ok {
+		return proc.Pid
 	}
 
-	// log.Printf("open up http://%s:3000", ip)
+	return 0
+}
 
-	return nil
+func (p *Project) instance() Instance {
+	volumes := []string{}
+	for _, v := range p.Volumes {
+		volumes = append(volumes, v.String())
+	}
+
+	mounts := []string{}
+	for _, m := range p.Mounts {
+		mounts = append(mounts, m.String())
+	}
+
+	return Instance{
+		Volumes:     volumes,
+		Ephemeral:   p.Ephemeral,
+		Mounts:      mounts,
+		LogSinks:    p.LogSinks,
+		Num:         p.num,
+		Limits:      p.Limits,
+		Healthcheck: p.Healthcheck,
+		Env:         p.Env,
+		Stack:       p.Stack,
+		Service:     p.Service,
+		Hypervisor:  p.hypervisor().Name(),
+		Arch:        p.Arch,
+		Accel:       p.Accel,
+		Socket:      p.socket(),
+		NetworkMode: p.NetworkMode,
+	}
+}
+
+// Stop stops instance which isn't saved in runtime, e.g. when it can't be
+// saved
+func (p *Project) Stop() {
+	if proc, ok := p.Process.(*runner.ExecRunner); ok {
+		p.hypervisor().Stop(proc, p.machine())
+	}
 }
 
 func (p *Project) formatEnv(env string) (result string) {
@@ -136,37 +268,125 @@ func (p *Project) formatEnv(env string) (result string) {
 }
 
 // locked down to one process for now
-//
-func (p *Project) createQemuBlocks() (string, []string) {
+// named volumes go after manifest ones, host directories are the last
+func (p *Project) createBlocks() (string, []volume.Attached) {
 	blocks := ""
-	drives := []string{}
+	disks := []volume.Attached{}
 
 	if len(p.manifest.Processes) == 0 {
-		return blocks, drives
+		return blocks, disks
+	}
+
+	format := p.hypervisor().DiskFormat()
+
+	for _, v := range p.manifest.Processes[0].Volumes {
+		disks = append(disks, volume.Attached{
+			File:   p.overlayFile(v.Id),
+			Format: format,
+			Mount:  v.Mount,
+		})
+	}
+
+	disks = append(disks, p.Volumes...)
+
+	for i, m := range p.Mounts {
+		disks = append(disks, volume.Attached{
+			Name:     m.Host,
+			File:     p.MountFile(p.num, i),
+			Format:   volume.FormatRaw,
+			Mount:    m.Guest,
+			ReadOnly: true,
+		})
 	}
 
-	for i, volume := range p.manifest.Processes[0].Volumes {
+	for i, disk := range disks {
 		blocks += `"blk" :  {"source":"dev", "path":"/dev/ld` +
 			strconv.Itoa(i) + `a", "fstype":"blk", "mountpoint":"` +
-			volume.Mount + `"}, `
-		drives = append(drives, []string{"-drive", "if=virtio,file=" + p.VolumesDir() + "/vol" + strconv.Itoa(volume.Id) + ",format=raw"}...)
+			disk.Mount + `"}, `
 	}
 
-	return blocks, drives
+	return blocks, disks
 }
 
-func (p *Project) kvmEnabled() bool {
-	out, err := p.Process.Shell("egrep '(vmx|svm)' /proc/cpuinfo")
-	if err != nil {
-		log.Printf("Error retrieving KVM status - %s\n", err)
-		return false
+// overlayFile returns overlay of manifest volume in format hypervisor
+// supports
+func (p *Project) overlayFile(id int) string {
+	if p.hypervisor().DiskFormat() == volume.FormatRaw {
+		return p.RawOverlayFile(p.num, id)
+	}
+
+	return p.OverlayFile(p.num, id)
+}
+
+// createOverlays makes qcow2 overlay backed by pristine manifest volume for
+// every volume of instance, so instances never write to shared files.
+// Hypervisors without qcow2 support get a copy of volume instead.
+// Existing overlays are reused unless instance is ephemeral.
+func (p *Project) createOverlays() error {
+	if len(p.manifest.Processes) == 0 || len(p.manifest.Processes[0].Volumes) == 0 {
+		return nil
+	}
+
+	// dry run only reports commands, overlays are kept as they are
+	if _, ok := p.Process.(runner.DryRunner); !ok {
+		if p.Ephemeral {
+			if err := os.RemoveAll(p.OverlaysDir(p.num)); err != nil {
+				return fmt.Errorf("error removing overlays - %s", err)
+			}
+		}
+
+		if err := os.MkdirAll(p.OverlaysDir(p.num), 0755); err != nil {
+			return fmt.Errorf("error creating overlays directory - %s", err)
+		}
 	}
 
-	out = bytes.TrimSpace(out)
+	for _, v := range p.manifest.Processes[0].Volumes {
+		overlay := p.overlayFile(v.Id)
 
-	if len(out) == 0 {
-		return false
+		if _, err := os.Stat(overlay); err == nil && !p.Ephemeral {
+			continue
+		}
+
+		backing := p.VolumeFile(v.Id)
+
+		cmd := "qemu-img create -q -f qcow2 -F raw -b " + backing + " " + overlay
+		if p.hypervisor().DiskFormat() == volume.FormatRaw {
+			cmd = "cp " + backing + " " + overlay
+		}
+
+		if out, err := p.Process.Shell(cmd); err != nil {
+			return fmt.Errorf("error creating overlay of volume %d - %s\n%s", v.Id, err, out)
+		}
+	}
+
+	return nil
+}
+
+// buildMounts makes ISO9660 image of every mounted host directory
+func (p *Project) buildMounts() error {
+	if len(p.Mounts) == 0 {
+		return nil
 	}
 
-	return true
+	if _, ok := p.Process.(runner.DryRunner); ok {
+		return nil
+	}
+
+	if err := os.MkdirAll(p.MountsDir(p.num), 0755); err != nil {
+		return fmt.Errorf("error creating mounts directory - %s", err)
+	}
+
+	for i, m := range p.Mounts {
+		file := p.MountFile(p.num, i)
+
+		if _, err := os.Stat(file); err == nil && p.ReuseMounts {
+			continue
+		}
+
+		if err := iso9660.Build(m.Host, file); err != nil {
+			return fmt.Errorf("error building image of %s - %s", m.Host, err)
+		}
+	}
+
+	return nil
 }
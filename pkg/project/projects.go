@@ -1,23 +1,59 @@
 package project
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 
+	"github.com/deferpanic/virgo/pkg/health"
+	"github.com/deferpanic/virgo/pkg/hypervisor"
+	"github.com/deferpanic/virgo/pkg/limits"
 	"github.com/deferpanic/virgo/pkg/network"
 	"github.com/deferpanic/virgo/pkg/registry"
 	"github.com/deferpanic/virgo/pkg/runner"
 	"github.com/deferpanic/virgo/pkg/tools"
 )
 
+// Instance keeps details of single running instance, which are not
+// covered by process and network
+type Instance struct {
+	Num         int
+	Limits      limits.Limits
+	Restarts    int
+	Healthcheck *health.Check `json:",omitempty"`
+	Env         []string      `json:",omitempty"`
+	Stack       string        `json:",omitempty"` // set for instances started by up
+	Service     string        `json:",omitempty"`
+	Volumes     []string      `json:",omitempty"` // named volumes, e.g.: data:/data
+	Ephemeral   bool          `json:",omitempty"`
+	Mounts      []string      `json:",omitempty"` // host directories, e.g.: /home/app/conf:/etc/app
+	LogSinks    []string      `json:",omitempty"`
+	Hypervisor  string        `json:",omitempty"` // qemu if it's empty
+	Socket      string        `json:",omitempty"` // api socket of hypervisor
+	Arch        string        `json:",omitempty"` // host one if it's empty
+	Accel       string        `json:",omitempty"` // auto detected if it's empty
+	NetworkMode string        `json:",omitempty"` // tap if it's empty
+
+	// loaded from health state file, which is updated by health monitor
+	Health string `json:"-"`
+}
+
+// Returns name of host tap interface of instance
+func (i Instance) Iface() string {
+	return "tap" + strconv.Itoa(i.Num)
+}
+
 type Runtime struct {
 	ProjectName string
 	Process     []*runner.ExecRunner
 	Network     []network.Network
+	Instance    []Instance
 }
 
 type Projects []*Runtime
@@ -37,6 +73,24 @@ func LoadProjects(r *registry.Registry) (Projects, error) {
 		return nil, fmt.Errorf("error unmarshalling %s - %s", r.RuntimeFile(), err)
 	}
 
+	for _, rt := range result {
+		for i, instance := range rt.Instance {
+			rt.Instance[i].Health = health.StatusNone
+
+			if instance.Healthcheck == nil {
+				continue
+			}
+
+			state, err := health.LoadState(r.Project(rt.ProjectName).HealthFile(instance.Num))
+			if err != nil {
+				rt.Instance[i].Health = health.StatusStarting
+				continue
+			}
+
+			rt.Instance[i].Health = state.Status
+		}
+	}
+
 	return result, nil
 }
 
@@ -50,15 +104,16 @@ func (ps Projects) GetProjectByName(name string) *Runtime {
 	return nil
 }
 
-func (ps Projects) Add(p *Project, r *registry.Registry) error {
+func (ps *Projects) Add(p *Project, r *registry.Registry) error {
 	if _, ok := p.Process.(runner.DryRunner); ok {
 		return nil
 	}
 
-	for i, _ := range ps {
-		if ps[i].ProjectName == p.Name() {
-			ps[i].Process = append(ps[i].Process, p.Process.(*runner.ExecRunner))
-			ps[i].Network = append(ps[i].Network, p.Network)
+	for _, rt := range *ps {
+		if rt.ProjectName == p.Name() {
+			rt.Process = append(rt.Process, p.Process.(*runner.ExecRunner))
+			rt.Network = append(rt.Network, p.Network)
+			rt.Instance = append(rt.Instance, p.instance())
 			return ps.save(r)
 		}
 	}
@@ -67,17 +122,38 @@ func (ps Projects) Add(p *Project, r *registry.Registry) error {
 		ProjectName: p.Name(),
 		Process:     []*runner.ExecRunner{p.Process.(*runner.ExecRunner)},
 		Network:     []network.Network{p.Network},
+		Instance:    []Instance{p.instance()},
 	}
 
-	ps = append(ps, rt)
+	*ps = append(*ps, rt)
 
 	return ps.save(r)
 }
 
-func (ps Projects) Delete(rt *Runtime, r *registry.Registry) error {
-	for i, _ := range ps {
-		if ps[i].ProjectName == rt.ProjectName {
-			ps = append(ps[:i], ps[i+1:]...)
+// Replace updates i-th instance of project after it was restarted
+func (ps *Projects) Replace(rt *Runtime, i int, p *Project, r *registry.Registry) error {
+	if _, ok := p.Process.(runner.DryRunner); ok {
+		return nil
+	}
+
+	if i < 0 || i >= len(rt.Process) || i >= len(rt.Instance) {
+		return fmt.Errorf("instance %d of '%s' not found in runtime", i, rt.ProjectName)
+	}
+
+	instance := p.instance()
+	instance.Restarts = rt.Instance[i].Restarts + 1
+
+	rt.Process[i] = p.Process.(*runner.ExecRunner)
+	rt.Network[i] = p.Network
+	rt.Instance[i] = instance
+
+	return ps.save(r)
+}
+
+func (ps *Projects) Delete(rt *Runtime, r *registry.Registry) error {
+	for i, p := range *ps {
+		if p.ProjectName == rt.ProjectName {
+			*ps = append((*ps)[:i], (*ps)[i+1:]...)
 			return ps.save(r)
 		}
 	}
@@ -85,7 +161,31 @@ func (ps Projects) Delete(rt *Runtime, r *registry.Registry) error {
 	return fmt.Errorf("project '%s' not found in runtime", rt.ProjectName)
 }
 
-func (ps Projects) save(r *registry.Registry) error {
+// Remove deletes i-th instance of project from runtime, project without
+// instances is deleted as well
+func (ps *Projects) Remove(rt *Runtime, i int, r *registry.Registry) error {
+	if i < 0 || i >= len(rt.Process) {
+		return fmt.Errorf("instance %d of '%s' not found in runtime", i, rt.ProjectName)
+	}
+
+	if len(rt.Process) == 1 {
+		return ps.Delete(rt, r)
+	}
+
+	rt.Process = append(rt.Process[:i], rt.Process[i+1:]...)
+
+	if i < len(rt.Network) {
+		rt.Network = append(rt.Network[:i], rt.Network[i+1:]...)
+	}
+
+	if i < len(rt.Instance) {
+		rt.Instance = append(rt.Instance[:i], rt.Instance[i+1:]...)
+	}
+
+	return ps.save(r)
+}
+
+func (ps *Projects) save(r *registry.Registry) error {
 	wr, err := os.OpenFile(r.RuntimeFile(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("error opening file '%s' - %s", r.RuntimeFile(), err)
@@ -117,39 +217,61 @@ func (ps Projects) Running() Projects {
 	return result
 }
 
-func (ps Projects) GetNextNetowrk() (string, string) {
-	highIP := net.IP{10, 1, 2, 4}.To4()
-	highGw := net.IP{10, 1, 2, 1}.To4()
-
-	if len(ps.Running()) == 0 {
-		return highIP.To4().String(), highGw.To4().String()
-	}
-
-	if len(ps.Running()) > 0 {
-		for _, p := range ps {
-			ip := net.ParseIP(p.Network[len(p.Network)-1].Ip).To4()
-			if ip[2] > highIP[2] {
-				highIP = ip
+// NextNetwork returns address and gateway of the first /24 subnet of pool,
+// which isn't used by running instances. Subnets are taken starting from
+// start address.
+func (ps Projects) NextNetwork(start net.IP, pool *net.IPNet) (string, string) {
+	mask := net.CIDRMask(24, 32)
+	used := make(map[string]bool)
+
+	for _, p := range ps.Running() {
+		for _, n := range p.Network {
+			if ip := net.ParseIP(n.Ip).To4(); ip != nil {
+				used[ip.Mask(mask).String()] = true
 			}
 		}
+	}
+
+	first := binary.BigEndian.Uint32(start.To4().Mask(mask))
 
-		highIP[2]++
+	for n := first; ; n += 256 {
+		subnet := make(net.IP, 4)
+		binary.BigEndian.PutUint32(subnet, n)
 
-		if highIP[2] == 255 {
+		// overflow of pool or of address space
+		if !pool.Contains(subnet) || n < first {
 			return "", ""
 		}
-	}
 
-	highGw[2] = highIP[2]
+		if used[subnet.String()] {
+			continue
+		}
+
+		ip, gw := make(net.IP, 4), make(net.IP, 4)
+		copy(ip, subnet)
+		copy(gw, subnet)
+		ip[3], gw[3] = 4, 1
 
-	return highIP.To4().String(), highGw.To4().String()
+		return ip.String(), gw.String()
+	}
 }
 
+// Returns number for new instance, it's greater than numbers of all
+// instances in runtime, so tap interfaces and logs never collide
 func (ps Projects) NextNum() int {
 	var n int = 0
 
 	for i, _ := range ps {
-		n += len(ps[i].Process)
+		for j := range ps[i].Process {
+			if num := ps[i].instance(j).Num; num > n {
+				n = num
+			}
+		}
+
+		// runtime saved by older versions has no instance numbers
+		if len(ps[i].Instance) == 0 {
+			n += len(ps[i].Process)
+		}
 	}
 
 	return n + 1
@@ -162,7 +284,7 @@ func (ps Projects) String() string {
 		return ""
 	}
 
-	result += "Projectname\tGw\tIP\tMAC\tPids\n"
+	result += "Projectname\tGw\tIP\tMAC\tLimits\tHealth\tHypervisor\tStatus\tPids\n"
 
 	for _, p := range ps {
 		pids := []string{}
@@ -171,13 +293,224 @@ func (ps Projects) String() string {
 			pids = append(pids, strconv.Itoa(instance.Pid))
 		}
 
-		result += fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n", p.ProjectName, p.Network[0].Gw, p.Network[0].Ip, p.Network[0].Mac, tools.Join(pids, ", "))
+		result += fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.ProjectName, p.Network[0].Gw, p.Network[0].Ip, p.Network[0].Mac, p.instance(0).Limits, p.instance(0).Health, p.hypervisor(0), p.Status(0), tools.Join(pids, ", "))
 
 		for i := 1; i < len(p.Network); i++ {
-			result += fmt.Sprintf("\t%s\t%s\t%s\n", p.Network[i].Gw, p.Network[i].Ip, p.Network[i].Mac)
+			result += fmt.Sprintf("\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Network[i].Gw, p.Network[i].Ip, p.Network[i].Mac, p.instance(i).Limits, p.instance(i).Health, p.hypervisor(i), p.Status(i))
+		}
+
+	}
+
+	return result
+}
+
+// Backends returns addresses of running instances of project, which are
+// healthy or have no health check. Empty stack and service select
+// instances started by run or scale only.
+func (ps Projects) Backends(project, stack, service string, port int) []string {
+	result := []string{}
+
+	rt := ps.GetProjectByName(project)
+	if rt == nil {
+		return result
+	}
+
+	for i, proc := range rt.Process {
+		instance := rt.instance(i)
+
+		if instance.Stack != stack || instance.Service != service || i >= len(rt.Network) {
+			continue
+		}
+
+		if instance.Health != health.StatusHealthy && instance.Health != health.StatusNone {
+			continue
+		}
+
+		if !runner.IsPidAlive(proc.Pid) {
+			continue
+		}
+
+		result = append(result, net.JoinHostPort(rt.Network[i].Ip, strconv.Itoa(port)))
+	}
+
+	return result
+}
+
+// HasInstances checks if runtime contains instances of project, started
+// by stack service if given
+func (ps Projects) HasInstances(project, stack, service string) bool {
+	rt := ps.GetProjectByName(project)
+	if rt == nil {
+		return false
+	}
+
+	for i := range rt.Process {
+		if instance := rt.instance(i); instance.Stack == stack && instance.Service == service {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VolumeUser returns name of running instance which has volume attached,
+// empty string if volume is free
+func (ps Projects) VolumeUser(name string) string {
+	for _, rt := range ps {
+		for i, proc := range rt.Process {
+			for _, spec := range rt.instance(i).Volumes {
+				if strings.SplitN(spec, ":", 2)[0] == name && runner.IsPidAlive(proc.Pid) {
+					return rt.InstanceName(i)
+				}
+			}
 		}
+	}
+
+	return ""
+}
 
+// StackString lists instances started by up, grouped by stack and service
+func (ps Projects) StackString() string {
+	type row struct {
+		stack, service, line string
+	}
+
+	rows := []row{}
+
+	for _, p := range ps {
+		for i, proc := range p.Process {
+			instance := p.instance(i)
+			if instance.Stack == "" || i >= len(p.Network) {
+				continue
+			}
+
+			rows = append(rows, row{
+				stack:   instance.Stack,
+				service: instance.Service,
+				line:    fmt.Sprintf("%s\t%s\t%s\t%d\t%s\t%s\t%d\n", instance.Stack, instance.Service, p.ProjectName, instance.Num, p.Network[i].Ip, instance.Health, proc.Pid),
+			})
+		}
+	}
+
+	if len(rows) == 0 {
+		return ""
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].stack != rows[j].stack {
+			return rows[i].stack < rows[j].stack
+		}
+
+		return rows[i].service < rows[j].service
+	})
+
+	result := "Stack\tService\tProjectname\tInstance\tIP\tHealth\tPid\n"
+
+	for _, r := range rows {
+		result += r.line
 	}
 
 	return result
 }
+
+// Returns details of i-th instance, runtime saved by older versions
+// has no instances at all
+func (rt *Runtime) instance(i int) Instance {
+	if i < len(rt.Instance) {
+		return rt.Instance[i]
+	}
+
+	return Instance{}
+}
+
+// Returns index of instance by its number, -1 if not found
+func (rt *Runtime) Index(num int) int {
+	for i, instance := range rt.Instance {
+		if instance.Num == num {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Returns unique name of i-th instance, e.g.: hello-1
+func (rt *Runtime) InstanceName(i int) string {
+	return instanceName(rt.ProjectName, rt.instance(i).Num)
+}
+
+func instanceName(project string, num int) string {
+	return project + "-" + strconv.Itoa(num)
+}
+
+// Stop stops i-th instance with hypervisor it was started by
+func (rt *Runtime) Stop(i int) error {
+	if i < 0 || i >= len(rt.Process) {
+		return fmt.Errorf("instance %d of '%s' not found in runtime", i, rt.ProjectName)
+	}
+
+	hv, err := hypervisor.Get(rt.hypervisor(i))
+	if err != nil {
+		return err
+	}
+
+	return hv.Stop(rt.Process[i], rt.machine(i))
+}
+
+// Returns name of hypervisor i-th instance is run by
+func (rt *Runtime) hypervisor(i int) string {
+	if name := rt.instance(i).Hypervisor; name != "" {
+		return name
+	}
+
+	return hypervisor.Qemu
+}
+
+// DiskFormat returns format of volume overlays of instance with given
+// number, which depends on hypervisor it was started by, empty if instance
+// isn't in runtime
+func (rt *Runtime) DiskFormat(num int) string {
+	i := rt.Index(num)
+	if i < 0 {
+		return ""
+	}
+
+	hv, err := hypervisor.Get(rt.hypervisor(i))
+	if err != nil {
+		return ""
+	}
+
+	return hv.DiskFormat()
+}
+
+// Status returns state of i-th instance reported by its hypervisor
+func (rt *Runtime) Status(i int) string {
+	if i < 0 || i >= len(rt.Process) {
+		return hypervisor.StatusStopped
+	}
+
+	hv, err := hypervisor.Get(rt.hypervisor(i))
+	if err != nil {
+		return hypervisor.StatusStopped
+	}
+
+	return hv.Status(rt.Process[i], rt.machine(i))
+}
+
+// machine returns settings of running instance needed by hypervisor to
+// stop it or report its status
+func (rt *Runtime) machine(i int) hypervisor.Machine {
+	instance := rt.instance(i)
+
+	m := hypervisor.Machine{
+		Name:   rt.InstanceName(i),
+		Socket: instance.Socket,
+		Net:    hypervisor.Net{Mode: instance.NetworkMode, Iface: instance.Iface()},
+	}
+
+	if i < len(rt.Network) {
+		m.Net.Gw = rt.Network[i].Gw
+	}
+
+	return m
+}
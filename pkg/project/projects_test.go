@@ -1,11 +1,23 @@
 package project
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/deferpanic/virgo/pkg/hypervisor"
+	"github.com/deferpanic/virgo/pkg/network"
 	"github.com/deferpanic/virgo/pkg/registry"
+	"github.com/deferpanic/virgo/pkg/runner"
+	"github.com/deferpanic/virgo/pkg/volume"
 )
 
 func writeSampleData(file string, b []byte) error {
@@ -137,3 +149,397 @@ func TestNextNetPair(t *testing.T) {
 		t.Fatalf("Expected IP: 10.1.255.4, Obtained: %s\n", highIP.To4().String())
 	}
 }
+
+func TestNextNetwork(t *testing.T) {
+	projects := Projects{
+		{
+			ProjectName: "project1",
+			Process:     []*runner.ExecRunner{{Pid: os.Getpid()}, {Pid: os.Getpid()}},
+			Network:     []network.Network{{Ip: "10.1.2.4"}, {Ip: "10.1.4.4"}},
+		},
+	}
+
+	start, pool, _ := net.ParseCIDR("10.1.2.0/16")
+
+	if ip, gw := projects.NextNetwork(start, pool); ip != "10.1.3.4" || gw != "10.1.3.1" {
+		t.Fatalf("Expected 10.1.3.4 and 10.1.3.1, obtained %s and %s\n", ip, gw)
+	}
+
+	start, pool, _ = net.ParseCIDR("10.1.4.0/23")
+
+	if ip, _ := projects.NextNetwork(start, pool); ip != "10.1.5.4" {
+		t.Fatalf("Expected 10.1.5.4, obtained %s\n", ip)
+	}
+
+	start, pool, _ = net.ParseCIDR("10.1.4.0/24")
+
+	if ip, gw := projects.NextNetwork(start, pool); ip != "" || gw != "" {
+		t.Fatalf("Expected exceeded pool, obtained %s and %s\n", ip, gw)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	r, err := registry.New("/tmp/.virgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	projects := Projects{
+		{
+			ProjectName: "project1",
+			Process:     []*runner.ExecRunner{{Pid: 1}, {Pid: 2}},
+			Network:     []network.Network{{Ip: "10.1.2.4"}, {Ip: "10.1.3.4"}},
+			Instance:    []Instance{{Num: 1, Stack: "shop", Service: "app"}, {Num: 2}},
+		},
+	}
+
+	if result := projects.StackString(); !strings.Contains(result, "shop\tapp\tproject1\t1\t10.1.2.4") {
+		t.Fatalf("Unexpected stack list:\n%s\n", result)
+	}
+
+	rt := projects.GetProjectByName("project1")
+
+	if err := projects.Remove(rt, 0, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rt.Process) != 1 || rt.Process[0].Pid != 2 || rt.Network[0].Ip != "10.1.3.4" || rt.Instance[0].Num != 2 {
+		t.Fatalf("Unexpected runtime after remove: %#v\n", rt)
+	}
+
+	if err := projects.Remove(rt, 0, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(projects) != 0 {
+		t.Fatalf("Expected empty runtime, obtained %d projects\n", len(projects))
+	}
+}
+
+func TestNextNum(t *testing.T) {
+	projects := Projects{
+		{
+			ProjectName: "project1",
+			Process:     []*runner.ExecRunner{{Pid: 1}, {Pid: 2}},
+			Instance:    []Instance{{Num: 1}, {Num: 5}},
+		},
+		{
+			ProjectName: "project2",
+			Process:     []*runner.ExecRunner{{Pid: 3}},
+			Instance:    []Instance{{Num: 3}},
+		},
+	}
+
+	if n := projects.NextNum(); n != 6 {
+		t.Fatalf("Expected next number 6, obtained %d\n", n)
+	}
+
+	if n := (Projects{}).NextNum(); n != 1 {
+		t.Fatalf("Expected next number 1 for empty runtime, obtained %d\n", n)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	projects := Projects{
+		{
+			ProjectName: "project1",
+			Process:     []*runner.ExecRunner{{Pid: os.Getpid()}, {Pid: os.Getpid()}, {Pid: os.Getpid()}, {Pid: -1}, {Pid: os.Getpid()}},
+			Network:     []network.Network{{Ip: "10.1.2.4"}, {Ip: "10.1.3.4"}, {Ip: "10.1.4.4"}, {Ip: "10.1.5.4"}, {Ip: "10.1.6.4"}},
+			Instance: []Instance{
+				{Num: 1, Health: "none"},
+				{Num: 2, Health: "healthy"},
+				{Num: 3, Health: "starting"},
+				{Num: 4, Health: "none"},
+				{Num: 5, Health: "none", Stack: "shop", Service: "app"},
+			},
+		},
+	}
+
+	expected := []string{"10.1.2.4:3000", "10.1.3.4:3000"}
+	obtained := projects.Backends("project1", "", "", 3000)
+
+	if strings.Join(obtained, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected backends %v, obtained %v\n", expected, obtained)
+	}
+
+	if obtained := projects.Backends("project1", "shop", "app", 80); len(obtained) != 1 || obtained[0] != "10.1.6.4:80" {
+		t.Fatalf("Unexpected stack backends %v\n", obtained)
+	}
+
+	if !projects.HasInstances("project1", "shop", "app") || projects.HasInstances("project1", "shop", "db") || projects.HasInstances("project2", "", "") {
+		t.Fatal("Unexpected result of HasInstances")
+	}
+}
+
+func TestDiskFormat(t *testing.T) {
+	rt := Runtime{
+		ProjectName: "project1",
+		Process:     []*runner.ExecRunner{{Pid: 1}, {Pid: 2}},
+		Instance:    []Instance{{Num: 1}, {Num: 2, Hypervisor: hypervisor.Firecracker}},
+	}
+
+	if obtained := rt.DiskFormat(1); obtained != volume.FormatQcow2 {
+		t.Fatalf("Expected format '%s', obtained '%s'\n", volume.FormatQcow2, obtained)
+	}
+
+	if obtained := rt.DiskFormat(2); obtained != volume.FormatRaw {
+		t.Fatalf("Expected format '%s', obtained '%s'\n", volume.FormatRaw, obtained)
+	}
+
+	if obtained := rt.DiskFormat(3); obtained != "" {
+		t.Fatalf("Expected no format for unknown instance, obtained '%s'\n", obtained)
+	}
+}
+
+func TestVolumeUser(t *testing.T) {
+	projects := Projects{
+		{
+			ProjectName: "project1",
+			Process:     []*runner.ExecRunner{{Pid: -1}, {Pid: os.Getpid()}},
+			Instance:    []Instance{{Num: 1, Volumes: []string{"db:/db"}}, {Num: 2, Volumes: []string{"data:/data"}}},
+		},
+	}
+
+	if obtained := projects.VolumeUser("data"); obtained != "project1-2" {
+		t.Fatalf("Expected 'project1-2', obtained '%s'\n", obtained)
+	}
+
+	// process of the first instance is gone
+	if obtained := projects.VolumeUser("db"); obtained != "" {
+		t.Fatalf("Expected volume to be free, obtained '%s'\n", obtained)
+	}
+}
+
+func TestCreateBlocks(t *testing.T) {
+	r, err := registry.New("/tmp/.virgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(r.Root())
+
+	pr, err := r.AddProject("project1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Project{
+		Project: pr,
+		num:     2,
+		Volumes: []volume.Attached{{Name: "data", File: "/tmp/data.img", Format: volume.FormatRaw, Mount: "/data"}},
+		Mounts:  []Mount{{Host: "/home/app/conf", Guest: "/etc/app"}},
+	}
+
+	manifest := `{"Processes":[{"Memory":64,"Kernel":"project1","Volumes":[{"Id":7887,"File":"stubetc.iso","Mount":"/etc"}]}]}`
+
+	if err := json.Unmarshal([]byte(manifest), &p.manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, drives := p.createBlocks()
+
+	expected := []string{
+		pr.OverlayFile(2, 7887) + ":qcow2",
+		"/tmp/data.img:raw",
+		pr.MountFile(2, 0) + ":raw",
+	}
+
+	obtained := []string{}
+	for _, d := range drives {
+		obtained = append(obtained, d.File+":"+d.Format)
+	}
+
+	if strings.Join(obtained, " ") != strings.Join(expected, " ") || !drives[2].ReadOnly {
+		t.Fatalf("Expected drives %v, obtained %v\n", expected, drives)
+	}
+
+	if !strings.Contains(blocks, `"/dev/ld0a", "fstype":"blk", "mountpoint":"/etc"`) || !strings.Contains(blocks, `"/dev/ld1a", "fstype":"blk", "mountpoint":"/data"`) {
+		t.Fatalf("Unexpected blocks %s\n", blocks)
+	}
+
+	// hypervisors without qcow2 support get raw copies of volumes
+	if p.Hypervisor, err = hypervisor.Get(hypervisor.Firecracker); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, drives = p.createBlocks(); drives[0].File != pr.RawOverlayFile(2, 7887) || drives[0].Format != volume.FormatRaw {
+		t.Fatalf("Expected raw overlay, obtained %+v\n", drives[0])
+	}
+
+	// dry run of ephemeral instance keeps existing overlays
+	if err := os.MkdirAll(pr.OverlaysDir(2), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeSampleData(pr.RawOverlayFile(2, 7887), []byte("overlay")); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Ephemeral = true
+	p.Process = runner.NewDryRunner(ioutil.Discard)
+
+	if err := p.createOverlays(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(pr.RawOverlayFile(2, 7887)); err != nil {
+		t.Fatalf("Expected overlay to be kept in dry run, obtained %s\n", err)
+	}
+}
+
+func TestParseMount(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, spec := range []string{".:/etc/app", dir + ":/etc/app:ro"} {
+		m, err := ParseMount(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Host != dir || m.Guest != "/etc/app" {
+			t.Fatalf("Unexpected mount %+v for '%s'\n", m, spec)
+		}
+	}
+
+	for _, spec := range []string{"", ".", ".:etc", ".:/etc:rw", "/nonexistent:/etc", ":/etc"} {
+		if _, err := ParseMount(spec); err == nil {
+			t.Errorf("Expecting error for '%s'\n", spec)
+		}
+	}
+}
+
+func TestGarbage(t *testing.T) {
+	r, err := registry.New("/tmp/.virgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(r.Root())
+
+	p1, err := r.AddProject("project1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2, err := r.AddProject("project2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{
+		p1.ManifestFile(),
+		p1.IfUpFile(1),
+		p1.IfDownFile(2),
+		p1.OverlayFile(1, 7),
+		p1.OverlayFile(2, 7),
+		p1.OverlayFile(3, 7),
+		p1.OverlayFile(3, 9),
+		p1.MountFile(2, 0),
+		p1.SerialLogFile(1),
+		p1.SerialLogFile(2),
+		p1.SerialLogFile(2) + ".1",
+		p1.HelperLogFile(1) + ".2.gz",
+		p1.HelperLogFile(2),
+		p1.HealthFile(2),
+		p1.LogsDir() + "/qemu.log",
+		p2.ManifestFile(),
+	}
+
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := writeSampleData(file, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writeSampleData(p1.ManifestFile(), []byte(`{"Processes":[{"Volumes":[{"Id":7}]}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-72 * time.Hour)
+
+	if err := os.Chtimes(p2.ManifestFile(), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	projects := Projects{
+		{
+			ProjectName: "project1",
+			Process:     []*runner.ExecRunner{{Pid: os.Getpid()}, {Pid: -1}},
+			Network:     []network.Network{{}, {}},
+			Instance:    []Instance{{Num: 1}, {Num: 2, Ephemeral: true}},
+		},
+	}
+
+	if orphans := projects.Orphans(); len(orphans) != 1 || orphans[0] != "project1-2" {
+		t.Fatalf("Expected project1-2 to be orphaned, obtained %v\n", orphans)
+	}
+
+	obtained, err := projects.Garbage(r, 24*time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// overlays of persistent instance 3 are kept, except unreferenced one
+	expected := []string{
+		p1.OverlaysDir(2),
+		p1.OverlayFile(3, 9),
+		p1.MountsDir(2),
+		p1.SerialLogFile(2) + ".1",
+		p1.HelperLogFile(1) + ".2.gz",
+		p1.HealthFile(2),
+		p1.IfDownFile(2),
+		p2.Root(),
+	}
+
+	sort.Strings(expected)
+	sort.Strings(obtained)
+
+	if strings.Join(obtained, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected garbage:\n%s\nobtained:\n%s\n", strings.Join(expected, "\n"), strings.Join(obtained, "\n"))
+	}
+
+	// project2 is kept without age limit
+	if obtained, _ = projects.Garbage(r, 0, time.Now()); len(obtained) != 7 {
+		t.Fatalf("Expected 7 entries, obtained %v\n", obtained)
+	}
+}
+
+func TestLoadManifestMirror(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/projects/manifest/demo" {
+			http.NotFound(w, req)
+			return
+		}
+
+		w.Write([]byte(`{"Processes":[{"Memory":128,"Kernel":"demo"}],"Arch":"aarch64","Healthcheck":{"Type":"tcp","Port":3000}}`))
+	}))
+	defer srv.Close()
+
+	defer func(base string) { APIBase = base }(APIBase)
+	APIBase = srv.URL + "/v1"
+
+	raw, manifest, err := loadManifest("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Processes) != 1 || manifest.Processes[0].Memory != 128 {
+		t.Fatalf("Expected manifest of mirror, obtained %v\n", manifest)
+	}
+
+	// fields unknown to api are kept
+	extra := manifestExtra{}
+
+	if err := json.Unmarshal(raw, &extra); err != nil || extra.Arch != "aarch64" || extra.Healthcheck == nil {
+		t.Fatalf("Expected arch and health check of manifest, obtained %+v, %v\n", extra, err)
+	}
+
+	if _, _, err := loadManifest("missing"); err == nil {
+		t.Fatalf("Expected error for missing manifest, obtained nil\n")
+	}
+}
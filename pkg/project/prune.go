@@ -0,0 +1,235 @@
+package project
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/registry"
+	"github.com/deferpanic/virgo/pkg/runner"
+)
+
+// Orphans returns names of instances saved in runtime, which processes
+// are gone
+func (ps Projects) Orphans() []string {
+	result := []string{}
+
+	for _, rt := range ps {
+		for i, proc := range rt.Process {
+			if !runner.IsPidAlive(proc.Pid) {
+				result = append(result, rt.InstanceName(i))
+			}
+		}
+	}
+
+	return result
+}
+
+// RemoveOrphans removes instances which processes are gone from runtime
+func (ps *Projects) RemoveOrphans(r *registry.Registry) error {
+	for _, rt := range append(Projects{}, *ps...) {
+		for i := len(rt.Process) - 1; i >= 0; i-- {
+			if runner.IsPidAlive(rt.Process[i].Pid) {
+				continue
+			}
+
+			if err := ps.Remove(rt, i, r); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Garbage returns files of registry which aren't used by running instances:
+// overlays of stopped ephemeral instances and of volumes which aren't in
+// manifest, mount images, health states and network scripts of stopped
+// instances and rotated logs. Overlays of other instances are kept until
+// rm. Whole projects which haven't been run for unused are returned as
+// well, zero unused keeps all projects.
+func (ps Projects) Garbage(r *registry.Registry, unused time.Duration, now time.Time) ([]string, error) {
+	result := []string{}
+
+	for _, pr := range r.ProjectList() {
+		running := make(map[int]bool)
+		ephemeral := make(map[int]bool)
+
+		if rt := ps.GetProjectByName(pr.Name()); rt != nil {
+			for i, proc := range rt.Process {
+				if runner.IsPidAlive(proc.Pid) {
+					running[rt.instance(i).Num] = true
+				} else if rt.instance(i).Ephemeral {
+					ephemeral[rt.instance(i).Num] = true
+				}
+			}
+		}
+
+		if len(running) == 0 && unused > 0 && now.Sub(pr.LastRun()) > unused {
+			files, err := pr.Files()
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, files...)
+			continue
+		}
+
+		overlays, err := unusedFiles(pr.OverlaysRoot(), "%d", running)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dir := range overlays {
+			var num int
+
+			fmt.Sscanf(filepath.Base(dir), "%d", &num)
+
+			if ephemeral[num] {
+				result = append(result, dir)
+				continue
+			}
+
+			files, err := unreferencedOverlays(pr, dir)
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, files...)
+		}
+
+		files, err := unusedFiles(pr.MountsRoot(), "%d", running)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, files...)
+
+		if files, err = rotatedLogs(pr.LogsDir(), []string{registry.SerialLog(), "helper-%d.log"}); err != nil {
+			return nil, err
+		}
+
+		result = append(result, files...)
+
+		for _, pattern := range []string{"health-%d.json", "ifup-%d.sh", "ifdown-%d.sh"} {
+			files, err := unusedFiles(pr.Root(), pattern, running)
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, files...)
+		}
+	}
+
+	return result, nil
+}
+
+// unreferencedOverlays returns overlays in dir of volumes which aren't in
+// manifest anymore, all of them are kept if manifest can't be read
+func unreferencedOverlays(pr registry.Project, dir string) ([]string, error) {
+	result := []string{}
+
+	volumes, err := ManifestVolumes(pr)
+	if err != nil {
+		return result, nil
+	}
+
+	used := make(map[int]bool)
+	for _, v := range volumes {
+		used[v.Id] = true
+	}
+
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range list {
+		var id int
+
+		if _, err := fmt.Sscanf(info.Name(), "vol%d.", &id); err != nil || used[id] {
+			continue
+		}
+
+		result = append(result, filepath.Join(dir, info.Name()))
+	}
+
+	return result, nil
+}
+
+// rotatedLogs returns rotated copies of logs in dir, e.g. serial-1.log.1
+// or serial-1.log.2.gz made by logrotate, logs themselves are kept
+func rotatedLogs(dir string, patterns []string) ([]string, error) {
+	result := []string{}
+
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+
+		return nil, err
+	}
+
+	for _, info := range list {
+		if isRotated(info.Name(), patterns) {
+			result = append(result, filepath.Join(dir, info.Name()))
+		}
+	}
+
+	return result, nil
+}
+
+// isRotated checks if name is a log name matching one of patterns followed
+// by rotation suffix
+func isRotated(name string, patterns []string) bool {
+	for i := 1; i < len(name); i++ {
+		if name[i] != '.' {
+			continue
+		}
+
+		for _, pattern := range patterns {
+			var num int
+
+			if _, err := fmt.Sscanf(name[:i], pattern, &num); err == nil && fmt.Sprintf(pattern, num) == name[:i] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// unusedFiles returns entries of dir matching pattern with instance number,
+// which don't belong to running instances
+func unusedFiles(dir, pattern string, running map[int]bool) ([]string, error) {
+	result := []string{}
+
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+
+		return nil, err
+	}
+
+	for _, info := range list {
+		var num int
+
+		if _, err := fmt.Sscanf(info.Name(), pattern, &num); err != nil {
+			continue
+		}
+
+		// Sscanf ignores trailing text
+		if fmt.Sprintf(pattern, num) != info.Name() || running[num] {
+			continue
+		}
+
+		result = append(result, filepath.Join(dir, info.Name()))
+	}
+
+	return result, nil
+}
@@ -1,63 +1,248 @@
 package project
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 
 	"github.com/deferpanic/dpcli/api"
+	"github.com/deferpanic/virgo/pkg/cache"
+	"github.com/deferpanic/virgo/pkg/download"
 	"github.com/deferpanic/virgo/pkg/registry"
+	"github.com/deferpanic/virgo/pkg/tools"
 )
 
-func Pull(pr registry.Project) error {
-	var (
-		err      error
-		manifest api.Manifest
-	)
+// DefaultAPIBase is api of deferpanic, everything of it is downloaded by
+// dpcli, which knows its endpoints and auth
+const DefaultAPIBase = "https://api.deferpanic.com/v1"
 
-	if manifest, err = api.LoadManifest(pr.Name()); err != nil {
+// endpoints mirror serves manifests, kernels and volumes at, requests are
+// authorized by "Bearer <token>" header. APIBase is replaced by mirror of
+// credentials profile, urls of default api are used as cache keys only.
+var (
+	APIBase      = DefaultAPIBase
+	manifestURL  = "%s/projects/manifest/%s"
+	kernelURL    = "%s/projects/download/%s"
+	communityURL = "%s/projects/community/download/%s/%s"
+	volumeURL    = "%s/volumes/download/%d"
+)
+
+// Pull downloads kernel and volumes of project, registry files are
+// replaced only when all of them are downloaded. Files which haven't
+// changed since they were cached are linked from c, nil c disables cache.
+func Pull(pr registry.Project, m *download.Manager, c *cache.Cache) error {
+	raw, manifest, err := loadManifest(pr.Repository())
+	if err != nil {
 		return err
 	}
 
+	mirror := APIBase != DefaultAPIBase
+
 	ap := &api.Projects{}
+	av := &api.Volumes{}
+
+	jobs := []download.Job{{Name: "kernel", File: pr.KernelFile()}}
+
 	if pr.IsCommunity() {
-		parts := strings.Split(pr.Name(), "/")
-		err = ap.DownloadCommunity(parts[1], pr.UserName(), pr.KernelFile())
+		parts := strings.Split(pr.Repository(), "/")
+		jobs[0].URL = fmt.Sprintf(communityURL, APIBase, parts[1], pr.UserName())
+		jobs[0].Fetch = func(dst string) error {
+			return ap.DownloadCommunity(parts[1], pr.UserName(), dst)
+		}
 	} else {
-		err = ap.Download(pr.Name(), pr.KernelFile())
+		jobs[0].URL = fmt.Sprintf(kernelURL, APIBase, pr.Repository())
+		jobs[0].Fetch = func(dst string) error {
+			return ap.Download(pr.Repository(), dst)
+		}
 	}
-	if err != nil {
-		return err
+
+	if mirror {
+		jobs[0].Fetch = nil
 	}
 
-	v := &api.Volumes{}
+	seen := make(map[string]bool)
 
 	for i := 0; i < len(manifest.Processes); i++ {
 		proc := manifest.Processes[i]
 		for _, volume := range proc.Volumes {
-			dst := filepath.Join(pr.VolumesDir(), "vol"+strconv.Itoa(volume.Id))
+			id := volume.Id
 
-			if err = v.Download(volume.Id, dst); err != nil {
-				return err
+			job := download.Job{
+				Name: fmt.Sprintf("vol%d", id),
+				URL:  fmt.Sprintf(volumeURL, APIBase, id),
+				File: pr.VolumeFile(id),
+			}
+
+			if !mirror {
+				job.Fetch = func(dst string) error {
+					return av.Download(id, dst)
+				}
+			}
+
+			if !seen[job.File] {
+				jobs = append(jobs, job)
+				seen[job.File] = true
 			}
 		}
 	}
 
-	b, err := json.Marshal(manifest)
-	if err != nil {
+	if c != nil {
+		for i := range jobs {
+			if e, ok := c.Lookup(jobs[i].URL); ok && e.ETag != "" {
+				jobs[i].ETag = e.ETag
+			}
+		}
+	}
+
+	if mirror && m.Header.Get("Authorization") == "" && tools.Token() != "" {
+		m.Header.Set("Authorization", "Bearer "+tools.Token())
+	}
+
+	if err := m.Fetch(jobs); err != nil {
 		return err
 	}
 
-	wr, err := os.OpenFile(pr.ManifestFile(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
+	if c != nil {
+		if err := cacheJobs(c, jobs); err != nil {
+			return err
+		}
+	}
+
+	// overlays can't outlive volumes they're backed by
+	if err := os.RemoveAll(pr.OverlaysRoot()); err != nil {
 		return err
 	}
 
-	if _, err := wr.Write(b); err != nil {
+	if err := removeStale(pr.VolumesDir(), seen); err != nil {
 		return err
 	}
 
+	// files could be hard linked to other tags, so they're never
+	// overwritten in place
+	tmp := pr.ManifestFile() + download.PartSuffix
+
+	if err := ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, pr.ManifestFile())
+}
+
+// cacheJobs links files which aren't modified from cache and adds
+// downloaded ones to it
+func cacheJobs(c *cache.Cache, jobs []download.Job) error {
+	for _, job := range jobs {
+		if job.Cached {
+			e, _ := c.Lookup(job.URL)
+
+			if err := c.Link(e, job.File); err != nil {
+				return fmt.Errorf("error linking cached %s - %s", job.Name, err)
+			}
+
+			continue
+		}
+
+		if _, err := c.Add(job.URL, job.ETag, job.File); err != nil {
+			return fmt.Errorf("error caching %s - %s", job.Name, err)
+		}
+	}
+
+	return c.Save()
+}
+
+// Check reports if manifest of project differs from upstream one, project
+// which isn't pulled is outdated
+func Check(pr registry.Project) (bool, error) {
+	b, _, err := loadManifest(pr.Repository())
+	if err != nil {
+		return false, err
+	}
+
+	local, err := ioutil.ReadFile(pr.ManifestFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	return !bytes.Equal(b, local), nil
+}
+
+// removeStale removes volumes which aren't used by new manifest, part
+// files are kept to resume next pull
+func removeStale(dir string, used map[string]bool) error {
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range list {
+		file := filepath.Join(dir, info.Name())
+
+		if used[file] || strings.HasSuffix(file, download.PartSuffix) || strings.HasSuffix(file, download.PartSuffix+download.ETagSuffix) {
+			continue
+		}
+
+		if err := os.RemoveAll(file); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// loadManifest returns manifest as it's received from APIBase, so fields
+// api doesn't know, e.g. Healthcheck and Arch, are kept. dpcli knows only
+// default api and returns parsed manifest, so it has api fields only,
+// manifest of mirror is requested directly, the same way as kernel.
+func loadManifest(name string) ([]byte, api.Manifest, error) {
+	var manifest api.Manifest
+
+	if APIBase == DefaultAPIBase {
+		m, err := api.LoadManifest(name)
+		if err != nil {
+			return nil, m, err
+		}
+
+		b, err := json.Marshal(m)
+
+		return b, m, err
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf(manifestURL, APIBase, name), nil)
+	if err != nil {
+		return nil, manifest, err
+	}
+
+	if tools.Token() != "" {
+		req.Header.Set("Authorization", "Bearer "+tools.Token())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, manifest, fmt.Errorf("error loading manifest of %s - %s", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, manifest, fmt.Errorf("error loading manifest of %s - %s", name, resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, manifest, fmt.Errorf("error loading manifest of %s - %s", name, err)
+	}
+
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, manifest, fmt.Errorf("error decoding manifest of %s - %s", name, err)
+	}
+
+	return b, manifest, nil
+}
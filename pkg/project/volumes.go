@@ -0,0 +1,64 @@
+package project
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/deferpanic/dpcli/api"
+	"github.com/deferpanic/virgo/pkg/registry"
+)
+
+// ManifestVolume is a volume listed in manifest together with its file
+// in registry
+type ManifestVolume struct {
+	Id    int
+	File  string // name given by api
+	Mount string
+	Path  string
+}
+
+// ManifestVolumes returns volumes of all processes of pulled project
+func ManifestVolumes(pr registry.Project) ([]ManifestVolume, error) {
+	manifest := api.Manifest{}
+
+	b, err := ioutil.ReadFile(pr.ManifestFile())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("unable to load manifest file - %s", err)
+	}
+
+	result := []ManifestVolume{}
+
+	for _, proc := range manifest.Processes {
+		for _, v := range proc.Volumes {
+			result = append(result, ManifestVolume{
+				Id:    v.Id,
+				File:  v.File,
+				Mount: v.Mount,
+				Path:  pr.VolumeFile(v.Id),
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// ManifestVolumeByMount finds volume of project mounted at given path
+func ManifestVolumeByMount(pr registry.Project, mount string) (ManifestVolume, error) {
+	volumes, err := ManifestVolumes(pr)
+	if err != nil {
+		return ManifestVolume{}, err
+	}
+
+	for _, v := range volumes {
+		if v.Mount == mount {
+			return v, nil
+		}
+	}
+
+	return ManifestVolume{}, fmt.Errorf("project '%s' has no volume mounted at '%s'", pr.Name(), mount)
+}
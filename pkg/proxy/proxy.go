@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var dialTimeout = 2 * time.Second
+
+// Backends returns addresses to balance connections between, it's called
+// for every accepted connection
+type Backends func() []string
+
+// Cached wraps b so it's called at most once per ttl, connections accepted
+// in between reuse the last result
+func Cached(b Backends, ttl time.Duration) Backends {
+	var (
+		mu      sync.Mutex
+		last    []string
+		updated time.Time
+	)
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if updated.IsZero() || time.Since(updated) >= ttl {
+			last = b()
+			updated = time.Now()
+		}
+
+		return last
+	}
+}
+
+// Proxy is a round robin tcp load balancer
+type Proxy struct {
+	listener net.Listener
+	backends Backends
+	next     uint64
+}
+
+func Listen(addr string, b Backends) (*Proxy, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s - %s", addr, err)
+	}
+
+	return &Proxy{
+		listener: l,
+		backends: b,
+	}, nil
+}
+
+func (p *Proxy) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+func (p *Proxy) Close() error {
+	return p.listener.Close()
+}
+
+// Serve accepts connections until proxy is closed
+func (p *Proxy) Serve() error {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go p.handle(conn)
+	}
+}
+
+func (p *Proxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	backends := p.backends()
+
+	// try every backend once starting from next one in turn
+	for i := 0; i < len(backends); i++ {
+		n := atomic.AddUint64(&p.next, 1) - 1
+		addr := backends[n%uint64(len(backends))]
+
+		upstream, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err != nil {
+			log.Printf("error connecting to backend %s - %s", addr, err)
+			continue
+		}
+		defer upstream.Close()
+
+		pipe(conn, upstream)
+
+		return
+	}
+
+	log.Printf("no backend available for connection from %s", conn.RemoteAddr())
+}
+
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+
+		// let other side know there is nothing more to read
+		if c, ok := dst.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+
+		done <- struct{}{}
+	}
+
+	go cp(a, b)
+	go cp(b, a)
+
+	<-done
+	<-done
+}
+
+// ParseMapping parses "host:guest" port mapping, single port is used for
+// both sides
+func ParseMapping(spec string) (int, int, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("wrong port mapping '%s', should be host:guest", spec)
+	}
+
+	ports := make([]int, 2)
+
+	for i, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil || v <= 0 || v > 65535 {
+			return 0, 0, fmt.Errorf("wrong port mapping '%s', should be host:guest", spec)
+		}
+
+		ports[i] = v
+	}
+
+	return ports[0], ports[1], nil
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// backend replies with its name to every connection
+func backend(t *testing.T, name string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Write([]byte(name + "\n"))
+			conn.Close()
+		}
+	}()
+
+	return l
+}
+
+func request(t *testing.T, addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return ""
+	}
+
+	return line[:len(line)-1]
+}
+
+func TestRoundRobin(t *testing.T) {
+	b1 := backend(t, "one")
+	defer b1.Close()
+
+	b2 := backend(t, "two")
+	defer b2.Close()
+
+	// nothing is listening here
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	backends := func() []string {
+		return []string{b1.Addr().String(), dead.Addr().String(), b2.Addr().String()}
+	}
+
+	p, err := Listen("127.0.0.1:0", backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	go p.Serve()
+
+	obtained := []string{}
+	for i := 0; i < 4; i++ {
+		obtained = append(obtained, request(t, p.Addr().String()))
+	}
+
+	expected := []string{"one", "two", "one", "two"}
+
+	for i := range expected {
+		if obtained[i] != expected[i] {
+			t.Fatalf("Expected %v, obtained %v\n", expected, obtained)
+		}
+	}
+}
+
+func TestNoBackends(t *testing.T) {
+	p, err := Listen("127.0.0.1:0", func() []string { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	go p.Serve()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if b, _ := ioutil.ReadAll(conn); len(b) != 0 {
+		t.Fatalf("Expected connection to be closed, obtained '%s'\n", b)
+	}
+}
+
+func TestParseMapping(t *testing.T) {
+	host, guest, err := ParseMapping("8080:3000")
+	if err != nil || host != 8080 || guest != 3000 {
+		t.Fatalf("Unexpected result: %d, %d, %v\n", host, guest, err)
+	}
+
+	if host, guest, err = ParseMapping("80"); err != nil || host != 80 || guest != 80 {
+		t.Fatalf("Unexpected result: %d, %d, %v\n", host, guest, err)
+	}
+
+	for _, spec := range []string{"", "a:b", "1:2:3", "0:80", "80:70000"} {
+		if _, _, err := ParseMapping(spec); err == nil {
+			t.Errorf("Expecting error for '%s'\n", spec)
+		}
+	}
+}
+
+func TestCached(t *testing.T) {
+	calls := 0
+
+	b := Cached(func() []string {
+		calls++
+		return []string{strconv.Itoa(calls)}
+	}, 50*time.Millisecond)
+
+	b()
+	if obtained := b(); calls != 1 || obtained[0] != "1" {
+		t.Fatalf("Expected cached result, obtained %v after %d calls\n", obtained, calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if obtained := b(); calls != 2 || obtained[0] != "2" {
+		t.Fatalf("Expected refreshed result, obtained %v after %d calls\n", obtained, calls)
+	}
+}
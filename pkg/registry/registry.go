@@ -5,24 +5,57 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	cfgDefaultRoot  = ".virgo"
 	cfgProjectsDir  = "projects"
+	cfgTagsDir      = "tags"
+	cfgDefaultTag   = "latest"
 	cfgKernelDir    = "kernel"
 	cfgLogsDir      = "logs"
 	cfgPidsDir      = "pids"
 	cfgVolumesDir   = "volumes"
+	cfgCacheDir     = "cache"
+	cfgOverlaysDir  = "overlays"
+	cfgMountsDir    = "mounts"
+	cfgLastRunFile  = "lastrun"
 	cfgManifestFile = "manifest"
 	cfgRuntimeFile  = "runtime.json"
-	cfgIfUpFile     = "ifup.sh"
-	cfgIfDownFile   = "ifdown.sh"
+	cfgIfUpFile     = "ifup-%d.sh"
+	cfgIfDownFile   = "ifdown-%d.sh"
+	cfgLogSinkFile  = "logsink"
+	cfgCredentials  = "credentials"
+	cfgSerialLog    = "serial-%d.log"
+	cfgConfigFile   = "config.yaml"
+	cfgHelperLog    = "helper-%d.log"
+	cfgHealthFile   = "health-%d.json"
+	cfgSocketFile   = "api-%d.sock"
+	cfgCapabilities = "capabilities.json"
 )
 
+// name of guest serial log, it's changed by config
+var serialLog = cfgSerialLog
+
+// SetSerialLog changes name of guest serial logs, pattern has %d for
+// instance number
+func SetSerialLog(pattern string) {
+	if pattern != "" {
+		serialLog = pattern
+	}
+}
+
+// SerialLog returns name pattern of guest serial logs
+func SerialLog() string {
+	return serialLog
+}
+
 type Project struct {
 	name     string
+	tag      string
 	username string
 	root     string
 }
@@ -49,13 +82,25 @@ func New(v ...string) (r *Registry, err error) {
 	return
 }
 
+// AddProject adds project to registry, name could have tag, e.g.
+// hello:1.0, project without tag is hello:latest
 func (r *Registry) AddProject(name string) (Project, error) {
-	p := Project{name: name, root: r.root}
+	name, tag := SplitTag(name)
+
+	p := Project{name: name, tag: tag, root: r.root}
 
 	if name == "" {
 		return Project{}, fmt.Errorf("empty project name, unable to proceed")
 	}
 
+	if err := ValidName(name); err != nil {
+		return Project{}, err
+	}
+
+	if err := validTag(tag); err != nil {
+		return Project{}, err
+	}
+
 	if strings.Contains(name, "/") {
 		if parts := strings.Split(name, "/"); len(parts) != 2 {
 			return Project{}, fmt.Errorf("wrong format for community project, should be project/username")
@@ -68,16 +113,15 @@ func (r *Registry) AddProject(name string) (Project, error) {
 		}
 	}
 
-	p.name = name
-	r.projects = append(r.projects, p)
-
-	projectroot := filepath.Join(r.Projects(), name)
+	if r.Project(p.Name()).Name() == "" {
+		r.projects = append(r.projects, p)
+	}
 
-	if _, err := os.Stat(projectroot); err == nil {
+	if _, err := os.Stat(p.Root()); err == nil {
 		return p, nil
 	}
 
-	for _, dir := range r.Project(name).Structure() {
+	for _, dir := range p.Structure() {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return Project{}, fmt.Errorf("error creating registry - %s", err)
 		}
@@ -87,8 +131,10 @@ func (r *Registry) AddProject(name string) (Project, error) {
 }
 
 func (r *Registry) Project(name string) Project {
+	name, tag := SplitTag(name)
+
 	for _, project := range r.projects {
-		if project.name == name {
+		if project.name == name && project.tag == tag {
 			return project
 		}
 	}
@@ -128,22 +174,33 @@ func (r *Registry) initialize() error {
 				continue
 			}
 
-			manifest := filepath.Join(root, info.Name(), info.Name()+"."+cfgManifestFile)
+			projectName := info.Name()
 
-			if _, err := os.Stat(manifest); err == nil {
-				projectName := info.Name()
+			if root != r.Projects() {
+				projectName = filepath.Join(filepath.Base(root), info.Name())
+			}
 
-				if root != r.Projects() {
-					projectName = filepath.Join(filepath.Base(root), info.Name())
-				}
+			manifest := filepath.Join(root, info.Name(), info.Name()+"."+cfgManifestFile)
 
+			_, err := os.Stat(manifest)
+			if err == nil {
 				if _, err := r.AddProject(projectName); err != nil {
 					return err
 				}
-			} else if os.IsNotExist(err) {
-				loadProjects(filepath.Join(root, info.Name()))
-			} else {
+			} else if !os.IsNotExist(err) {
 				fmt.Println(err)
+				continue
+			}
+
+			tagged, terr := r.loadTags(projectName)
+			if terr != nil {
+				return terr
+			}
+
+			// directory without manifest and tags is username of
+			// community projects
+			if err != nil && !tagged {
+				loadProjects(filepath.Join(root, info.Name()))
 			}
 		}
 
@@ -157,8 +214,32 @@ func (r Registry) purge() error {
 	return os.RemoveAll(r.Root())
 }
 
+// PurgeProject removes project files, tags of untagged project are kept
+// until they're removed by their own names
 func (r Registry) PurgeProject(name string) error {
-	return os.RemoveAll(r.Project(name).Root())
+	pr := r.Project(name)
+	if pr.Name() == "" {
+		return nil
+	}
+
+	files, err := pr.Files()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := os.RemoveAll(file); err != nil {
+			return err
+		}
+	}
+
+	// directory of tagged project could be left empty
+	if pr.tag != "" {
+		os.Remove(pr.TagsDir())
+		os.Remove(filepath.Dir(pr.TagsDir()))
+	}
+
+	return nil
 }
 
 func (r Registry) Root() string {
@@ -173,36 +254,109 @@ func (r Registry) RuntimeFile() string {
 	return filepath.Join(r.root, cfgRuntimeFile)
 }
 
+// Returns directory of named volumes, which aren't bound to any project
+func (r Registry) VolumesDir() string {
+	return filepath.Join(r.root, cfgVolumesDir)
+}
+
+// Returns cache of downloaded kernels and volumes shared by projects
+func (r Registry) CacheDir() string {
+	return filepath.Join(r.root, cfgCacheDir)
+}
+
+// File with api tokens of profiles, it's readable by owner only
+func (r Registry) CredentialsFile() string {
+	return filepath.Join(r.root, cfgCredentials)
+}
+
+// File with log sinks used by older versions, one uri per line, they're
+// moved to config
+func (r Registry) LogSinkFile() string {
+	return filepath.Join(r.root, cfgLogSinkFile)
+}
+
+// File with probed capabilities of qemu binaries
+func (r Registry) CapabilitiesFile() string {
+	return filepath.Join(r.root, cfgCapabilities)
+}
+
 func (r Registry) Structure() []string {
 	return []string{
 		r.Root(),
 		r.Projects(),
+		r.VolumesDir(),
+		r.CacheDir(),
 	}
 }
 
 // Returns project root, e.g.: ~/.virgo/projects/hello
 // For community projects root is nested in username/projects directory.
+// Tagged projects are kept in tags directory of project, e.g.:
+// ~/.virgo/projects/hello/tags/1.0
 func (p Project) Root() string {
+	if p.tag != "" {
+		return filepath.Join(p.TagsDir(), p.tag)
+	}
+
 	return filepath.Join(p.root, cfgProjectsDir, p.name)
 }
 
+// Returns project name with tag, latest tag is omitted
 func (p Project) Name() string {
+	if p.tag != "" {
+		return p.name + ":" + p.tag
+	}
+
+	return p.name
+}
+
+// Returns project name without tag, as it's known to api
+func (p Project) Repository() string {
 	return p.name
 }
 
+func (p Project) Tag() string {
+	if p.tag != "" {
+		return p.tag
+	}
+
+	return cfgDefaultTag
+}
+
+// Returns directory of all tags of project
+func (p Project) TagsDir() string {
+	return filepath.Join(p.root, cfgProjectsDir, p.name, cfgTagsDir)
+}
+
 func (p Project) LogsDir() string {
 	return filepath.Join(p.Root(), cfgLogsDir)
 }
 
+// Returns guest serial output file of instance
+func (p Project) SerialLogFile(num int) string {
+	return filepath.Join(p.LogsDir(), fmt.Sprintf(serialLog, num))
+}
+
+// Returns output file of background helpers of instance, such as log
+// shipper and health monitor
+func (p Project) HelperLogFile(num int) string {
+	return filepath.Join(p.LogsDir(), fmt.Sprintf(cfgHelperLog, num))
+}
+
+// Returns health state file of instance
+func (p Project) HealthFile(num int) string {
+	return filepath.Join(p.Root(), fmt.Sprintf(cfgHealthFile, num))
+}
+
 func (p Project) KernelDir() string {
 	return filepath.Join(p.Root(), cfgKernelDir)
 }
 
 func (p Project) KernelFile() string {
-	file := filepath.Join(p.Root(), cfgKernelDir, p.Name())
+	file := filepath.Join(p.Root(), cfgKernelDir, p.name)
 
 	if p.IsCommunity() {
-		name := strings.Replace(p.Name(), "/", "_", -1)
+		name := strings.Replace(p.name, "/", "_", -1)
 		file = filepath.Join(p.Root(), cfgKernelDir, name)
 	}
 
@@ -213,23 +367,101 @@ func (p Project) VolumesDir() string {
 	return filepath.Join(p.Root(), cfgVolumesDir)
 }
 
+// Returns pristine manifest volume with given id, e.g.:
+// ~/.virgo/projects/hello/volumes/vol7887
+func (p Project) VolumeFile(id int) string {
+	return filepath.Join(p.VolumesDir(), "vol"+strconv.Itoa(id))
+}
+
+// Returns directory of copy-on-write overlays of all instances
+func (p Project) OverlaysRoot() string {
+	return filepath.Join(p.Root(), cfgOverlaysDir)
+}
+
+// Returns directory of copy-on-write overlays of instance volumes, e.g.:
+// ~/.virgo/projects/hello/overlays/1
+func (p Project) OverlaysDir(num int) string {
+	return filepath.Join(p.OverlaysRoot(), strconv.Itoa(num))
+}
+
+// Returns overlay of manifest volume with given id for instance
+func (p Project) OverlayFile(num, id int) string {
+	return filepath.Join(p.OverlaysDir(num), "vol"+strconv.Itoa(id)+".qcow2")
+}
+
+// Returns raw overlay of manifest volume, it's a copy of volume made for
+// hypervisors without qcow2 support
+func (p Project) RawOverlayFile(num, id int) string {
+	return filepath.Join(p.OverlaysDir(num), "vol"+strconv.Itoa(id)+".raw")
+}
+
+// Returns api socket of hypervisor running instance
+func (p Project) SocketFile(num int) string {
+	return filepath.Join(p.Root(), fmt.Sprintf(cfgSocketFile, num))
+}
+
+// Returns probed capabilities of qemu binaries, they're shared by all
+// projects
+func (p Project) CapabilitiesFile() string {
+	return filepath.Join(p.root, cfgCapabilities)
+}
+
+// Returns directory of images built from host directories of all instances
+func (p Project) MountsRoot() string {
+	return filepath.Join(p.Root(), cfgMountsDir)
+}
+
+// Returns directory of images built from host directories mounted into
+// instance
+func (p Project) MountsDir(num int) string {
+	return filepath.Join(p.MountsRoot(), strconv.Itoa(num))
+}
+
+// Returns image of i-th host directory mounted into instance
+func (p Project) MountFile(num, i int) string {
+	return filepath.Join(p.MountsDir(num), "mount"+strconv.Itoa(i)+".iso")
+}
+
 func (p Project) ManifestFile() string {
-	file := filepath.Join(p.Root(), p.Name()+"."+cfgManifestFile)
+	file := filepath.Join(p.Root(), p.name+"."+cfgManifestFile)
 
 	if p.IsCommunity() {
-		parts := strings.Split(p.Name(), "/")
+		parts := strings.Split(p.name, "/")
 		file = filepath.Join(p.Root(), parts[1]+"."+cfgManifestFile)
 	}
 
 	return file
 }
 
-func (p Project) IfUpFile() string {
-	return filepath.Join(p.Root(), cfgIfUpFile)
+// Returns config file with settings overriding global ones
+func (p Project) ConfigFile() string {
+	return filepath.Join(p.Root(), cfgConfigFile)
+}
+
+// File touched on every run of project
+func (p Project) LastRunFile() string {
+	return filepath.Join(p.Root(), cfgLastRunFile)
+}
+
+// Returns time project was run last time, projects which were never run
+// report time they were pulled
+func (p Project) LastRun() time.Time {
+	for _, file := range []string{p.LastRunFile(), p.ManifestFile()} {
+		if info, err := os.Stat(file); err == nil {
+			return info.ModTime()
+		}
+	}
+
+	return time.Time{}
+}
+
+// Returns tap scripts of instance, they carry its subnet
+func (p Project) IfUpFile(num int) string {
+	return filepath.Join(p.Root(), fmt.Sprintf(cfgIfUpFile, num))
 }
 
-func (p Project) IfDownFile() string {
-	return filepath.Join(p.Root(), cfgIfDownFile)
+func (p Project) IfDownFile(num int) string {
+	return filepath.Join(p.Root(), fmt.Sprintf(cfgIfDownFile, num))
 }
 
 func (p Project) IsCommunity() bool {
@@ -2,7 +2,10 @@ package registry
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/deferpanic/virgo/pkg/tools"
@@ -12,6 +15,8 @@ func expectedRoot() []string {
 	return []string{
 		"/tmp/.virgo",
 		"/tmp/.virgo/projects",
+		"/tmp/.virgo/volumes",
+		"/tmp/.virgo/cache",
 	}
 }
 
@@ -108,3 +113,118 @@ func TestRegistryCommunity(t *testing.T) {
 		t.Error("Expecting error for wrong format")
 	}
 }
+
+func TestUsage(t *testing.T) {
+	r, err := New("/tmp/.virgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.purge()
+
+	p, err := r.AddProject("project1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]int{
+		p.KernelFile():      10000,
+		p.VolumeFile(1):     20000,
+		p.SerialLogFile(1):  3000,
+		p.OverlayFile(1, 1): 5000,
+		p.MountFile(1, 0):   4000,
+		p.ManifestFile():    100,
+	}
+
+	for file, size := range files {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(file, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, err := p.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Kernel < 10000 || u.Volumes < 20000 || u.Logs < 3000 || u.Snapshots < 9000 || u.Other < 100 {
+		t.Fatalf("Unexpected usage %+v\n", u)
+	}
+
+	total, err := DiskUsage(p.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Total() != total {
+		t.Fatalf("Expected total %d, obtained %d\n", total, u.Total())
+	}
+
+	if size, err := DiskUsage("/nonexistent"); err != nil || size != 0 {
+		t.Fatalf("Expected no usage of missing path, obtained %d, %v\n", size, err)
+	}
+}
+
+func TestTag(t *testing.T) {
+	r, err := New("/tmp/.virgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.purge()
+
+	if _, err := r.AddProject("hello:wrong/tag"); err == nil {
+		t.Fatal("Expecting error for wrong tag")
+	}
+
+	p, err := r.AddProject("hello:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Name() != "hello" || p.Tag() != "latest" {
+		t.Fatalf("Expected hello:latest, obtained %s:%s\n", p.Name(), p.Tag())
+	}
+
+	for _, file := range []string{p.KernelFile(), p.ManifestFile(), p.VolumeFile(1)} {
+		if err := ioutil.WriteFile(file, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tagged, err := r.Tag("hello", ":stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tagged.Root() != "/tmp/.virgo/projects/hello/tags/stable" {
+		t.Fatalf("Expected root in tags directory, obtained %s\n", tagged.Root())
+	}
+
+	if b, err := ioutil.ReadFile(tagged.VolumeFile(1)); err != nil || string(b) != p.VolumeFile(1) {
+		t.Fatalf("Expected volume to be copied, obtained '%s', %v\n", b, err)
+	}
+
+	r, err = New("/tmp/.virgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Project("hello:stable").Name() != "hello:stable" || r.Project("hello").Name() != "hello" {
+		t.Fatalf("Expected both tags to be loaded, obtained %v\n", r.ProjectList())
+	}
+
+	if err := r.PurgeProject("hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(tagged.KernelFile()); err != nil {
+		t.Fatalf("Expected tag to outlive project - %s\n", err)
+	}
+
+	if _, err := os.Stat(p.KernelFile()); !os.IsNotExist(err) {
+		t.Fatalf("Expected kernel of project to be removed, obtained %v\n", err)
+	}
+}
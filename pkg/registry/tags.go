@@ -0,0 +1,214 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	tagRe  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+	nameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// SplitTag splits project reference to name and tag, latest tag is
+// returned as empty one
+func SplitTag(ref string) (string, string) {
+	i := strings.LastIndex(ref, ":")
+	if i < 0 {
+		return ref, ""
+	}
+
+	name, tag := ref[:i], ref[i+1:]
+
+	if tag == cfgDefaultTag {
+		tag = ""
+	}
+
+	return name, tag
+}
+
+// ValidName checks every part of project name, so name can't point
+// outside of projects directory, e.g. "..", "../x" or "/x"
+func ValidName(name string) error {
+	for _, part := range strings.Split(name, "/") {
+		if part == "." || part == ".." || !nameRe.MatchString(part) {
+			return fmt.Errorf("wrong project name '%s', only letters, digits, '_', '.' and '-' are allowed in its parts", name)
+		}
+	}
+
+	return nil
+}
+
+func validTag(tag string) error {
+	if tag != "" && !tagRe.MatchString(tag) {
+		return fmt.Errorf("wrong tag '%s', only letters, digits, '_', '.' and '-' are allowed", tag)
+	}
+
+	return nil
+}
+
+// loadTags adds tagged projects found in tags directory of project,
+// returns false if project has no tags
+func (r *Registry) loadTags(name string) (bool, error) {
+	tagsDir := Project{name: name, root: r.root}.TagsDir()
+
+	list, err := ioutil.ReadDir(tagsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	for _, info := range list {
+		if !info.IsDir() {
+			continue
+		}
+
+		if _, err := r.AddProject(name + ":" + info.Name()); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Tag makes target project a copy of source one, files are hard linked
+// if possible. Target is replaced if it exists.
+func (r *Registry) Tag(source, target string) (Project, error) {
+	src := r.Project(source)
+	if src.Name() == "" {
+		return Project{}, fmt.Errorf("Project '%s' not found", source)
+	}
+
+	if _, err := os.Stat(src.ManifestFile()); err != nil {
+		return Project{}, fmt.Errorf("Project '%s' isn't pulled", source)
+	}
+
+	if name, _ := SplitTag(target); name == "" {
+		target = src.Repository() + target
+	}
+
+	dst, err := r.AddProject(target)
+	if err != nil {
+		return Project{}, err
+	}
+
+	if dst.Name() == src.Name() {
+		return dst, nil
+	}
+
+	// overlays can't outlive volumes they're backed by
+	for _, dir := range []string{dst.VolumesDir(), dst.OverlaysRoot()} {
+		if err := os.RemoveAll(dir); err != nil {
+			return Project{}, err
+		}
+	}
+
+	if err := os.MkdirAll(dst.VolumesDir(), 0755); err != nil {
+		return Project{}, err
+	}
+
+	files := map[string]string{
+		src.KernelFile():   dst.KernelFile(),
+		src.ManifestFile(): dst.ManifestFile(),
+	}
+
+	volumes, err := ioutil.ReadDir(src.VolumesDir())
+	if err != nil && !os.IsNotExist(err) {
+		return Project{}, err
+	}
+
+	for _, info := range volumes {
+		files[filepath.Join(src.VolumesDir(), info.Name())] = filepath.Join(dst.VolumesDir(), info.Name())
+	}
+
+	for from, to := range files {
+		if err := linkFile(from, to); err != nil {
+			return Project{}, fmt.Errorf("error tagging '%s' - %s", src.Name(), err)
+		}
+	}
+
+	return dst, nil
+}
+
+// linkFile hard links file, falling back to copy
+func linkFile(from, to string) error {
+	if err := os.Remove(to); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Link(from, to); err == nil {
+		return nil
+	}
+
+	rd, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	wr, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(wr, rd); err != nil {
+		wr.Close()
+		return err
+	}
+
+	return wr.Close()
+}
+
+// Files returns top level files of project, tags of untagged project are
+// skipped
+func (p Project) Files() ([]string, error) {
+	if p.tag != "" {
+		return []string{p.Root()}, nil
+	}
+
+	if _, err := os.Stat(p.TagsDir()); err != nil {
+		return []string{p.Root()}, nil
+	}
+
+	list, err := ioutil.ReadDir(p.Root())
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+
+	for _, info := range list {
+		if file := filepath.Join(p.Root(), info.Name()); file != p.TagsDir() {
+			result = append(result, file)
+		}
+	}
+
+	return result, nil
+}
+
+// Hash returns sha256 of project kernel
+func (p Project) Hash() (string, error) {
+	rd, err := os.Open(p.KernelFile())
+	if err != nil {
+		return "", err
+	}
+	defer rd.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, rd); err != nil {
+		return "", fmt.Errorf("error reading kernel of '%s' - %s", p.Name(), err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Usage is disk space taken by project, snapshots are overlays and images
+// of mounted host directories
+type Usage struct {
+	Kernel    int64
+	Volumes   int64
+	Logs      int64
+	Snapshots int64
+	Other     int64
+}
+
+func (u Usage) Total() int64 {
+	return u.Kernel + u.Volumes + u.Logs + u.Snapshots + u.Other
+}
+
+// Usage returns disk space taken by project files, tags are counted
+// separately
+func (p Project) Usage() (Usage, error) {
+	var u Usage
+
+	total := int64(0)
+
+	files, err := p.Files()
+	if err != nil {
+		return u, err
+	}
+
+	for _, file := range files {
+		size, err := DiskUsage(file)
+		if err != nil {
+			return u, err
+		}
+
+		total += size
+	}
+
+	parts := []struct {
+		size *int64
+		dirs []string
+	}{
+		{&u.Kernel, []string{p.KernelDir()}},
+		{&u.Volumes, []string{p.VolumesDir()}},
+		{&u.Logs, []string{p.LogsDir()}},
+		{&u.Snapshots, []string{p.OverlaysRoot(), p.MountsRoot()}},
+	}
+
+	rest := total
+
+	for _, part := range parts {
+		for _, dir := range part.dirs {
+			size, err := DiskUsage(dir)
+			if err != nil {
+				return u, err
+			}
+
+			*part.size += size
+			rest -= size
+		}
+	}
+
+	u.Other = rest
+
+	return u, nil
+}
+
+// DiskUsage returns space taken by files in path, sparse images are
+// counted by allocated blocks. Missing path takes no space.
+func DiskUsage(path string) (int64, error) {
+	var total int64
+
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			total += int64(st.Blocks) * 512
+		} else {
+			total += info.Size()
+		}
+
+		return nil
+	})
+
+	return total, err
+}
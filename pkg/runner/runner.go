@@ -93,6 +93,12 @@ func (r *ExecRunner) SetDetached(v bool) {
 	r.Detached = v
 }
 
+// SetOutput redirects output of processes started by Exec
+func (r *ExecRunner) SetOutput(stdout, stderr *os.File) {
+	r.stdout = stdout
+	r.stderr = stderr
+}
+
 func (r *ExecRunner) IsAlive() bool {
 	// this is wrong, but temporary needed
 	if r.Pid != 0 {
@@ -110,6 +116,17 @@ func (r *ExecRunner) IsAlive() bool {
 	return false
 }
 
+// IsPidAlive checks if process with given pid exists
+func IsPidAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	err := syscall.Kill(pid, syscall.Signal(0))
+
+	return err == nil || err == syscall.EPERM
+}
+
 func (r *ExecRunner) Stop() error {
 	var (
 		pid int
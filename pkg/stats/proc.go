@@ -0,0 +1,159 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// USER_HZ, it's 100 on all supported architectures
+const clockTicks = 100
+
+var (
+	ProcRoot = "/proc"
+	NetRoot  = "/sys/class/net"
+)
+
+// Proc contains process counters read from /proc/<pid>/{stat,status,io}
+type Proc struct {
+	CPUTime    time.Duration // user + system time
+	StartTime  time.Duration // since system boot
+	RSS        uint64        // bytes
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+// Net contains interface counters read from /sys/class/net/<iface>/statistics
+type Net struct {
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+}
+
+func ReadProc(pid int) (Proc, error) {
+	result := Proc{}
+	dir := filepath.Join(ProcRoot, strconv.Itoa(pid))
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return result, err
+	}
+
+	// second field is command name in braces, which could contain spaces
+	stat := string(b)
+	if i := strings.LastIndex(stat, ")"); i != -1 {
+		stat = stat[i+1:]
+	}
+
+	fields := strings.Fields(stat)
+	if len(fields) < 20 {
+		return result, fmt.Errorf("unexpected format of %s/stat", dir)
+	}
+
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	start, _ := strconv.ParseUint(fields[19], 10, 64)
+
+	result.CPUTime = ticks(utime + stime)
+	result.StartTime = ticks(start)
+
+	status, err := readKeyValues(filepath.Join(dir, "status"))
+	if err != nil {
+		return result, err
+	}
+
+	// VmRSS is in kB
+	result.RSS = status["VmRSS"] * 1024
+
+	// io is readable only by owner, skip it silently
+	if io, err := readKeyValues(filepath.Join(dir, "io")); err == nil {
+		result.ReadBytes = io["read_bytes"]
+		result.WriteBytes = io["write_bytes"]
+	}
+
+	return result, nil
+}
+
+func ReadNet(iface string) (Net, error) {
+	result := Net{}
+	dir := filepath.Join(NetRoot, iface, "statistics")
+
+	for name, v := range map[string]*uint64{
+		"rx_bytes":   &result.RxBytes,
+		"tx_bytes":   &result.TxBytes,
+		"rx_packets": &result.RxPackets,
+		"tx_packets": &result.TxPackets,
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return result, err
+		}
+
+		if *v, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err != nil {
+			return result, fmt.Errorf("unexpected format of %s/%s - %s", dir, name, err)
+		}
+	}
+
+	return result, nil
+}
+
+// Uptime returns time since system boot from /proc/uptime
+func Uptime() (time.Duration, error) {
+	b, err := ioutil.ReadFile(filepath.Join(ProcRoot, "uptime"))
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected format of %s/uptime", ProcRoot)
+	}
+
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected format of %s/uptime - %s", ProcRoot, err)
+	}
+
+	return time.Duration(v * float64(time.Second)), nil
+}
+
+// reads files formatted as "key: value [unit]" lines
+func readKeyValues(file string) (map[string]uint64, error) {
+	result := make(map[string]uint64)
+
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			continue
+		}
+
+		if v, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+			result[strings.TrimSpace(parts[0])] = v
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+func ticks(n uint64) time.Duration {
+	return time.Duration(n) * time.Second / clockTicks
+}
@@ -0,0 +1,132 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Target is single instance to collect stats for
+type Target struct {
+	Project  string
+	Instance int
+	Pid      int
+	Iface    string
+	Restarts int
+}
+
+type Sample struct {
+	Project    string        `json:"project"`
+	Instance   int           `json:"instance"`
+	Pid        int           `json:"pid"`
+	Running    bool          `json:"running"`
+	Restarts   int           `json:"restarts"`
+	CPUPercent float64       `json:"cpu_percent"`
+	CPUTime    time.Duration `json:"cpu_time"`
+	Uptime     time.Duration `json:"uptime"`
+	RSS        uint64        `json:"rss_bytes"`
+	ReadBytes  uint64        `json:"read_bytes"`
+	WriteBytes uint64        `json:"write_bytes"`
+	RxBytes    uint64        `json:"rx_bytes"`
+	TxBytes    uint64        `json:"tx_bytes"`
+	Time       time.Time     `json:"time"`
+}
+
+// Collector keeps previous samples to calculate cpu usage between calls
+type Collector struct {
+	prev map[int]Sample
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		prev: make(map[int]Sample),
+	}
+}
+
+func (c *Collector) Collect(targets []Target) []Sample {
+	result := make([]Sample, 0, len(targets))
+	prev := make(map[int]Sample)
+
+	boot, _ := Uptime()
+
+	for _, t := range targets {
+		s := Sample{
+			Project:  t.Project,
+			Instance: t.Instance,
+			Pid:      t.Pid,
+			Restarts: t.Restarts,
+			Time:     time.Now(),
+		}
+
+		if p, err := ReadProc(t.Pid); err == nil && t.Pid > 0 {
+			s.Running = true
+			s.CPUTime = p.CPUTime
+			s.RSS = p.RSS
+			s.ReadBytes = p.ReadBytes
+			s.WriteBytes = p.WriteBytes
+
+			if boot > p.StartTime {
+				s.Uptime = boot - p.StartTime
+			}
+		}
+
+		if n, err := ReadNet(t.Iface); err == nil && t.Iface != "" {
+			s.RxBytes = n.RxBytes
+			s.TxBytes = n.TxBytes
+		}
+
+		if last, ok := c.prev[t.Pid]; ok && s.Running {
+			if wall := s.Time.Sub(last.Time); wall > 0 {
+				s.CPUPercent = float64(s.CPUTime-last.CPUTime) / float64(wall) * 100
+			}
+		}
+
+		prev[t.Pid] = s
+		result = append(result, s)
+	}
+
+	c.prev = prev
+
+	return result
+}
+
+// WriteTable writes samples as tab separated table, to be used with tabwriter
+func WriteTable(w io.Writer, samples []Sample) {
+	fmt.Fprintf(w, "Projectname\tInstance\tPid\tCPU %%\tCPU time\tMem usage\tNet I/O\tBlock I/O\tUptime\n")
+
+	for _, s := range samples {
+		if !s.Running {
+			fmt.Fprintf(w, "%s\t%d\t%d\t--\t--\t--\t--\t--\tdown\n", s.Project, s.Instance, s.Pid)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.2f%%\t%s\t%s\t%s / %s\t%s / %s\t%s\n",
+			s.Project,
+			s.Instance,
+			s.Pid,
+			s.CPUPercent,
+			s.CPUTime.Truncate(time.Millisecond*10),
+			HumanBytes(s.RSS),
+			HumanBytes(s.RxBytes), HumanBytes(s.TxBytes),
+			HumanBytes(s.ReadBytes), HumanBytes(s.WriteBytes),
+			s.Uptime.Truncate(time.Second),
+		)
+	}
+}
+
+func HumanBytes(n uint64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := uint64(unit), 0
+
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.2f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
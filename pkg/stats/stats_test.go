@@ -0,0 +1,113 @@
+package stats
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSampleData(t *testing.T, file, data string) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fakeRoots(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	procRoot, netRoot := ProcRoot, NetRoot
+	ProcRoot = filepath.Join(dir, "proc")
+	NetRoot = filepath.Join(dir, "net")
+
+	writeSampleData(t, filepath.Join(ProcRoot, "uptime"), "1000.50 3000.00\n")
+	writeSampleData(t, filepath.Join(ProcRoot, "42", "stat"), "42 (qemu-system-x86 ) S 1 42 42 0 -1 4194560 1000 0 0 0 150 50 0 0 20 0 3 0 50000 1000000 2000 18446744073709551615\n")
+	writeSampleData(t, filepath.Join(ProcRoot, "42", "status"), "Name:\tqemu-system-x86\nVmRSS:\t   2048 kB\nThreads:\t3\n")
+	writeSampleData(t, filepath.Join(ProcRoot, "42", "io"), "rchar: 1\nwchar: 2\nread_bytes: 4096\nwrite_bytes: 8192\n")
+
+	for name, v := range map[string]string{"rx_bytes": "100", "tx_bytes": "200", "rx_packets": "1", "tx_packets": "2"} {
+		writeSampleData(t, filepath.Join(NetRoot, "tap1", "statistics", name), v+"\n")
+	}
+
+	return func() {
+		ProcRoot, NetRoot = procRoot, netRoot
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReadProc(t *testing.T) {
+	defer fakeRoots(t)()
+
+	p, err := ReadProc(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.CPUTime != 2*time.Second {
+		t.Errorf("Expected cpu time 2s, obtained %s\n", p.CPUTime)
+	}
+
+	if p.StartTime != 500*time.Second {
+		t.Errorf("Expected start time 500s, obtained %s\n", p.StartTime)
+	}
+
+	if p.RSS != 2048*1024 {
+		t.Errorf("Expected rss %d, obtained %d\n", 2048*1024, p.RSS)
+	}
+
+	if p.ReadBytes != 4096 || p.WriteBytes != 8192 {
+		t.Errorf("Unexpected io counters: %d, %d\n", p.ReadBytes, p.WriteBytes)
+	}
+
+	if _, err := ReadProc(43); err == nil {
+		t.Error("Expecting error for missing process")
+	}
+}
+
+func TestCollect(t *testing.T) {
+	defer fakeRoots(t)()
+
+	targets := []Target{
+		{Project: "hello", Instance: 1, Pid: 42, Iface: "tap1"},
+		{Project: "hello", Instance: 2, Pid: 43, Iface: "tap2"},
+	}
+
+	samples := NewCollector().Collect(targets)
+
+	if len(samples) != 2 {
+		t.Fatalf("Expected 2 samples, obtained %d\n", len(samples))
+	}
+
+	if s := samples[0]; !s.Running || s.RxBytes != 100 || s.TxBytes != 200 || s.Uptime != 500500*time.Millisecond {
+		t.Errorf("Unexpected sample: %#v\n", s)
+	}
+
+	if samples[1].Running {
+		t.Error("Expecting second instance is down")
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tt := map[uint64]string{
+		0:       "0B",
+		1023:    "1023B",
+		1024:    "1.00KiB",
+		1536:    "1.50KiB",
+		1 << 20: "1.00MiB",
+		5 << 30: "5.00GiB",
+	}
+
+	for n, expected := range tt {
+		if obtained := HumanBytes(n); obtained != expected {
+			t.Errorf("Expected '%s' for %d, obtained '%s'\n", expected, n, obtained)
+		}
+	}
+}
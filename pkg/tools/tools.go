@@ -1,9 +1,12 @@
 package tools
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"strings"
 	"text/tabwriter"
 
@@ -45,24 +48,47 @@ func (ss StringSlice) Contains(s string) bool {
 	return false
 }
 
-func SetToken() error {
-	f := os.Getenv("HOME") + "/.dprc"
+var token string
 
-	dat, err := ioutil.ReadFile(f)
-	if err != nil {
-		return fmt.Errorf("error reading file '%s' - %s", f, err)
-	}
+// Token returns api token set by SetToken
+func Token() string {
+	return token
+}
 
-	dtoken := string(dat)
+// SetToken sets token used by api calls
+func SetToken(t string) {
+	token = t
+	api.Cli = api.NewCliImplementation(t)
+}
+
+// ReadPassword prints prompt and reads line from stdin, terminal echo is
+// disabled while it's typed
+func ReadPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
 
-	if dtoken == "" {
-		return fmt.Errorf("error reading token - no token found")
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		stty := func(arg string) error {
+			cmd := exec.Command("stty", arg)
+			cmd.Stdin = os.Stdin
+			return cmd.Run()
+		}
+
+		if err := stty("-echo"); err != nil {
+			return "", fmt.Errorf("error disabling terminal echo - %s", err)
+		}
+
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
 	}
 
-	dtoken = strings.TrimSpace(dtoken)
-	api.Cli = api.NewCliImplementation(dtoken)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("error reading input - %s", err)
+	}
 
-	return nil
+	return strings.TrimSpace(line), nil
 }
 
 func ShowFiles(dir string) error {
@@ -0,0 +1,212 @@
+package volume
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/deferpanic/virgo/pkg/iso9660"
+)
+
+const (
+	FsIso9660 = "iso9660"
+
+	ext2Magic = 0xef53
+	ffsMagic  = 0x011954
+	ffs2Magic = 0x19540119
+)
+
+// Detect returns image format and filesystem found in it, filesystem is
+// empty if unknown or image isn't raw
+func Detect(file string) (string, string, error) {
+	rd, err := os.Open(file)
+	if err != nil {
+		return "", "", err
+	}
+	defer rd.Close()
+
+	b := make([]byte, 70*1024)
+
+	n, err := io.ReadFull(rd, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", "", fmt.Errorf("error reading %s - %s", file, err)
+	}
+
+	b = b[:n]
+
+	at := func(off, size int) []byte {
+		if off+size > len(b) {
+			return nil
+		}
+
+		return b[off : off+size]
+	}
+
+	if bytes.Equal(at(0, 4), []byte("QFI\xfb")) {
+		return FormatQcow2, "", nil
+	}
+
+	switch {
+	case bytes.Equal(at(32769, 5), []byte("CD001")):
+		return FormatRaw, FsIso9660, nil
+
+	case at(1080, 2) != nil && binary.LittleEndian.Uint16(at(1080, 2)) == ext2Magic:
+		return FormatRaw, FsExt2, nil
+
+	// superblock of ffs v1 is at 8192, ffs v2 is at 65536
+	case at(8192+1372, 4) != nil && binary.LittleEndian.Uint32(at(8192+1372, 4)) == ffsMagic,
+		at(65536+1372, 4) != nil && binary.LittleEndian.Uint32(at(65536+1372, 4)) == ffs2Magic:
+		return FormatRaw, FsFfs, nil
+
+	case bytes.Equal(at(510, 2), []byte{0x55, 0xaa}) && (bytes.HasPrefix(at(54, 5), []byte("FAT")) || bytes.HasPrefix(at(82, 5), []byte("FAT"))):
+		return FormatRaw, FsFat, nil
+	}
+
+	return FormatRaw, "", nil
+}
+
+// ExportTar writes files of ISO9660 image to tar archive
+func ExportTar(image string, w io.Writer) error {
+	rd, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	tw := tar.NewWriter(w)
+
+	err = iso9660.Walk(rd, func(f iso9660.File) error {
+		hdr := &tar.Header{
+			Name:    f.Path,
+			Mode:    0644,
+			Size:    f.Size,
+			ModTime: f.ModTime,
+		}
+
+		if f.Dir {
+			hdr.Name += "/"
+			hdr.Mode = 0755
+			hdr.Size = 0
+			hdr.Typeflag = tar.TypeDir
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if f.Dir {
+			return nil
+		}
+
+		_, err := io.Copy(tw, f.Reader)
+
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error exporting %s - %s", image, err)
+	}
+
+	return tw.Close()
+}
+
+// ExportRaw writes disk image itself to tar archive under given name
+func ExportRaw(image, name string, w io.Writer) error {
+	rd, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	info, err := rd.Stat()
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tw, rd); err != nil {
+		return fmt.Errorf("error exporting %s - %s", image, err)
+	}
+
+	return tw.Close()
+}
+
+// ImportTar builds ISO9660 image from files of tar archive
+func ImportTar(r io.Reader, image string) error {
+	dir, err := ioutil.TempDir("", "virgo-import")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("error reading archive - %s", err)
+		}
+
+		name := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+
+		if name != dir && !strings.HasPrefix(name, dir+string(filepath.Separator)) {
+			return fmt.Errorf("wrong path '%s' in archive", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+
+			wr, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(wr, tr)
+			wr.Close()
+
+			if err != nil {
+				return fmt.Errorf("error extracting '%s' - %s", hdr.Name, err)
+			}
+
+			os.Chtimes(name, hdr.ModTime, hdr.ModTime)
+		}
+	}
+
+	// image is replaced only when it's completely built
+	tmp := image + ".tmp"
+
+	if err := iso9660.Build(dir, tmp); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, image)
+}
@@ -0,0 +1,352 @@
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deferpanic/virgo/pkg/runner"
+)
+
+const (
+	FormatRaw   = "raw"
+	FormatQcow2 = "qcow2"
+
+	FsFfs  = "ffs"
+	FsExt2 = "ext2"
+	FsFat  = "fat"
+
+	metaExt = ".json"
+)
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Volume is a persistent disk image, which isn't bound to any project
+type Volume struct {
+	Name    string    `json:"name"`
+	Format  string    `json:"format"`
+	Fs      string    `json:"fs,omitempty"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	Path    string    `json:"path"`
+}
+
+// Attached is a volume given to instance, e.g.: run -v data:/data
+type Attached struct {
+	Name     string
+	File     string
+	Format   string
+	Mount    string
+	ReadOnly bool
+}
+
+func (a Attached) String() string {
+	return a.Name + ":" + a.Mount
+}
+
+// Store keeps volumes as <name>.<format> images together with <name>.json
+// metadata in single directory, e.g.: ~/.virgo/volumes
+type Store struct {
+	dir string
+	r   runner.Runner
+}
+
+func NewStore(dir string, r runner.Runner) Store {
+	return Store{
+		dir: dir,
+		r:   r,
+	}
+}
+
+func (s Store) Dir() string {
+	return s.dir
+}
+
+// Create makes new volume of given size in bytes. Image is created by
+// qemu-img and optionally formatted by host tools.
+func (s Store) Create(name string, size int64, format, fs string) (*Volume, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("wrong volume name '%s', only letters, digits, '_', '.' and '-' are allowed", name)
+	}
+
+	if format == "" {
+		format = FormatRaw
+	}
+
+	if format != FormatRaw && format != FormatQcow2 {
+		return nil, fmt.Errorf("unknown volume format '%s', should be raw or qcow2", format)
+	}
+
+	if size <= 0 {
+		return nil, fmt.Errorf("volume size has to be positive")
+	}
+
+	if _, err := s.Get(name); err == nil {
+		return nil, fmt.Errorf("volume '%s' already exists", name)
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating volumes directory - %s", err)
+	}
+
+	v := &Volume{
+		Name:    name,
+		Format:  format,
+		Fs:      fs,
+		Size:    size,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Path:    s.imageFile(name, format),
+	}
+
+	if err := s.createImage(v); err != nil {
+		os.Remove(v.Path)
+		return nil, err
+	}
+
+	if _, ok := s.r.(runner.DryRunner); ok {
+		return v, nil
+	}
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(s.metaFile(name), b, 0644); err != nil {
+		os.Remove(v.Path)
+		return nil, fmt.Errorf("error writing volume metadata - %s", err)
+	}
+
+	return v, nil
+}
+
+func (s Store) Get(name string) (*Volume, error) {
+	b, err := ioutil.ReadFile(s.metaFile(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("volume '%s' not found", name)
+		}
+
+		return nil, fmt.Errorf("error reading volume '%s' - %s", name, err)
+	}
+
+	v := &Volume{}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, fmt.Errorf("error parsing metadata of volume '%s' - %s", name, err)
+	}
+
+	// registry root may be moved
+	v.Path = s.imageFile(v.Name, v.Format)
+
+	return v, nil
+}
+
+// List returns volumes sorted by name
+func (s Store) List() ([]*Volume, error) {
+	result := []*Volume{}
+
+	list, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+
+		return nil, fmt.Errorf("error listing volumes - %s", err)
+	}
+
+	for _, info := range list {
+		if info.IsDir() || filepath.Ext(info.Name()) != metaExt {
+			continue
+		}
+
+		v, err := s.Get(strings.TrimSuffix(info.Name(), metaExt))
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, v)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result, nil
+}
+
+func (s Store) Remove(name string) error {
+	v, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.r.(runner.DryRunner); ok {
+		_, err := s.r.Shell("rm -f " + v.Path + " " + s.metaFile(name))
+		return err
+	}
+
+	if err := os.Remove(v.Path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing volume '%s' - %s", name, err)
+	}
+
+	return os.Remove(s.metaFile(name))
+}
+
+// Attach resolves mount spec name:/path to volume image
+func (s Store) Attach(spec string) (Attached, error) {
+	m, err := ParseMount(spec)
+	if err != nil {
+		return Attached{}, err
+	}
+
+	v, err := s.Get(m.Name)
+	if err != nil {
+		return Attached{}, err
+	}
+
+	m.File = v.Path
+	m.Format = v.Format
+
+	return m, nil
+}
+
+func (s Store) createImage(v *Volume) error {
+	size := strconv.FormatInt(v.Size, 10)
+
+	if v.Fs == "" {
+		return s.shell("qemu-img", "qemu-img create -q -f "+v.Format+" "+v.Path+" "+size)
+	}
+
+	// filesystems are made on raw image, which is converted afterwards
+	raw := v.Path
+	if v.Format != FormatRaw {
+		raw = v.Path + ".raw"
+		defer os.Remove(raw)
+	}
+
+	switch v.Fs {
+	case FsFfs:
+		empty, err := ioutil.TempDir("", "virgo-volume")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(empty)
+
+		if err := s.shell("makefs", "makefs -t ffs -s "+size+" "+raw+" "+empty); err != nil {
+			return err
+		}
+
+	case FsExt2:
+		if err := s.shell("qemu-img", "qemu-img create -q -f raw "+raw+" "+size); err != nil {
+			return err
+		}
+
+		if err := s.shell("mke2fs", "mke2fs -q -F -t ext2 "+raw); err != nil {
+			return err
+		}
+
+	case FsFat:
+		if err := s.shell("qemu-img", "qemu-img create -q -f raw "+raw+" "+size); err != nil {
+			return err
+		}
+
+		if err := s.shell("mkfs.fat", "mkfs.fat "+raw); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown filesystem '%s', should be ffs, ext2 or fat", v.Fs)
+	}
+
+	if raw == v.Path {
+		return nil
+	}
+
+	return s.shell("qemu-img", "qemu-img convert -f raw -O "+v.Format+" "+raw+" "+v.Path)
+}
+
+// shell runs cmd checking that tool is installed first
+func (s Store) shell(tool, cmd string) error {
+	if _, ok := s.r.(runner.DryRunner); !ok {
+		if _, err := s.r.Shell("which " + tool); err != nil {
+			return fmt.Errorf("%s not found, please install it to create this volume", tool)
+		}
+	}
+
+	if out, err := s.r.Shell(cmd); err != nil {
+		return fmt.Errorf("error running '%s' - %s\n%s", cmd, err, out)
+	}
+
+	return nil
+}
+
+func (s Store) imageFile(name, format string) string {
+	ext := ".img"
+	if format == FormatQcow2 {
+		ext = ".qcow2"
+	}
+
+	return filepath.Join(s.dir, name+ext)
+}
+
+func (s Store) metaFile(name string) string {
+	return filepath.Join(s.dir, name+metaExt)
+}
+
+// ParseMount parses volume mount spec, e.g.: data:/data
+func ParseMount(spec string) (Attached, error) {
+	i := strings.Index(spec, ":")
+	if i <= 0 {
+		return Attached{}, fmt.Errorf("wrong volume '%s', should be name:/path", spec)
+	}
+
+	a := Attached{
+		Name:  spec[:i],
+		Mount: spec[i+1:],
+	}
+
+	if !validName.MatchString(a.Name) {
+		return Attached{}, fmt.Errorf("wrong volume name '%s'", a.Name)
+	}
+
+	if !strings.HasPrefix(a.Mount, "/") || strings.ContainsAny(a.Mount, "\" ") {
+		return Attached{}, fmt.Errorf("wrong mountpoint '%s' of volume '%s', should be absolute path", a.Mount, a.Name)
+	}
+
+	return a, nil
+}
+
+// ParseSize converts size like 512M or 1G to bytes, plain numbers are bytes
+func ParseSize(s string) (int64, error) {
+	units := map[byte]int64{
+		'K': 1 << 10,
+		'M': 1 << 20,
+		'G': 1 << 30,
+		'T': 1 << 40,
+	}
+
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if v == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	mult := int64(1)
+
+	if m, ok := units[v[len(v)-1]]; ok {
+		mult = m
+		v = v[:len(v)-1]
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("wrong size '%s', should be e.g. 512M or 1G", s)
+	}
+
+	return n * mult, nil
+}
@@ -0,0 +1,205 @@
+package volume
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeRunner pretends every tool is installed and creates images
+// instead of qemu-img
+type fakeRunner struct {
+	cmds []string
+}
+
+func (f *fakeRunner) Exec(name string, args ...string) error          { return nil }
+func (f *fakeRunner) Run(name string, args ...string) ([]byte, error) { return nil, nil }
+func (f *fakeRunner) SetDetached(v bool)                              {}
+func (f *fakeRunner) IsAlive() bool                                   { return false }
+
+func (f *fakeRunner) Shell(cmd string) ([]byte, error) {
+	f.cmds = append(f.cmds, cmd)
+
+	if fields := strings.Fields(cmd); fields[0] == "qemu-img" && fields[1] == "create" {
+		return nil, ioutil.WriteFile(fields[5], nil, 0644)
+	}
+
+	return nil, nil
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-volume-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &fakeRunner{}
+	s := NewStore(dir, r)
+
+	v, err := s.Create("data", 1<<20, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Format != FormatRaw || v.Path != dir+"/data.img" {
+		t.Fatalf("Unexpected volume %+v\n", v)
+	}
+
+	expected := "qemu-img create -q -f raw " + dir + "/data.img 1048576"
+	if r.cmds[len(r.cmds)-1] != expected {
+		t.Fatalf("Expected '%s', obtained '%s'\n", expected, r.cmds[len(r.cmds)-1])
+	}
+
+	if _, err := s.Create("data", 1<<20, "", ""); err == nil {
+		t.Fatal("Expected error creating existing volume")
+	}
+
+	if _, err := s.Create("db", 1<<20, FormatQcow2, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", "../x", "-a"} {
+		if _, err := s.Create(name, 1<<20, "", ""); err == nil {
+			t.Errorf("Expected error for name '%s'\n", name)
+		}
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 2 || list[0].Name != "data" || list[1].Name != "db" || list[1].Path != dir+"/db.qcow2" {
+		t.Fatalf("Unexpected list %v\n", list)
+	}
+
+	a, err := s.Attach("db:/var/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.File != dir+"/db.qcow2" || a.Format != FormatQcow2 || a.Mount != "/var/db" {
+		t.Fatalf("Unexpected attachment %+v\n", a)
+	}
+
+	if err := s.Remove("data"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(dir + "/data.img"); !os.IsNotExist(err) {
+		t.Fatal("Expected image to be removed")
+	}
+
+	if _, err := s.Get("data"); err == nil {
+		t.Fatal("Expected error getting removed volume")
+	}
+}
+
+func TestParseMount(t *testing.T) {
+	a, err := ParseMount("data:/data")
+	if err != nil || a.Name != "data" || a.Mount != "/data" || a.String() != "data:/data" {
+		t.Fatalf("Unexpected result: %+v, %v\n", a, err)
+	}
+
+	for _, spec := range []string{"", "data", ":/data", "data:data", "data:/my data"} {
+		if _, err := ParseMount(spec); err == nil {
+			t.Errorf("Expecting error for '%s'\n", spec)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tt := map[string]int64{
+		"512":  512,
+		"64k":  64 << 10,
+		"512M": 512 << 20,
+		"1G":   1 << 30,
+		"2GB":  2 << 30,
+	}
+
+	for s, expected := range tt {
+		if obtained, err := ParseSize(s); err != nil || obtained != expected {
+			t.Errorf("Expected %d for '%s', obtained %d, %v\n", expected, s, obtained, err)
+		}
+	}
+
+	for _, s := range []string{"", "G", "-1M", "1X"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("Expecting error for '%s'\n", s)
+		}
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo-volume-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"app.conf":          "listen 3000\n",
+		"seed/records.json": `[{"id":1}]`,
+	}
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	for name, data := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+
+		tw.Write([]byte(data))
+	}
+
+	tw.Close()
+
+	image := dir + "/vol1"
+
+	if err := ImportTar(buf, image); err != nil {
+		t.Fatal(err)
+	}
+
+	if format, fs, err := Detect(image); err != nil || format != FormatRaw || fs != FsIso9660 {
+		t.Fatalf("Unexpected format %s and filesystem %s, %v\n", format, fs, err)
+	}
+
+	out := &bytes.Buffer{}
+
+	if err := ExportTar(image, out); err != nil {
+		t.Fatal(err)
+	}
+
+	obtained := make(map[string]string)
+	tr := tar.NewReader(out)
+
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		b, _ := ioutil.ReadAll(tr)
+		obtained[hdr.Name] = string(b)
+	}
+
+	for name, data := range files {
+		if obtained[name] != data {
+			t.Errorf("Expected '%s' to contain '%s', obtained '%s'\n", name, data, obtained[name])
+		}
+	}
+
+	evil := &bytes.Buffer{}
+	tw = tar.NewWriter(evil)
+	tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0644})
+	tw.Close()
+
+	if err := ImportTar(evil, image); err == nil {
+		t.Fatal("Expected error importing path outside of archive root")
+	}
+}